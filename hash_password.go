@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	socks5 "go-socket5/socket5"
+	"os"
+	"strings"
+)
+
+// runHashPassword 生成密码哈希，用于配置中的 password_hash
+//
+//	go-socket5 hash-password [-algo bcrypt|argon2id|scrypt] [password]
+//
+// 未在参数中给出密码时从标准输入读取一行，避免密码留在shell历史中
+func runHashPassword(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	algo := fs.String("algo", socks5.HashBcrypt, "哈希算法: bcrypt, argon2id, scrypt")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var password string
+	if fs.NArg() > 0 {
+		password = fs.Arg(0)
+	} else {
+		fmt.Fprint(os.Stderr, "请输入密码: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintf(os.Stderr, "读取密码失败: %v\n", err)
+			return 1
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "密码不能为空")
+		return 1
+	}
+
+	hash, err := socks5.HashPassword(*algo, password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "生成哈希失败: %v\n", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
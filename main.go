@@ -1,36 +1,64 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"go-socket5/server"
 	socks5 "go-socket5/socket5"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
+// configFile 配置文件路径
+const configFile = "config/config.yaml"
+
+// configWatchInterval 检查配置文件修改时间的间隔
+const configWatchInterval = 2 * time.Second
+
+// defaultShutdownTimeout 未配置 shutdown_timeout 时等待会话结束的时间
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(runHashPassword(os.Args[2:]))
+	}
+
 	// 加载配置
-	cfg, err := server.LoadConfig("config/config.yaml")
+	cfg, err := server.LoadConfig(configFile)
 	if err != nil {
 		log.Fatalf("加载配置失败: %v", err)
 	}
 
+	// 标准库 log 的输出也交给该记录器，统一级别和格式
+	logger, err := socks5.NewLogger(cfg.Log, os.Stderr)
+	if err != nil {
+		log.Fatalf("日志配置错误: %v", err)
+	}
+	// 日志同时保留在内存中，供管理界面查看
+	logger = socks5.CaptureLogs(logger, cfg.Log)
+	slog.SetDefault(logger)
+
+	users, err := socks5.NewUserStoreFromConfig(cfg.Socks5, logger)
+	if err != nil {
+		log.Fatalf("加载用户失败: %v", err)
+	}
+
 	// 启动SOCKS5服务器
 	socks5Server := &socks5.Server{
-		Config: socks5.Config{
-			Host:      cfg.Socks5.Host,
-			Port:      uint16(cfg.Socks5.Port),
-			BlackList: cfg.Socks5.BlackList,
-			AuthList:  toUint8Slice(cfg.Socks5.AuthList),
-		},
-		UserMap: map[string]string{
-			cfg.Socks5.User: cfg.Socks5.Password,
-		},
+		Config: socks5.ConfigFromSocks5(cfg.Socks5),
+		Users:  users,
+		Logger: logger,
 	}
 
+	// 管理接口通过控制入口操作代理服务器，通过 /api/config 查询和修改运行中的配置
+	server.SetProxyController(socks5Server)
+	server.SetLiveConfig(configFile, cfg)
+
 	// 启动SOCKS5服务器
 	go func() {
 		log.Printf("启动SOCKS5服务器 %s:%d", cfg.Socks5.Host, cfg.Socks5.Port)
@@ -55,11 +83,11 @@ func main() {
 	fmt.Printf("🔧 API接口: http://%s:%d/api/\n", cfg.Gin.Host, cfg.Gin.Port)
 	fmt.Println("💡 服务将持续运行，无需手动退出")
 
-	// 模拟一些连接数据用于测试
-	go simulateConnections()
-
 	// 设置优雅关闭
-	setupGracefulShutdown(socks5Server)
+	setupGracefulShutdown(socks5Server, cfg.Socks5)
+
+	// 收到 SIGHUP 或配置文件被修改时重新加载配置
+	setupConfigReload(configFile)
 
 	// 持续运行
 	for {
@@ -68,17 +96,45 @@ func main() {
 }
 
 // setupGracefulShutdown 设置优雅关闭
-func setupGracefulShutdown(server *socks5.Server) {
+// 收到信号后先进入排空模式等待 drain_delay，再等待会话结束，超过 shutdown_timeout 后强制关闭
+// 等待期间再次收到信号则立即强制关闭
+func setupGracefulShutdown(proxy *socks5.Server, cfg server.Socks5Config) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-c
 		log.Println("🛑 收到关闭信号，正在优雅关闭服务...")
+		// 重启后使用新的 drain_delay 和 shutdown_timeout
+		if live, ok := server.LiveSocks5Config(); ok {
+			cfg = live
+		}
 
-		// 关闭SOCKS5服务器
-		if server != nil {
-			// 这里可以添加服务器关闭逻辑
+		// 先让健康检查失败，等待负载均衡器摘除本实例
+		if cfg.DrainDelay > 0 {
+			proxy.SetDraining(true)
+			log.Printf("⏳ 已进入排空模式，%s 后停止接受新连接", cfg.DrainDelay)
+			select {
+			case <-time.After(cfg.DrainDelay):
+			case <-c:
+			}
+		}
+
+		timeout := cfg.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		go func() {
+			<-c
+			log.Println("⚠️ 再次收到关闭信号，强制关闭所有会话")
+			cancel()
+		}()
+
+		if err := proxy.Shutdown(ctx); err != nil {
+			log.Printf("⚠️ 部分会话被强制关闭: %v", err)
+		} else {
 			log.Println("✅ SOCKS5服务器已关闭")
 		}
 
@@ -87,39 +143,49 @@ func setupGracefulShutdown(server *socks5.Server) {
 	}()
 }
 
-// simulateConnections 模拟连接数据用于测试
-func simulateConnections() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	connectionID := 1
-	for range ticker.C {
-		// 模拟添加新连接
-		clientIP := fmt.Sprintf("192.168.1.%d", connectionID%255)
-		target := fmt.Sprintf("example%d.com:80", connectionID%10)
-		
-		server.AddConnection(
-			fmt.Sprintf("conn_%d", connectionID),
-			clientIP,
-			target,
-		)
-		
-		server.IncrementTotalConnections()
-		
-		// 模拟连接断开
-		if connectionID%3 == 0 {
-			server.RemoveConnection(fmt.Sprintf("conn_%d", connectionID-2))
+// setupConfigReload 收到 SIGHUP 或配置文件修改时间变化时重新加载配置
+// 用户、黑名单、认证方法、限制等配置项立即生效，已建立的会话不受影响；新配置有错误时保持原配置
+func setupConfigReload(path string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		modTime := fileModTime(path)
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c:
+				log.Println("🔄 收到 SIGHUP，重新加载配置")
+			case <-ticker.C:
+				if t := fileModTime(path); t.Equal(modTime) {
+					continue
+				}
+				log.Println("🔄 配置文件已修改，重新加载配置")
+			}
+			modTime = fileModTime(path)
+
+			update, err := server.ReloadConfig()
+			if err != nil {
+				slog.Error("重新加载配置失败，继续使用原配置", "path", path, "error", err)
+				continue
+			}
+			if len(update.Changed) == 0 && len(update.RestartRequired) == 0 {
+				slog.Info("配置没有变化", "path", path)
+				continue
+			}
+			if len(update.RestartRequired) > 0 {
+				slog.Warn("部分配置项需要重启后生效", "fields", update.RestartRequired)
+			}
 		}
-		
-		connectionID++
-	}
+	}()
 }
 
-// toUint8Slice 辅助函数，将[]int转[]uint8
-func toUint8Slice(arr []int) []uint8 {
-	r := make([]uint8, len(arr))
-	for i, v := range arr {
-		r[i] = uint8(v)
+// fileModTime 返回文件的修改时间，文件不存在时为零值
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
 	}
-	return r
+	return info.ModTime()
 }
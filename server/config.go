@@ -2,22 +2,160 @@ package server
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Socks5Config 配置文件中的 socks5 配置
+// 可热更新的配置项见 HotReloadable，其余配置项修改后需要重启
 type Socks5Config struct {
-	Host      string   `yaml:"host"`
-	Port      int      `yaml:"port"`
-	User      string   `yaml:"user"`
-	Password  string   `yaml:"password"`
-	BlackList []string `yaml:"blacklist"`
-	AuthList  []int    `yaml:"auth_list"`
+	Host             string        `yaml:"host" json:"host"`
+	Port             int           `yaml:"port" json:"port"`
+	User             string        `yaml:"user" json:"user"`
+	Password         string        `yaml:"password" json:"password"`
+	Users            []UserConfig  `yaml:"users" json:"users"`
+	UsersFile        string        `yaml:"users_file" json:"usersFile"`
+	HtpasswdFile     string        `yaml:"htpasswd_file" json:"htpasswdFile"`
+	BlackList        []string      `yaml:"blacklist" json:"blackList"`
+	BlackListResolve bool          `yaml:"blacklist_resolve" json:"blackListResolve"`
+	AuthList         []int         `yaml:"auth_list" json:"authList"`
+	DrainDelay       time.Duration `yaml:"drain_delay" json:"drainDelay"`           // 关闭前保持排空模式的时间
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout" json:"shutdownTimeout"` // 等待会话结束的最长时间
+
+	HandshakeTimeout   time.Duration `yaml:"handshake_timeout" json:"handshakeTimeout"`      // 认证和读取请求的超时
+	DialTimeout        time.Duration `yaml:"dial_timeout" json:"dialTimeout"`                // 连接目标的超时
+	IdleTimeout        time.Duration `yaml:"idle_timeout" json:"idleTimeout"`                // 转发阶段的空闲超时，0 表示不限制
+	MaxSessionLifetime time.Duration `yaml:"max_session_lifetime" json:"maxSessionLifetime"` // 会话最长存活时间，0 表示不限制
+
+	Bandwidth BandwidthConfig `yaml:"bandwidth" json:"bandwidth"` // 带宽限制
+	Quotas    QuotaConfig     `yaml:"quotas" json:"quotas"`       // 用户流量和连接时间配额
+
+	RateLimits  RateLimitConfig   `yaml:"rate_limits" json:"rateLimits"`  // 新连接速率限制
+	Concurrency ConcurrencyConfig `yaml:"concurrency" json:"concurrency"` // 并发会话上限
+	BruteForce  BruteForceConfig  `yaml:"brute_force" json:"bruteForce"`  // 认证暴力破解防护
+
+	AccessLog AccessLogConfig `yaml:"access_log" json:"accessLog"` // 会话访问日志
+}
+
+// AccessLogConfig 访问日志配置，每个结束的会话输出一行，Path 为空时不输出
+type AccessLogConfig struct {
+	Path       string        `yaml:"path" json:"path"`              // 文件路径，stdout 表示标准输出
+	Format     string        `yaml:"format" json:"format"`          // json 或 text，默认 json
+	Template   string        `yaml:"template" json:"template"`      // text 格式使用的 text/template 模板，为空时使用内置模板
+	MaxSize    int64         `yaml:"max_size" json:"maxSize"`       // 单个文件的最大字节数，超过后轮转，0 表示不按大小轮转
+	Rotate     time.Duration `yaml:"rotate" json:"rotate"`          // 按时间轮转的间隔，如 24h，0 表示不按时间轮转
+	MaxBackups int           `yaml:"max_backups" json:"maxBackups"` // 保留的轮转文件数，0 表示全部保留
+}
+
+// BruteForceConfig 用户名密码认证的暴力破解防护，按来源IP和用户名分别统计失败次数
+// MaxFailures 为 0 时不启用，其余字段为 0 时使用默认值
+type BruteForceConfig struct {
+	MaxFailures int           `yaml:"max_failures" json:"maxFailures"` // 窗口内失败次数达到后封禁
+	Window      time.Duration `yaml:"window" json:"window"`            // 失败计数窗口，默认 10m
+	BanTime     time.Duration `yaml:"ban_time" json:"banTime"`         // 首次封禁时长，再次封禁时翻倍，默认 15m
+	MaxBanTime  time.Duration `yaml:"max_ban_time" json:"maxBanTime"`  // 封禁时长上限，默认 24h
+	Backoff     time.Duration `yaml:"backoff" json:"backoff"`          // 认证失败后延迟应答的基数，每次失败翻倍，默认 500ms
+	MaxBackoff  time.Duration `yaml:"max_backoff" json:"maxBackoff"`   // 延迟应答上限，默认 8s
+	Allowlist   []string      `yaml:"allowlist" json:"allowlist"`      // 从不封禁的来源网段（CIDR 或 IP）
+}
+
+// BanInfo 封禁记录
+type BanInfo struct {
+	Type     string    `json:"type"`         // ip 或 user
+	Value    string    `json:"value"`        // 来源IP或用户名
+	IP       string    `json:"ip,omitempty"` // 用户名封禁的来源IP，用户名只对该来源封禁
+	Until    time.Time `json:"until"`        // 封禁到期时间
+	Failures int       `json:"failures"`     // 当前窗口内的失败次数
+	Bans     int       `json:"bans"`         // 累计封禁次数
+}
+
+// ConcurrencyConfig 并发会话上限，0 表示不限制
+// 在全局的 MaxConcurrentConnections 之外，按认证用户、来源IP和来源网段分别限制
+type ConcurrencyConfig struct {
+	PerUser  int            `yaml:"per_user" json:"perUser"`            // 每个认证用户
+	PerIP    int            `yaml:"per_ip" json:"perIP"`                // 每个来源IP
+	Users    map[string]int `yaml:"users" json:"users,omitempty"`       // 指定用户的上限，覆盖 per_user
+	Networks map[string]int `yaml:"networks" json:"networks,omitempty"` // 网段（CIDR）内所有来源共享的上限
+}
+
+// RateLimitConfig 新连接速率限制，分别按来源IP、来源子网和认证用户计算
+type RateLimitConfig struct {
+	PerIP     RateLimit `yaml:"per_ip" json:"perIP"`
+	PerSubnet RateLimit `yaml:"per_subnet" json:"perSubnet"`
+	PerUser   RateLimit `yaml:"per_user" json:"perUser"`
+	SubnetV4  int       `yaml:"subnet_v4" json:"subnetV4"` // IPv4 子网前缀长度，默认 24
+	SubnetV6  int       `yaml:"subnet_v6" json:"subnetV6"` // IPv6 子网前缀长度，默认 64
+}
+
+// RateLimit 令牌桶参数，Rate 为 0 表示不限制
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`   // 每秒允许的新连接数
+	Burst int     `yaml:"burst" json:"burst"` // 允许的突发连接数，为 0 时取 Rate（至少为 1）
+}
+
+// BandwidthConfig 带宽限制配置，单位为字节/秒，0 表示不限制
+// 一个会话同时受全局、用户和连接三级限制，取最严格的一级
+type BandwidthConfig struct {
+	Global        BandwidthLimit            `yaml:"global" json:"global"`                // 所有会话共享
+	PerUser       BandwidthLimit            `yaml:"per_user" json:"perUser"`             // 每个认证用户的所有会话共享
+	PerConnection BandwidthLimit            `yaml:"per_connection" json:"perConnection"` // 每个会话单独计算
+	Users         map[string]BandwidthLimit `yaml:"users" json:"users,omitempty"`        // 指定用户的限制，覆盖 per_user
+}
+
+// BandwidthLimit 上下行带宽限制
+type BandwidthLimit struct {
+	Upload   int64 `yaml:"upload" json:"upload"`     // 客户端发往目标
+	Download int64 `yaml:"download" json:"download"` // 目标返回客户端
+}
+
+// QuotaConfig 用户配额配置，只作用于认证用户
+type QuotaConfig struct {
+	StateFile string                `yaml:"state_file" json:"stateFile"`  // 用量持久化文件，为空时重启后用量清零
+	CutOff    bool                  `yaml:"cut_off" json:"cutOff"`        // 配额用完时断开进行中的会话
+	Default   QuotaLimit            `yaml:"default" json:"default"`       // 所有用户的默认配额
+	Users     map[string]QuotaLimit `yaml:"users" json:"users,omitempty"` // 指定用户的配额，覆盖 default
+}
+
+// QuotaLimit 单个用户的配额，0 表示不限制
+type QuotaLimit struct {
+	Bytes     int64         `yaml:"bytes" json:"bytes"`          // 每个周期的上下行总字节数
+	Period    string        `yaml:"period" json:"period"`        // 字节配额的周期：day、week、month，默认 month
+	DailyTime time.Duration `yaml:"daily_time" json:"dailyTime"` // 每天最长连接时间
+}
+
+// QuotaStatus 用户配额的使用情况
+type QuotaStatus struct {
+	User       string    `json:"user"`
+	Period     string    `json:"period"`
+	BytesUsed  int64     `json:"bytesUsed"`
+	BytesLimit int64     `json:"bytesLimit"`
+	ResetAt    time.Time `json:"resetAt"`   // 字节配额下次清零的时间
+	TimeUsed   int64     `json:"timeUsed"`  // 当天已用连接时间（秒）
+	TimeLimit  int64     `json:"timeLimit"` // 每天最长连接时间（秒）
+	Exhausted  bool      `json:"exhausted"`
+}
+
+// UserConfig 代理用户配置
+// 同时设置 Password 和 PasswordHash 时以 PasswordHash 为准
+type UserConfig struct {
+	Username     string `yaml:"username" json:"username"`
+	Password     string `yaml:"password" json:"password"`
+	PasswordHash string `yaml:"password_hash" json:"passwordHash"` // HashPassword 生成的哈希
 }
 
 type ProjectConfig struct {
 	Socks5 Socks5Config `yaml:"socks5"`
 	Gin    GinConfig    `yaml:"gin"`
+	Log    LogConfig    `yaml:"log"`
+}
+
+// LogConfig 日志配置
+type LogConfig struct {
+	Level       string `yaml:"level" json:"level"`              // debug、info、warn、error，默认 info，协议报文只在 debug 级别输出
+	Format      string `yaml:"format" json:"format"`            // text 或 json，默认 text
+	ShowSecrets bool   `yaml:"show_secrets" json:"showSecrets"` // 在日志中输出密码和认证报文，仅用于排查问题，默认脱敏
+	BufferSize  int    `yaml:"buffer_size" json:"bufferSize"`   // 内存中保留供 /api/logs 查询的日志条数，默认 1000
 }
 
 // LoadConfig 读取配置文件
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultConnTestTimeout 连接测试未指定超时时的整体超时
+const DefaultConnTestTimeout = 10 * time.Second
+
+// maxConnTestTimeout 连接测试允许的最长超时
+const maxConnTestTimeout = 60 * time.Second
+
+// 连接测试的阶段
+const (
+	ConnTestHandshake = "handshake" // 连接本地代理并完成 SOCKS5 认证
+	ConnTestDNS       = "dns"       // 解析目标域名
+	ConnTestConnect   = "connect"   // 发送 CONNECT 请求，由代理服务器连接目标
+	ConnTestTLS       = "tls"       // 与目标进行 TLS 握手
+	ConnTestHTTP      = "http"      // 发送 HTTP 请求并读取响应头
+)
+
+// ConnTestRequest /api/test 的请求
+type ConnTestRequest struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`     // 认证用户，为空时不认证
+	Password string `json:"password"` // 指定用户时必填，除非 ConfigCredentials 为 true
+	// ConfigCredentials 为 true 时未指定的用户或密码使用配置中的明文密码
+	// 管理接口本身没有认证，默认关闭，避免能访问管理接口的人不知道密码就以配置中的用户使用代理
+	ConfigCredentials bool   `json:"configCredentials"`
+	TLS               bool   `json:"tls"`     // 连接目标后进行 TLS 握手
+	HTTP              bool   `json:"http"`    // 发送 HTTP 请求，TLS 时为 HTTPS
+	Path              string `json:"path"`    // HTTP 请求路径，默认 /
+	Timeout           int    `json:"timeout"` // 整体超时（秒），默认 10，最长 60
+}
+
+// ConnTestTimings 连接测试各阶段的耗时，单位毫秒，未执行的阶段省略
+type ConnTestTimings struct {
+	Handshake *float64 `json:"handshake,omitempty"`
+	DNS       *float64 `json:"dns,omitempty"` // 目标为IP时不解析
+	Connect   *float64 `json:"connect,omitempty"`
+	TLS       *float64 `json:"tls,omitempty"`
+	HTTP      *float64 `json:"http,omitempty"`
+	Total     float64  `json:"total"`
+}
+
+// ConnTestResult 连接测试的结果
+type ConnTestResult struct {
+	Success     bool            `json:"success"`
+	Message     string          `json:"message"`
+	Proxy       string          `json:"proxy,omitempty"`       // 使用的本地代理地址
+	User        string          `json:"user,omitempty"`        // 认证用户，无认证时为空
+	FailedPhase string          `json:"failedPhase,omitempty"` // 失败的阶段
+	ReplyCode   *int            `json:"replyCode,omitempty"`   // 代理服务器的失败应答码
+	ResolvedIPs []string        `json:"resolvedIPs,omitempty"` // 目标域名解析出的地址
+	TLSVersion  string          `json:"tlsVersion,omitempty"`
+	HTTPStatus  int             `json:"httpStatus,omitempty"`
+	Timings     ConnTestTimings `json:"timings"`
+	Latency     string          `json:"latency"` // 总耗时
+}
+
+// timeout 返回请求的整体超时
+func (r *ConnTestRequest) timeout() time.Duration {
+	timeout := time.Duration(r.Timeout) * time.Second
+	if timeout <= 0 {
+		return DefaultConnTestTimeout
+	}
+	if timeout > maxConnTestTimeout {
+		return maxConnTestTimeout
+	}
+	return timeout
+}
+
+// validate 检查请求，ConfigCredentials 为 true 且未指定用户或密码时使用配置中的用户
+func (r *ConnTestRequest) validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("目标主机不能为空")
+	}
+	if r.Port <= 0 || r.Port > 65535 {
+		return fmt.Errorf("无效的端口: %d", r.Port)
+	}
+	if r.Path == "" {
+		r.Path = "/"
+	}
+	r.Timeout = int(r.timeout() / time.Second)
+	if r.User != "" && r.Password != "" {
+		return nil
+	}
+	if !r.ConfigCredentials {
+		if r.User != "" {
+			return fmt.Errorf("请提供用户 %s 的密码，或设置 configCredentials 使用配置中的密码", r.User)
+		}
+		return nil
+	}
+	cfg, ok := LiveSocks5Config()
+	if !ok {
+		return nil
+	}
+	user, password, err := testCredentials(cfg, r.User)
+	if err != nil {
+		return err
+	}
+	r.User, r.Password = user, password
+	return nil
+}
+
+// testCredentials 返回配置中用户的明文密码，user 为空时选择第一个有明文密码的用户，没有时不认证
+// 只配置了密码哈希或来自用户文件的用户需要在请求中提供密码
+func testCredentials(cfg Socks5Config, user string) (string, string, error) {
+	if cfg.User != "" && cfg.Password != "" && (user == "" || user == cfg.User) {
+		return cfg.User, cfg.Password, nil
+	}
+	for _, u := range cfg.Users {
+		if u.Password != "" && (user == "" || user == u.Username) {
+			return u.Username, u.Password, nil
+		}
+	}
+	if user != "" {
+		return "", "", fmt.Errorf("配置中没有用户 %s 的明文密码，请在请求中提供密码", user)
+	}
+	return "", "", nil
+}
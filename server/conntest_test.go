@@ -0,0 +1,83 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnTestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		timeout int
+		want    time.Duration
+	}{
+		{0, DefaultConnTestTimeout},
+		{-1, DefaultConnTestTimeout},
+		{5, 5 * time.Second},
+		{3600, maxConnTestTimeout},
+	}
+	for _, tt := range tests {
+		r := ConnTestRequest{Timeout: tt.timeout}
+		if got := r.timeout(); got != tt.want {
+			t.Errorf("timeout(%d) = %v, want %v", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestConnTestRequestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     ConnTestRequest
+		wantErr bool
+	}{
+		{"缺少主机", ConnTestRequest{Port: 80}, true},
+		{"端口为0", ConnTestRequest{Host: "example.com"}, true},
+		{"端口过大", ConnTestRequest{Host: "example.com", Port: 65536}, true},
+		{"有效", ConnTestRequest{Host: "example.com", Port: 80, User: "u", Password: "p", Timeout: 120}, false},
+		{"指定用户但没有密码", ConnTestRequest{Host: "example.com", Port: 80, User: "u"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (tt.req.Path != "/" || tt.req.Timeout != int(maxConnTestTimeout/time.Second)) {
+				t.Errorf("validate 后 Path = %q, Timeout = %d", tt.req.Path, tt.req.Timeout)
+			}
+		})
+	}
+}
+
+func TestTestCredentials(t *testing.T) {
+	cfg := Socks5Config{
+		User:     "admin",
+		Password: "adminpw",
+		Users: []UserConfig{
+			{Username: "hashed", PasswordHash: "$2a$10$hash"},
+			{Username: "alice", Password: "alicepw"},
+		},
+	}
+	tests := []struct {
+		name               string
+		cfg                Socks5Config
+		user               string
+		wantUser, wantPass string
+		wantErr            bool
+	}{
+		{"默认使用顶层用户", cfg, "", "admin", "adminpw", false},
+		{"指定用户", cfg, "alice", "alice", "alicepw", false},
+		{"只有哈希的用户", cfg, "hashed", "", "", true},
+		{"未知用户", cfg, "bob", "", "", true},
+		{"跳过只有哈希的用户", Socks5Config{Users: cfg.Users}, "", "alice", "alicepw", false},
+		{"没有用户时不认证", Socks5Config{}, "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, pass, err := testCredentials(tt.cfg, tt.user)
+			if user != tt.wantUser || pass != tt.wantPass || (err != nil) != tt.wantErr {
+				t.Errorf("testCredentials = %q, %q, %v, want %q, %q, wantErr %v",
+					user, pass, err, tt.wantUser, tt.wantPass, tt.wantErr)
+			}
+		})
+	}
+}
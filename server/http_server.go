@@ -1,9 +1,16 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,39 +24,123 @@ type GinConfig struct {
 
 // 服务器统计信息
 type ServerStats struct {
-	Connections      int   `json:"connections"`
-	TotalConnections int   `json:"totalConnections"`
-	Uptime           int64 `json:"uptime"`
-	StartTime        int64 `json:"startTime"`
-	Status           string `json:"status"`
-}
-
-// 服务器配置信息
-type ServerConfig struct {
-	Host            string   `json:"host"`
-	Port            int      `json:"port"`
-	User            string   `json:"user"`
-	AuthMethods     []string `json:"authMethods"`
-	MaxConnections  int      `json:"maxConnections"`
-	BlackList       []string `json:"blackList"`
+	Connections      int              `json:"connections"`
+	TotalConnections int              `json:"totalConnections"`
+	Uptime           int64            `json:"uptime"`
+	StartTime        int64            `json:"startTime"`
+	Status           string           `json:"status"`
+	Rejected         map[string]int64 `json:"rejected"` // 按原因统计被拒绝的连接数
 }
 
 // 连接信息
+// BytesIn/BytesOut 在会话转发期间持续更新，读取时使用 Snapshot
 type ConnectionInfo struct {
-	ID        string    `json:"id"`
-	ClientIP  string    `json:"clientIP"`
-	Target    string    `json:"target"`
-	StartTime time.Time `json:"startTime"`
-	Status    string    `json:"status"`
+	ID         string    `json:"id"`
+	ClientIP   string    `json:"clientIP"`
+	ClientAddr string    `json:"clientAddr"`
+	User       string    `json:"user"`
+	Command    string    `json:"command"`
+	Target     string    `json:"target"`
+	StartTime  time.Time `json:"startTime"`
+	Status     string    `json:"status"`
+	BytesIn    int64     `json:"bytesIn"`  // 客户端发往目标的字节数
+	BytesOut   int64     `json:"bytesOut"` // 目标返回客户端的字节数
+
+	closeFunc func() // 终止会话，关闭客户端和上游连接
+}
+
+// ConnectionFilter 批量断开连接的筛选条件，空字段不参与筛选
+type ConnectionFilter struct {
+	User     string `form:"user"`
+	ClientIP string `form:"clientIP"`
+	Target   string `form:"target"` // 目标 host:port 或仅 host
+}
+
+// IsEmpty 是否没有任何筛选条件
+func (f ConnectionFilter) IsEmpty() bool {
+	return f.User == "" && f.ClientIP == "" && f.Target == ""
+}
+
+// Match 连接是否满足所有筛选条件
+func (f ConnectionFilter) Match(c *ConnectionInfo) bool {
+	if f.User != "" && f.User != c.User {
+		return false
+	}
+	if f.ClientIP != "" && f.ClientIP != c.ClientIP {
+		return false
+	}
+	if f.Target != "" && f.Target != c.Target {
+		host, _, err := net.SplitHostPort(c.Target)
+		if err != nil || !strings.EqualFold(f.Target, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddBytes 累加转发字节数，可并发调用
+func (c *ConnectionInfo) AddBytes(in, out int64) {
+	if in != 0 {
+		atomic.AddInt64(&c.BytesIn, in)
+	}
+	if out != 0 {
+		atomic.AddInt64(&c.BytesOut, out)
+	}
+}
+
+// Snapshot 返回连接信息的一致副本，调用方需持有连接表的读锁
+func (c *ConnectionInfo) Snapshot() ConnectionInfo {
+	return ConnectionInfo{
+		ID:         c.ID,
+		ClientIP:   c.ClientIP,
+		ClientAddr: c.ClientAddr,
+		User:       c.User,
+		Command:    c.Command,
+		Target:     c.Target,
+		StartTime:  c.StartTime,
+		Status:     c.Status,
+		BytesIn:    atomic.LoadInt64(&c.BytesIn),
+		BytesOut:   atomic.LoadInt64(&c.BytesOut),
+	}
+}
+
+// ProxyController 管理接口对代理服务器的控制入口，由 main 在启动时通过 SetProxyController 注入
+type ProxyController interface {
+	SetDraining(draining bool) // 开启或关闭排空模式
+	Draining() bool            // 是否处于排空模式
+
+	Bandwidth() BandwidthConfig             // 当前的带宽限制
+	SetBandwidth(cfg BandwidthConfig) error // 替换带宽限制，对已建立的会话立即生效
+
+	QuotaStatus() []QuotaStatus  // 所有用户的配额使用情况
+	ResetQuota(user string) bool // 清零用户的配额用量，没有用量记录时返回false
+
+	RateLimits() RateLimitConfig             // 当前的新连接速率限制
+	SetRateLimits(cfg RateLimitConfig) error // 替换新连接速率限制
+
+	Bans() []BanInfo           // 生效中的认证封禁
+	Unban(ip, user string) int // 解除封禁，两者都为空时解除全部，返回解除的封禁数
+
+	ApplyConfig(cfg Socks5Config, fields []string) error // 应用 fields 中列出的可热更新配置项，有错误时不修改任何配置
+
+	// Restart 按 cfg 重启，返回新监听器开始接受连接的地址，进入每个阶段时调用 progress
+	// wait 等待重启前的会话结束，drain 为 true 时排空，超时后强制关闭，否则立即关闭；没有重启前的会话时为nil
+	Restart(cfg Socks5Config, drain bool, progress func(phase string)) (addr string, wait func(), err error)
+
+	// TestConnection 通过本地监听器代理连接目标，测量各阶段耗时
+	TestConnection(req ConnTestRequest) ConnTestResult
 }
 
 var (
-	serverStartTime  = time.Now()
-	connectionCount  = 0
-	totalConnections = 0
-	activeConnections = make(map[string]*ConnectionInfo)
-	statsMutex       = sync.RWMutex{}
-	connectionsMutex = sync.RWMutex{}
+	proxyController     ProxyController
+	serverStartTime     = time.Now()
+	connectionCount     = 0
+	totalConnections    = 0
+	rejectedConnections = make(map[string]int64)
+	activeConnections   = make(map[string]*ConnectionInfo)
+	statsMutex          = sync.RWMutex{}
+	connectionsMutex    = sync.RWMutex{}
+	bandwidthMutex      = sync.Mutex{} // 串行化带宽限制的修改，避免并发的读-改-写相互覆盖
 )
 
 // NewHTTPServer 创建并返回Gin引擎
@@ -58,7 +149,7 @@ func NewHTTPServer(cfg GinConfig) *gin.Engine {
 		gin.SetMode(cfg.Mode)
 	}
 	r := gin.New()
-	r.Use(gin.Logger(), gin.Recovery())
+	r.Use(gin.Logger(), gin.Recovery(), metricsMiddleware)
 
 	// 静态文件托管
 	r.Static("/static", "./static")
@@ -85,6 +176,20 @@ func NewHTTPServer(cfg GinConfig) *gin.Engine {
 		c.JSON(200, gin.H{"msg": "pong"})
 	})
 
+	// 负载均衡健康检查，排空模式下返回503
+	r.GET("/health", func(c *gin.Context) {
+		if isDraining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Prometheus 指标
+	r.GET("/metrics", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", renderMetrics())
+	})
+
 	// API路由组
 	api := r.Group("/api")
 	{
@@ -92,12 +197,17 @@ func NewHTTPServer(cfg GinConfig) *gin.Engine {
 		api.GET("/stats", func(c *gin.Context) {
 			statsMutex.RLock()
 			uptime := int64(time.Since(serverStartTime).Seconds())
+			rejected := make(map[string]int64, len(rejectedConnections))
+			for reason, n := range rejectedConnections {
+				rejected[reason] = n
+			}
 			stats := ServerStats{
 				Connections:      connectionCount,
 				TotalConnections: totalConnections,
 				Uptime:           uptime,
 				StartTime:        serverStartTime.Unix(),
-				Status:           "running",
+				Status:           serverStatus(),
+				Rejected:         rejected,
 			}
 			statsMutex.RUnlock()
 			c.JSON(http.StatusOK, stats)
@@ -106,7 +216,7 @@ func NewHTTPServer(cfg GinConfig) *gin.Engine {
 		// 获取服务器状态
 		api.GET("/status", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{
-				"status":    "running",
+				"status":    serverStatus(),
 				"timestamp": time.Now().Unix(),
 				"uptime":    int64(time.Since(serverStartTime).Seconds()),
 			})
@@ -114,25 +224,25 @@ func NewHTTPServer(cfg GinConfig) *gin.Engine {
 
 		// 获取服务器配置
 		api.GET("/config", func(c *gin.Context) {
-			config := ServerConfig{
-				Host:           "0.0.0.0",
-				Port:           1080,
-				User:           "test",
-				AuthMethods:    []string{"无认证", "用户名密码认证"},
-				MaxConnections: 10000,
-				BlackList:      []string{},
-			}
-			c.JSON(http.StatusOK, config)
+			cfg, ok := LiveSocks5Config()
+			if !ok {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "代理服务器未就绪"})
+				return
+			}
+			c.JSON(http.StatusOK, cfg.MaskSecrets())
 		})
 
 		// 获取活跃连接列表
 		api.GET("/connections", func(c *gin.Context) {
 			connectionsMutex.RLock()
-			connections := make([]*ConnectionInfo, 0, len(activeConnections))
+			connections := make([]ConnectionInfo, 0, len(activeConnections))
 			for _, conn := range activeConnections {
-				connections = append(connections, conn)
+				connections = append(connections, conn.Snapshot())
 			}
 			connectionsMutex.RUnlock()
+			sort.Slice(connections, func(i, j int) bool {
+				return connections[i].StartTime.Before(connections[j].StartTime)
+			})
 			c.JSON(http.StatusOK, connections)
 		})
 
@@ -141,84 +251,387 @@ func NewHTTPServer(cfg GinConfig) *gin.Engine {
 			id := c.Param("id")
 			connectionsMutex.RLock()
 			conn, exists := activeConnections[id]
+			var snapshot ConnectionInfo
+			if exists {
+				snapshot = conn.Snapshot()
+			}
 			connectionsMutex.RUnlock()
-			
+
 			if !exists {
 				c.JSON(http.StatusNotFound, gin.H{"error": "连接不存在"})
 				return
 			}
-			c.JSON(http.StatusOK, conn)
+			c.JSON(http.StatusOK, snapshot)
 		})
 
 		// 断开指定连接
 		api.DELETE("/connections/:id", func(c *gin.Context) {
-			id := c.Param("id")
-			connectionsMutex.Lock()
-			delete(activeConnections, id)
-			connectionsMutex.Unlock()
-			
-			// 更新连接数
-			statsMutex.Lock()
-			connectionCount = len(activeConnections)
-			statsMutex.Unlock()
-			
+			if !CloseConnection(c.Param("id")) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "连接不存在"})
+				return
+			}
 			c.JSON(http.StatusOK, gin.H{"message": "连接已断开"})
 		})
 
-		// 重启服务器
-		api.POST("/restart", func(c *gin.Context) {
+		// 按用户、客户端IP或目标批量断开连接
+		api.DELETE("/connections", func(c *gin.Context) {
+			var filter ConnectionFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的筛选条件"})
+				return
+			}
+			// 没有筛选条件时必须显式指定 all=true，避免误断开全部连接
+			if filter.IsEmpty() && c.Query("all") != "true" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "需要指定 user、clientIP、target 或 all=true"})
+				return
+			}
+			closed := CloseConnections(filter)
 			c.JSON(http.StatusOK, gin.H{
-				"message": "重启请求已发送",
-				"timestamp": time.Now().Unix(),
+				"message": fmt.Sprintf("已断开 %d 个连接", closed),
+				"closed":  closed,
 			})
 		})
 
+		// 查询排空模式
+		api.GET("/drain", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"draining": isDraining()})
+		})
+
+		// 开启排空模式
+		api.POST("/drain", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			proxyController.SetDraining(true)
+			c.JSON(http.StatusOK, gin.H{"message": "已开启排空模式", "draining": true})
+		})
+
+		// 关闭排空模式
+		api.DELETE("/drain", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			proxyController.SetDraining(false)
+			c.JSON(http.StatusOK, gin.H{"message": "已关闭排空模式", "draining": false})
+		})
+
+		// 查询带宽限制
+		api.GET("/bandwidth", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			c.JSON(http.StatusOK, proxyController.Bandwidth())
+		})
+
+		// 整体替换带宽限制
+		api.PUT("/bandwidth", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			bandwidthMutex.Lock()
+			defer bandwidthMutex.Unlock()
+			var cfg BandwidthConfig
+			if err := c.ShouldBindJSON(&cfg); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的带宽配置"})
+				return
+			}
+			if err := proxyController.SetBandwidth(cfg); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "带宽限制已更新", "bandwidth": proxyController.Bandwidth()})
+		})
+
+		// 设置指定用户的带宽限制
+		api.PUT("/bandwidth/users/:user", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			bandwidthMutex.Lock()
+			defer bandwidthMutex.Unlock()
+			var limit BandwidthLimit
+			if err := c.ShouldBindJSON(&limit); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的带宽配置"})
+				return
+			}
+			cfg := proxyController.Bandwidth()
+			if cfg.Users == nil {
+				cfg.Users = make(map[string]BandwidthLimit)
+			}
+			cfg.Users[c.Param("user")] = limit
+			if err := proxyController.SetBandwidth(cfg); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "用户带宽限制已更新", "limit": limit})
+		})
+
+		// 删除指定用户的带宽限制，恢复使用 perUser
+		api.DELETE("/bandwidth/users/:user", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			bandwidthMutex.Lock()
+			defer bandwidthMutex.Unlock()
+			cfg := proxyController.Bandwidth()
+			if _, ok := cfg.Users[c.Param("user")]; !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "该用户没有单独的带宽限制"})
+				return
+			}
+			delete(cfg.Users, c.Param("user"))
+			if err := proxyController.SetBandwidth(cfg); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "用户带宽限制已删除"})
+		})
+
+		// 查询新连接速率限制
+		api.GET("/ratelimits", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			c.JSON(http.StatusOK, proxyController.RateLimits())
+		})
+
+		// 替换新连接速率限制
+		api.PUT("/ratelimits", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			var cfg RateLimitConfig
+			if err := c.ShouldBindJSON(&cfg); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的速率限制配置"})
+				return
+			}
+			if err := proxyController.SetRateLimits(cfg); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "速率限制已更新", "rateLimits": proxyController.RateLimits()})
+		})
+
+		// 查询生效中的认证封禁
+		api.GET("/bans", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			c.JSON(http.StatusOK, proxyController.Bans())
+		})
+
+		// 按来源IP或用户名解除封禁
+		api.DELETE("/bans", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			ip, user := c.Query("ip"), c.Query("user")
+			// 没有条件时必须显式指定 all=true，避免误解除全部封禁
+			if ip == "" && user == "" && c.Query("all") != "true" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "需要指定 ip、user 或 all=true"})
+				return
+			}
+			cleared := proxyController.Unban(ip, user)
+			c.JSON(http.StatusOK, gin.H{
+				"message": fmt.Sprintf("已解除 %d 个封禁", cleared),
+				"cleared": cleared,
+			})
+		})
+
+		// 查询所有用户的配额使用情况
+		api.GET("/quotas", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			c.JSON(http.StatusOK, proxyController.QuotaStatus())
+		})
+
+		// 查询指定用户的配额使用情况
+		api.GET("/quotas/:user", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			for _, status := range proxyController.QuotaStatus() {
+				if status.User == c.Param("user") {
+					c.JSON(http.StatusOK, status)
+					return
+				}
+			}
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		})
+
+		// 清零指定用户的配额用量
+		api.DELETE("/quotas/:user", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			if !proxyController.ResetQuota(c.Param("user")) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "该用户没有配额用量"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "配额用量已清零"})
+		})
+
+		// 重启服务器
+		// 重新读取配置文件并在进程内重启代理服务器，mode=drain（默认）等待会话结束，mode=immediate 立即关闭所有会话
+		// 新监听器开始接受连接后返回，重启过程中可通过 GET /api/restart 查询进度
+		api.POST("/restart", func(c *gin.Context) {
+			if !proxyReady(c) {
+				return
+			}
+			status, err := RestartProxy(c.Query("mode"))
+			switch {
+			case errors.Is(err, ErrRestartInProgress):
+				current, _ := LastRestart()
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "restart": current})
+			case err != nil && status.StartedAt.IsZero():
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case err != nil:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "restart": status})
+			default:
+				c.JSON(http.StatusOK, gin.H{"message": "SOCKS5服务器已重启", "restart": status})
+			}
+		})
+
+		// 查询最近一次重启的进度
+		api.GET("/restart", func(c *gin.Context) {
+			status, ok := LastRestart()
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "没有重启记录"})
+				return
+			}
+			c.JSON(http.StatusOK, status)
+		})
+
 		// 更新配置
+		// 请求体中出现的配置项整体替换，可热更新的配置项立即生效，persist=true 时写回配置文件
 		api.PUT("/config", func(c *gin.Context) {
-			var config ServerConfig
-			if err := c.ShouldBindJSON(&config); err != nil {
+			current, ok := LiveSocks5Config()
+			if !ok {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "代理服务器未就绪"})
+				return
+			}
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的配置数据"})
 				return
 			}
-			
+			cfg, err := MergeSocks5Config(current, body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			update, err := UpdateSocks5Config(cfg, c.Query("persist") == "true")
+			if err != nil {
+				// 配置已生效但写回文件失败时返回500，其余为配置错误
+				code := http.StatusBadRequest
+				if errors.Is(err, ErrConfigPersist) {
+					code = http.StatusInternalServerError
+				}
+				c.JSON(code, gin.H{"error": err.Error(), "update": update})
+				return
+			}
+			live, _ := LiveSocks5Config()
 			c.JSON(http.StatusOK, gin.H{
 				"message": "配置更新成功",
-				"config": config,
+				"update":  update,
+				"config":  live.MaskSecrets(),
 			})
 		})
 
-		// 获取日志
+		// 获取日志，按级别、会话、用户和时间范围过滤，返回最新的 limit 条
 		api.GET("/logs", func(c *gin.Context) {
-			limit := c.DefaultQuery("limit", "100")
+			filter, err := parseLogFilter(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+			if err != nil || limit < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的 limit"})
+				return
+			}
 			c.JSON(http.StatusOK, gin.H{
-				"logs": []string{
-					"[INFO] 服务器启动成功",
-					"[INFO] 新连接: 127.0.0.1:12345",
-					"[INFO] 认证成功",
-					"[INFO] 连接目标: example.com:80",
-				},
+				"logs":  logBuffer.query(filter, limit, 0),
 				"limit": limit,
 			})
 		})
 
+		// 实时日志（Server-Sent Events），过滤条件与 /logs 相同
+		// 先补发序号大于 after（或 Last-Event-ID）的日志，再推送新日志
+		api.GET("/logs/stream", func(c *gin.Context) {
+			filter, err := parseLogFilter(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			after := c.Query("after")
+			if id := c.GetHeader("Last-Event-ID"); id != "" {
+				after = id
+			}
+			var lastID uint64
+			if after != "" {
+				if lastID, err = strconv.ParseUint(after, 10, 64); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "无效的 after"})
+					return
+				}
+			}
+
+			// 先订阅再补发，补发和推送之间不会漏掉日志
+			ch, cancel := logBuffer.subscribe()
+			defer cancel()
+			matcher := logBuffer.matcher(filter)
+			backlog := logBuffer.query(LogFilter{}, 0, lastID)
+
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+			c.Header("X-Accel-Buffering", "no")
+			send := func(e LogEntry) {
+				if e.ID <= lastID {
+					return
+				}
+				lastID = e.ID
+				if matcher.match(&e) {
+					writeLogEvent(c.Writer, &e)
+				}
+			}
+			for _, e := range backlog {
+				send(e)
+			}
+			c.Writer.Flush()
+
+			heartbeat := time.NewTicker(logStreamHeartbeat)
+			defer heartbeat.Stop()
+			for {
+				select {
+				case e := <-ch:
+					send(e)
+				case <-heartbeat.C:
+					// 注释行保持连接，避免被代理判定为空闲
+					c.Writer.WriteString(": ping\n\n")
+				case <-c.Request.Context().Done():
+					return
+				}
+				c.Writer.Flush()
+			}
+		})
+
 		// 测试连接
+		// 以指定的用户（configCredentials 为 true 时可以使用配置中的用户）通过本地监听器连接目标，返回各阶段耗时，失败时 success 为 false
 		api.POST("/test", func(c *gin.Context) {
-			var req struct {
-				Host string `json:"host"`
-				Port int    `json:"port"`
+			if !proxyReady(c) {
+				return
 			}
-			
+			var req ConnTestRequest
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
 				return
 			}
-			
-			// 模拟连接测试
-			c.JSON(http.StatusOK, gin.H{
-				"success": true,
-				"message": fmt.Sprintf("连接到 %s:%d 成功", req.Host, req.Port),
-				"latency": "45ms",
-			})
+			if err := req.validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, proxyController.TestConnection(req))
 		})
 	}
 
@@ -238,6 +651,33 @@ func RunHTTPServer(cfg GinConfig) {
 	r.Run(addr)
 }
 
+// SetProxyController 注入代理服务器控制入口
+func SetProxyController(c ProxyController) {
+	proxyController = c
+}
+
+// proxyReady 检查代理服务器控制入口是否已注入，未注入时返回503
+func proxyReady(c *gin.Context) bool {
+	if proxyController == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "代理服务器未就绪"})
+		return false
+	}
+	return true
+}
+
+// isDraining 代理服务器是否处于排空模式
+func isDraining() bool {
+	return proxyController != nil && proxyController.Draining()
+}
+
+// serverStatus 返回服务器状态描述
+func serverStatus() string {
+	if isDraining() {
+		return "draining"
+	}
+	return "running"
+}
+
 // UpdateConnectionCount 更新连接数统计
 func UpdateConnectionCount(count int) {
 	statsMutex.Lock()
@@ -252,32 +692,76 @@ func IncrementTotalConnections() {
 	statsMutex.Unlock()
 }
 
-// AddConnection 添加新连接
-func AddConnection(id, clientIP, target string) {
-	connectionsMutex.Lock()
-	activeConnections[id] = &ConnectionInfo{
-		ID:        id,
-		ClientIP:  clientIP,
-		Target:    target,
-		StartTime: time.Now(),
-		Status:    "active",
-	}
-	connectionsMutex.Unlock()
-	
+// IncrementRejectedConnections 按原因累计被拒绝的连接数，如 concurrency_user、rate_limit_ip
+func IncrementRejectedConnections(reason string) {
 	statsMutex.Lock()
-	connectionCount = len(activeConnections)
+	rejectedConnections[reason]++
 	statsMutex.Unlock()
 }
 
+// AddConnection 登记新连接，会话结束时需调用 RemoveConnection
+// closeFunc 用于从管理接口终止会话，需要能被重复调用
+func AddConnection(info *ConnectionInfo, closeFunc func()) {
+	info.closeFunc = closeFunc
+	if info.StartTime.IsZero() {
+		info.StartTime = time.Now()
+	}
+	if info.Status == "" {
+		info.Status = "active"
+	}
+	connectionsMutex.Lock()
+	activeConnections[info.ID] = info
+	connectionsMutex.Unlock()
+	recordSessionStart(info.Command)
+}
+
 // RemoveConnection 移除连接
 func RemoveConnection(id string) {
 	connectionsMutex.Lock()
-	delete(activeConnections, id)
+	if info, exists := activeConnections[id]; exists {
+		recordSessionEnd(info)
+		delete(activeConnections, id)
+	}
 	connectionsMutex.Unlock()
-	
-	statsMutex.Lock()
-	connectionCount = len(activeConnections)
-	statsMutex.Unlock()
+}
+
+// CloseConnection 终止指定连接，连接不存在时返回false
+// 会话退出后自行调用 RemoveConnection，这里只标记状态
+func CloseConnection(id string) bool {
+	connectionsMutex.Lock()
+	conn, exists := activeConnections[id]
+	if exists {
+		conn.Status = "closing"
+	}
+	connectionsMutex.Unlock()
+
+	if !exists {
+		return false
+	}
+	if conn.closeFunc != nil {
+		conn.closeFunc()
+	}
+	return true
+}
+
+// CloseConnections 终止所有满足条件的连接，返回终止的数量
+func CloseConnections(filter ConnectionFilter) int {
+	var closeFuncs []func()
+	connectionsMutex.Lock()
+	for _, conn := range activeConnections {
+		if filter.Match(conn) {
+			conn.Status = "closing"
+			if conn.closeFunc != nil {
+				closeFuncs = append(closeFuncs, conn.closeFunc)
+			}
+		}
+	}
+	connectionsMutex.Unlock()
+
+	for _, closeFunc := range closeFuncs {
+		closeFunc()
+	}
+	return len(closeFuncs)
 }
 
 // GetActiveConnections 获取活跃连接数
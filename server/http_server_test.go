@@ -0,0 +1,60 @@
+package server
+
+import "testing"
+
+func TestConnectionFilterMatch(t *testing.T) {
+	conn := &ConnectionInfo{User: "alice", ClientIP: "192.0.2.1", Target: "Example.com:443"}
+	tests := []struct {
+		name   string
+		filter ConnectionFilter
+		want   bool
+	}{
+		{"空条件", ConnectionFilter{}, true},
+		{"用户", ConnectionFilter{User: "alice"}, true},
+		{"其他用户", ConnectionFilter{User: "bob"}, false},
+		{"来源IP", ConnectionFilter{ClientIP: "192.0.2.1"}, true},
+		{"其他来源IP", ConnectionFilter{ClientIP: "192.0.2.2"}, false},
+		{"完整目标", ConnectionFilter{Target: "Example.com:443"}, true},
+		{"目标主机不区分大小写", ConnectionFilter{Target: "example.com"}, true},
+		{"其他目标", ConnectionFilter{Target: "example.org"}, false},
+		{"所有条件都需满足", ConnectionFilter{User: "alice", ClientIP: "192.0.2.2"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(conn); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !(ConnectionFilter{}).IsEmpty() || (ConnectionFilter{User: "alice"}).IsEmpty() {
+		t.Error("IsEmpty 不符合预期")
+	}
+}
+
+func TestCloseConnections(t *testing.T) {
+	closed := map[string]int{}
+	for _, info := range []*ConnectionInfo{
+		{ID: "close-test-1", User: "alice", ClientIP: "192.0.2.1", Target: "a.test:80"},
+		{ID: "close-test-2", User: "alice", ClientIP: "192.0.2.2", Target: "b.test:80"},
+		{ID: "close-test-3", User: "bob", ClientIP: "192.0.2.1", Target: "a.test:80"},
+	} {
+		id := info.ID
+		AddConnection(info, func() { closed[id]++ })
+		defer RemoveConnection(id)
+	}
+
+	if n := CloseConnections(ConnectionFilter{User: "alice", ClientIP: "192.0.2.1"}); n != 1 || closed["close-test-1"] != 1 {
+		t.Errorf("CloseConnections = %d, closed = %v", n, closed)
+	}
+	if !CloseConnection("close-test-3") || closed["close-test-3"] != 1 {
+		t.Errorf("CloseConnection 没有终止会话: %v", closed)
+	}
+	if CloseConnection("close-test-missing") {
+		t.Error("不存在的连接返回 true")
+	}
+
+	connectionsMutex.RLock()
+	status := activeConnections["close-test-1"].Status
+	connectionsMutex.RUnlock()
+	if status != "closing" || closed["close-test-2"] != 0 {
+		t.Errorf("status = %q, closed = %v", status, closed)
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrConfigPersist 配置已生效但写回配置文件失败
+var ErrConfigPersist = errors.New("写回配置文件失败")
+
+// MaskedSecret 管理接口返回配置时密码和密码哈希的替代值，提交时保持该值表示不修改
+const MaskedSecret = "******"
+
+// hotReloadable 可在运行期间生效的 socks5 配置项（yaml 键名）
+var hotReloadable = map[string]bool{
+	"host": true, "port": true,
+	"user": true, "password": true, "users": true, "users_file": true, "htpasswd_file": true,
+	"blacklist": true, "blacklist_resolve": true, "auth_list": true,
+	"bandwidth": true, "quotas": true, "rate_limits": true, "concurrency": true, "brute_force": true,
+	"access_log": true,
+}
+
+// HotReloadable 配置项（yaml 键名）是否可在运行期间生效，其余配置项修改后需要重启
+func HotReloadable(field string) bool {
+	return hotReloadable[field]
+}
+
+var (
+	configMutex sync.Mutex     // 串行化配置的修改
+	configPath  string         // 配置文件路径，为空时不能写回
+	liveConfig  *ProjectConfig // 运行中的配置
+)
+
+// SetLiveConfig 登记配置文件路径和运行中的配置，供 /api/config 查询和修改
+func SetLiveConfig(path string, cfg *ProjectConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	copied := *cfg
+	configPath, liveConfig = path, &copied
+}
+
+// LiveSocks5Config 返回运行中的 socks5 配置，未登记时返回false
+func LiveSocks5Config() (Socks5Config, bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if liveConfig == nil {
+		return Socks5Config{}, false
+	}
+	syncLiveConfig()
+	return liveConfig.Socks5, true
+}
+
+// syncLiveConfig 同步通过 /api/bandwidth 等接口单独修改的配置，调用方需持有 configMutex
+func syncLiveConfig() {
+	if proxyController == nil {
+		return
+	}
+	liveConfig.Socks5.Bandwidth = proxyController.Bandwidth()
+	liveConfig.Socks5.RateLimits = proxyController.RateLimits()
+}
+
+// MaskSecrets 返回密码和密码哈希被替换为 MaskedSecret 的副本
+func (c Socks5Config) MaskSecrets() Socks5Config {
+	if c.Password != "" {
+		c.Password = MaskedSecret
+	}
+	users := make([]UserConfig, len(c.Users))
+	for i, u := range c.Users {
+		if u.Password != "" {
+			u.Password = MaskedSecret
+		}
+		if u.PasswordHash != "" {
+			u.PasswordHash = MaskedSecret
+		}
+		users[i] = u
+	}
+	c.Users = users
+	return c
+}
+
+// restoreSecrets 将仍为 MaskedSecret 的密码恢复为 old 中的值，users 按用户名对应
+func (c *Socks5Config) restoreSecrets(old Socks5Config) error {
+	if c.Password == MaskedSecret {
+		c.Password = old.Password
+	}
+	oldUsers := make(map[string]UserConfig, len(old.Users))
+	for _, u := range old.Users {
+		oldUsers[u.Username] = u
+	}
+	users := make([]UserConfig, len(c.Users))
+	for i, u := range c.Users {
+		prev, ok := oldUsers[u.Username]
+		if (u.Password == MaskedSecret || u.PasswordHash == MaskedSecret) && !ok {
+			return fmt.Errorf("新用户 %s 的密码不能为 %s", u.Username, MaskedSecret)
+		}
+		if u.Password == MaskedSecret {
+			u.Password = prev.Password
+		}
+		if u.PasswordHash == MaskedSecret {
+			u.PasswordHash = prev.PasswordHash
+		}
+		users[i] = u
+	}
+	c.Users = users
+	return nil
+}
+
+// MergeSocks5Config 用 JSON 对象中出现的配置项整体替换 base 中的对应项，未出现的配置项保持不变
+// 密码为 MaskedSecret 时保持原值，未知的配置项返回错误
+func MergeSocks5Config(base Socks5Config, patch []byte) (Socks5Config, error) {
+	var changes map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return base, fmt.Errorf("无效的配置数据: %v", err)
+	}
+	data, err := json.Marshal(base)
+	if err != nil {
+		return base, err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return base, err
+	}
+	for key, value := range changes {
+		if _, ok := merged[key]; !ok {
+			return base, fmt.Errorf("未知的配置项: %s", key)
+		}
+		merged[key] = value
+	}
+	if data, err = json.Marshal(merged); err != nil {
+		return base, err
+	}
+	var cfg Socks5Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return base, fmt.Errorf("无效的配置数据: %v", err)
+	}
+	if err := cfg.restoreSecrets(base); err != nil {
+		return base, err
+	}
+	return cfg, nil
+}
+
+// socks5Fields 按定义顺序返回 socks5 配置项的 yaml 键名和字段值
+func socks5Fields(cfg *Socks5Config) ([]string, []reflect.Value) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	keys := make([]string, 0, t.NumField())
+	values := make([]reflect.Value, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		keys = append(keys, key)
+		values = append(values, v.Field(i))
+	}
+	return keys, values
+}
+
+// DiffSocks5Config 返回 old 和 new 中不同的配置项（yaml 键名），按定义顺序排列
+// 按 YAML 编码结果比较，nil 和空的列表、映射视为相同
+func DiffSocks5Config(old, new Socks5Config) []string {
+	keys, oldValues := socks5Fields(&old)
+	_, newValues := socks5Fields(&new)
+	var changed []string
+	for i, key := range keys {
+		a, errA := yaml.Marshal(oldValues[i].Interface())
+		b, errB := yaml.Marshal(newValues[i].Interface())
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// copySocks5Fields 将 src 中指定的配置项复制到 dst
+func copySocks5Fields(dst *Socks5Config, src Socks5Config, fields []string) {
+	keys, dstValues := socks5Fields(dst)
+	_, srcValues := socks5Fields(&src)
+	for _, field := range fields {
+		for i, key := range keys {
+			if key == field {
+				dstValues[i].Set(srcValues[i])
+			}
+		}
+	}
+}
+
+// ConfigUpdate 一次配置修改的结果
+type ConfigUpdate struct {
+	Changed         []string `json:"changed"`         // 发生变化的配置项
+	Applied         []string `json:"applied"`         // 已在运行期间生效的配置项
+	RestartRequired []string `json:"restartRequired"` // 需要重启才能生效的配置项
+	Persisted       bool     `json:"persisted"`       // 是否已写回配置文件
+}
+
+// UpdateSocks5Config 将 cfg 中可热更新的配置项应用到运行中的代理服务器
+// 需要重启的配置项不影响运行中的配置，persist 为 true 时全部修改都写回配置文件，重启后生效
+// 配置有错误时不修改任何配置
+func UpdateSocks5Config(cfg Socks5Config, persist bool) (ConfigUpdate, error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return updateSocks5Config(cfg, persist)
+}
+
+// updateSocks5Config 与 UpdateSocks5Config 相同，调用方需持有 configMutex
+func updateSocks5Config(cfg Socks5Config, persist bool) (ConfigUpdate, error) {
+	update := ConfigUpdate{Changed: []string{}, Applied: []string{}, RestartRequired: []string{}}
+	if liveConfig == nil || proxyController == nil {
+		return update, fmt.Errorf("代理服务器未就绪")
+	}
+	if persist && configPath == "" {
+		return update, fmt.Errorf("没有可写回的配置文件")
+	}
+	syncLiveConfig()
+
+	for _, field := range DiffSocks5Config(liveConfig.Socks5, cfg) {
+		update.Changed = append(update.Changed, field)
+		if HotReloadable(field) {
+			update.Applied = append(update.Applied, field)
+		} else {
+			update.RestartRequired = append(update.RestartRequired, field)
+		}
+	}
+	if len(update.Changed) == 0 {
+		return update, nil
+	}
+
+	old := liveConfig.Socks5
+	if len(update.Applied) > 0 {
+		if err := proxyController.ApplyConfig(cfg, update.Applied); err != nil {
+			return update, err
+		}
+		copySocks5Fields(&liveConfig.Socks5, cfg, update.Applied)
+	}
+	logConfigDiff(old, cfg, update.Changed)
+	slog.Info("配置已更新", "applied", update.Applied, "restartRequired", update.RestartRequired)
+
+	if persist {
+		if err := saveSocks5Fields(configPath, cfg, update.Changed); err != nil {
+			return update, fmt.Errorf("%w: %v", ErrConfigPersist, err)
+		}
+		update.Persisted = true
+		slog.Info("配置已写回文件", "path", configPath, "fields", update.Changed)
+	}
+	return update, nil
+}
+
+// ReloadConfig 重新读取配置文件，将 socks5 配置中可热更新的配置项应用到运行中的代理服务器
+// 读取、检查或打开访问日志、配额状态等文件失败时保持全部原配置；log 和 gin 配置的变化需要重启，列在 RestartRequired 中
+func ReloadConfig() (ConfigUpdate, error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if configPath == "" || liveConfig == nil {
+		return ConfigUpdate{}, fmt.Errorf("没有登记配置文件")
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return ConfigUpdate{}, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+	update, err := updateSocks5Config(cfg.Socks5, false)
+	if err != nil {
+		return update, err
+	}
+	if !reflect.DeepEqual(liveConfig.Log, cfg.Log) {
+		update.RestartRequired = append(update.RestartRequired, "log")
+	}
+	if !reflect.DeepEqual(liveConfig.Gin, cfg.Gin) {
+		update.RestartRequired = append(update.RestartRequired, "gin")
+	}
+	return update, nil
+}
+
+// logConfigDiff 逐项输出配置的变化，密码和密码哈希脱敏
+func logConfigDiff(old, new Socks5Config, fields []string) {
+	old, new = old.MaskSecrets(), new.MaskSecrets()
+	keys, oldValues := socks5Fields(&old)
+	_, newValues := socks5Fields(&new)
+	for _, field := range fields {
+		for i, key := range keys {
+			if key != field {
+				continue
+			}
+			slog.Info("配置项变化", "field", key, "old", flowYAML(oldValues[i].Interface()), "new", flowYAML(newValues[i].Interface()))
+		}
+	}
+}
+
+// flowYAML 将值编码为单行的 YAML，与配置文件的写法一致
+func flowYAML(v any) string {
+	var node yaml.Node
+	if err := node.Encode(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	node.Style |= yaml.FlowStyle
+	data, err := yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveSocks5Fields 将 socks5 配置中的指定项写回配置文件
+// 只替换这些配置项的值，其他配置项和注释保持不变，通过临时文件替换保证写入的原子性
+func saveSocks5Fields(path string, cfg Socks5Config, fields []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("配置文件格式错误")
+	}
+	section := mappingValue(doc.Content[0], "socks5")
+
+	keys, values := socks5Fields(&cfg)
+	for _, field := range fields {
+		for i, key := range keys {
+			if key != field {
+				continue
+			}
+			var node yaml.Node
+			if err := node.Encode(values[i].Interface()); err != nil {
+				return err
+			}
+			old := mappingValue(section, key)
+			// 保持原来的 [a, b] 写法，块格式的列表和映射无法保留行尾注释的位置
+			if old.Kind == node.Kind && old.Style&yaml.FlowStyle != 0 {
+				node.Style |= yaml.FlowStyle
+			}
+			node.LineComment = old.LineComment
+			*old = node
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	encoder.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// mappingValue 返回映射节点中键对应的值节点，不存在时追加一个空映射
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
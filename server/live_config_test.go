@@ -0,0 +1,130 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDiffSocks5Config(t *testing.T) {
+	base := Socks5Config{
+		Host:      "0.0.0.0",
+		Port:      1080,
+		BlackList: []string{"10.0.0.0/8"},
+		Users:     []UserConfig{{Username: "alice", Password: "secret"}},
+	}
+	tests := []struct {
+		name   string
+		modify func(c *Socks5Config)
+		want   []string
+	}{
+		{"无变化", func(c *Socks5Config) {}, nil},
+		{"端口", func(c *Socks5Config) { c.Port = 1081 }, []string{"port"}},
+		{"按定义顺序", func(c *Socks5Config) { c.AuthList = []int{2}; c.Host = "127.0.0.1" }, []string{"host", "auth_list"}},
+		{"nil 和空列表相同", func(c *Socks5Config) { c.AuthList = []int{} }, nil},
+		{"列表内容", func(c *Socks5Config) { c.BlackList = []string{"10.0.0.0/16"} }, []string{"blacklist"}},
+		{"嵌套字段", func(c *Socks5Config) { c.Bandwidth.Global.Upload = 1024 }, []string{"bandwidth"}},
+		{"用户密码", func(c *Socks5Config) { c.Users = []UserConfig{{Username: "alice", Password: "other"}} }, []string{"users"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.BlackList = append([]string(nil), base.BlackList...)
+			tt.modify(&cfg)
+			if got := DiffSocks5Config(base, cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffSocks5Config = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopySocks5Fields(t *testing.T) {
+	dst := Socks5Config{Host: "0.0.0.0", Port: 1080}
+	src := Socks5Config{Host: "127.0.0.1", Port: 1081, BlackList: []string{"*:25"}}
+	copySocks5Fields(&dst, src, []string{"port", "blacklist"})
+	want := Socks5Config{Host: "0.0.0.0", Port: 1081, BlackList: []string{"*:25"}}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("copySocks5Fields = %+v, want %+v", dst, want)
+	}
+}
+
+func TestMergeSocks5Config(t *testing.T) {
+	base := Socks5Config{
+		Port:     1080,
+		User:     "admin",
+		Password: "secret",
+		Users:    []UserConfig{{Username: "alice", PasswordHash: "$2a$10$hash"}},
+	}
+	tests := []struct {
+		name    string
+		patch   string
+		check   func(c Socks5Config) bool
+		wantErr bool
+	}{
+		{"替换配置项", `{"port": 1081}`, func(c Socks5Config) bool { return c.Port == 1081 && c.Password == "secret" }, false},
+		{"掩码保持原密码", `{"password": "******", "users": [{"username": "alice", "passwordHash": "******"}]}`,
+			func(c Socks5Config) bool { return c.Password == "secret" && c.Users[0].PasswordHash == "$2a$10$hash" }, false},
+		{"新用户不能使用掩码", `{"users": [{"username": "bob", "password": "******"}]}`, nil, true},
+		{"未知配置项", `{"bogus": 1}`, nil, true},
+		{"类型错误", `{"port": "x"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := MergeSocks5Config(base, []byte(tt.patch))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(cfg) {
+				t.Errorf("MergeSocks5Config = %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestSaveSocks5Fields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	original := `# 代理配置
+socks5:
+  host: 0.0.0.0
+  port: 1080 # 监听端口
+  blacklist: [10.0.0.0/8]
+  auth_list: [0]
+log:
+  level: info
+`
+	if err := os.WriteFile(path, []byte(original), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Socks5Config{Host: "0.0.0.0", Port: 1081, BlackList: []string{"10.0.0.0/8", "*:25"}, AuthList: []int{0}}
+	cfg.Bandwidth.Global.Upload = 2048
+	if err := saveSocks5Fields(path, cfg, []string{"port", "blacklist", "bandwidth"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, want := range []string{"# 代理配置", "port: 1081 # 监听端口", "blacklist: [10.0.0.0/8, '*:25']", "level: info"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("配置文件缺少 %q:\n%s", want, text)
+		}
+	}
+
+	var saved ProjectConfig
+	if err := yaml.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Socks5.Port != 1081 || saved.Socks5.Bandwidth.Global.Upload != 2048 || len(saved.Socks5.BlackList) != 2 {
+		t.Errorf("写回的配置 %+v", saved.Socks5)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("文件权限 = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+}
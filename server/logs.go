@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultLogBufferSize 未配置 buffer_size 时内存中保留的日志条数
+const DefaultLogBufferSize = 1000
+
+// logSubscriberBuffer 实时日志订阅者的缓冲条数，订阅者来不及读取时丢弃新日志
+const logSubscriberBuffer = 256
+
+// logStreamHeartbeat 实时日志没有新日志时发送心跳的间隔
+const logStreamHeartbeat = 15 * time.Second
+
+// LogEntry 内存中保留的一条日志
+type LogEntry struct {
+	ID      uint64         `json:"id"` // 递增序号，SSE 断线重连时用于续传
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	Attrs   map[string]any `json:"attrs,omitempty"` // 分组属性的键以 . 连接
+
+	level slog.Level
+}
+
+// attr 返回属性的字符串值，不存在时为空
+func (e *LogEntry) attr(key string) string {
+	if v, ok := e.Attrs[key]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// LogFilter 日志查询条件，零值表示不过滤
+type LogFilter struct {
+	Level   slog.Level // 最低级别
+	Session string     // 会话ID
+	User    string     // 用户名，同时匹配该用户的会话内不带 user 属性的日志
+	Since   time.Time
+	Until   time.Time
+}
+
+// parseLogFilter 解析查询参数 level、session、user、since、until，时间为 RFC3339 格式
+func parseLogFilter(c *gin.Context) (LogFilter, error) {
+	f := LogFilter{Level: slog.LevelDebug, Session: c.Query("session"), User: c.Query("user")}
+	if level := c.Query("level"); level != "" {
+		if err := f.Level.UnmarshalText([]byte(level)); err != nil {
+			return f, fmt.Errorf("无效的日志级别: %q", level)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := c.Query(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("无效的 %s，应为 RFC3339 格式", p.name)
+			}
+			*p.t = t
+		}
+	}
+	return f, nil
+}
+
+// match 检查日志是否满足除用户以外的条件
+func (f *LogFilter) match(e *LogEntry) bool {
+	if e.level < f.Level {
+		return false
+	}
+	if f.Session != "" && e.attr("session") != f.Session {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// logRing 固定容量的日志环形缓冲区，写满后覆盖最旧的日志
+type logRing struct {
+	mu          sync.Mutex
+	entries     []LogEntry
+	start       int // 最旧一条的位置
+	count       int
+	seq         uint64
+	subscribers map[chan LogEntry]struct{}
+}
+
+var logBuffer = &logRing{
+	entries:     make([]LogEntry, DefaultLogBufferSize),
+	subscribers: make(map[chan LogEntry]struct{}),
+}
+
+// resize 修改容量，保留最新的日志
+func (r *logRing) resize(size int) {
+	if size <= 0 {
+		size = DefaultLogBufferSize
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size == len(r.entries) {
+		return
+	}
+	entries := make([]LogEntry, size)
+	n := r.count
+	if n > size {
+		n = size
+	}
+	for i := 0; i < n; i++ {
+		entries[i] = r.entries[(r.start+r.count-n+i)%len(r.entries)]
+	}
+	r.entries, r.start, r.count = entries, 0, n
+}
+
+// add 追加一条日志并推送给订阅者
+func (r *logRing) add(e LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.ID = r.seq
+	if r.count < len(r.entries) {
+		r.entries[(r.start+r.count)%len(r.entries)] = e
+		r.count++
+	} else {
+		r.entries[r.start] = e
+		r.start = (r.start + 1) % len(r.entries)
+	}
+	for ch := range r.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// logMatcher 按条件匹配日志
+// 用户属性通常只出现在认证相关的日志中，匹配用户时同时匹配该用户会话内的其他日志
+type logMatcher struct {
+	filter   LogFilter
+	sessions map[string]bool // 已知属于该用户的会话
+}
+
+// match 检查日志是否满足条件，遇到该用户的日志时记录其会话
+func (m *logMatcher) match(e *LogEntry) bool {
+	if m.filter.User != "" {
+		session := e.attr("session")
+		if e.attr("user") == m.filter.User {
+			if session != "" {
+				m.sessions[session] = true
+			}
+		} else if !m.sessions[session] {
+			return false
+		}
+	}
+	return m.filter.match(e)
+}
+
+// matcher 返回按条件匹配日志的 logMatcher，已从缓冲区中找出该用户的会话
+func (r *logRing) matcher(f LogFilter) *logMatcher {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.matcherLocked(f)
+}
+
+// matcherLocked 与 matcher 相同，调用方需持有锁
+func (r *logRing) matcherLocked(f LogFilter) *logMatcher {
+	m := &logMatcher{filter: f, sessions: make(map[string]bool)}
+	if f.User == "" {
+		return m
+	}
+	for i := 0; i < r.count; i++ {
+		e := &r.entries[(r.start+i)%len(r.entries)]
+		if session := e.attr("session"); session != "" && e.attr("user") == f.User {
+			m.sessions[session] = true
+		}
+	}
+	return m
+}
+
+// query 按条件返回最新的 limit 条日志（limit<=0 时不限制），afterID 非0时只返回序号更大的日志，按时间顺序排列
+func (r *logRing) query(f LogFilter, limit int, afterID uint64) []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.matcherLocked(f)
+	result := []LogEntry{}
+	for i := r.count - 1; i >= 0; i-- {
+		e := &r.entries[(r.start+i)%len(r.entries)]
+		if e.ID <= afterID {
+			break
+		}
+		if !m.match(e) {
+			continue
+		}
+		result = append(result, *e)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// subscribe 订阅新日志，返回的函数取消订阅
+func (r *logRing) subscribe() (<-chan LogEntry, func()) {
+	ch := make(chan LogEntry, logSubscriberBuffer)
+	r.mu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.subscribers, ch)
+		r.mu.Unlock()
+	}
+}
+
+// writeLogEvent 以 Server-Sent Events 格式输出一条日志，事件ID为日志序号
+func writeLogEvent(w io.Writer, e *LogEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", e.ID, data)
+	return err
+}
+
+// captureHandler 将日志同时写入内存缓冲区和下一级处理器
+type captureHandler struct {
+	next    slog.Handler
+	replace func(groups []string, a slog.Attr) slog.Attr // 写入缓冲区前替换属性，用于脱敏
+	attrs   map[string]any                               // WithAttrs 添加的属性，键已带分组前缀
+	groups  []string
+}
+
+// CaptureLogs 包装日志处理器，处理的每条日志同时保留在内存缓冲区中，供 /api/logs 查询和实时推送
+// size 为缓冲区保留的条数，0 时使用 DefaultLogBufferSize；replace 非nil时对写入缓冲区的属性调用，与 slog.HandlerOptions.ReplaceAttr 相同
+func CaptureLogs(next slog.Handler, size int, replace func(groups []string, a slog.Attr) slog.Attr) slog.Handler {
+	logBuffer.resize(size)
+	return &captureHandler{next: next, replace: replace}
+}
+
+// Enabled 与下一级处理器一致，缓冲区只保留实际输出的日志
+func (h *captureHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle 写入缓冲区后交给下一级处理器
+func (h *captureHandler) Handle(ctx context.Context, r slog.Record) error {
+	e := LogEntry{
+		Time:    r.Time,
+		Level:   r.Level.String(),
+		Message: r.Message,
+		level:   r.Level,
+	}
+	if n := len(h.attrs) + r.NumAttrs(); n > 0 {
+		e.Attrs = make(map[string]any, n)
+	}
+	for k, v := range h.attrs {
+		e.Attrs[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		h.addAttr(e.Attrs, h.groups, a)
+		return true
+	})
+	logBuffer.add(e)
+	return h.next.Handle(ctx, r)
+}
+
+// addAttr 展开分组属性后写入 attrs
+func (h *captureHandler) addAttr(attrs map[string]any, groups []string, a slog.Attr) {
+	if h.replace != nil && a.Value.Kind() != slog.KindGroup {
+		a = h.replace(groups, a)
+	}
+	a.Value = a.Value.Resolve()
+	if a.Key == "" && a.Value.Kind() != slog.KindGroup {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, ga := range a.Value.Group() {
+			h.addAttr(attrs, groups, ga)
+		}
+		return
+	}
+	key := a.Key
+	if len(groups) > 0 {
+		key = strings.Join(groups, ".") + "." + key
+	}
+	switch a.Value.Kind() {
+	case slog.KindDuration:
+		attrs[key] = a.Value.Duration().String()
+	case slog.KindAny:
+		// 错误和无法编码为JSON的值按字符串保留
+		v := a.Value.Any()
+		if err, ok := v.(error); ok {
+			attrs[key] = err.Error()
+		} else if _, err := json.Marshal(v); err != nil {
+			attrs[key] = fmt.Sprint(v)
+		} else {
+			attrs[key] = v
+		}
+	default:
+		attrs[key] = a.Value.Any()
+	}
+}
+
+// WithAttrs 返回带有额外属性的处理器
+func (h *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	m := make(map[string]any, len(h.attrs)+len(attrs))
+	for k, v := range h.attrs {
+		m[k] = v
+	}
+	for _, a := range attrs {
+		h.addAttr(m, h.groups, a)
+	}
+	clone := *h
+	clone.attrs = m
+	clone.next = h.next.WithAttrs(attrs)
+	return &clone
+}
+
+// WithGroup 返回在分组内输出属性的处理器
+func (h *captureHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	clone.next = h.next.WithGroup(name)
+	return &clone
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestRing 返回写入了 entries 的环形缓冲区
+func newTestRing(size int, entries ...LogEntry) *logRing {
+	r := &logRing{entries: make([]LogEntry, size), subscribers: make(map[chan LogEntry]struct{})}
+	for _, e := range entries {
+		r.add(e)
+	}
+	return r
+}
+
+// entryIDs 返回日志的序号
+func entryIDs(entries []LogEntry) []uint64 {
+	ids := []uint64{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestLogRingQuery(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(sec int, level slog.Level, attrs map[string]any) LogEntry {
+		return LogEntry{Time: base.Add(time.Duration(sec) * time.Second), Level: level.String(), level: level, Attrs: attrs}
+	}
+	r := newTestRing(5,
+		entry(1, slog.LevelInfo, nil), // 被覆盖
+		entry(2, slog.LevelInfo, map[string]any{"session": "s1"}),
+		entry(3, slog.LevelInfo, map[string]any{"session": "s1", "user": "alice"}),
+		entry(4, slog.LevelWarn, map[string]any{"session": "s1"}),
+		entry(5, slog.LevelDebug, map[string]any{"session": "s2"}),
+		entry(6, slog.LevelError, map[string]any{"session": "s2", "user": "bob"}),
+	)
+
+	tests := []struct {
+		name    string
+		filter  LogFilter
+		limit   int
+		afterID uint64
+		want    []uint64
+	}{
+		{"全部", LogFilter{Level: slog.LevelDebug}, 0, 0, []uint64{2, 3, 4, 5, 6}},
+		{"级别", LogFilter{Level: slog.LevelWarn}, 0, 0, []uint64{4, 6}},
+		{"会话", LogFilter{Level: slog.LevelDebug, Session: "s2"}, 0, 0, []uint64{5, 6}},
+		{"用户包含会话内的其他日志", LogFilter{Level: slog.LevelDebug, User: "alice"}, 0, 0, []uint64{2, 3, 4}},
+		{"时间范围", LogFilter{Level: slog.LevelDebug, Since: base.Add(3 * time.Second), Until: base.Add(5 * time.Second)}, 0, 0, []uint64{3, 4, 5}},
+		{"最新的若干条", LogFilter{Level: slog.LevelDebug}, 2, 0, []uint64{5, 6}},
+		{"续传", LogFilter{Level: slog.LevelDebug}, 0, 4, []uint64{5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entryIDs(r.query(tt.filter, tt.limit, tt.afterID)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("query = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 缩小容量时保留最新的日志
+	r.resize(2)
+	if got := entryIDs(r.query(LogFilter{Level: slog.LevelDebug}, 0, 0)); !reflect.DeepEqual(got, []uint64{5, 6}) {
+		t.Errorf("resize 后 = %v, want [5 6]", got)
+	}
+}
+
+func TestLogMatcherLearnsSessions(t *testing.T) {
+	r := newTestRing(10)
+	m := r.matcher(LogFilter{Level: slog.LevelDebug, User: "alice"})
+	entries := []struct {
+		attrs map[string]any
+		want  bool
+	}{
+		{map[string]any{"session": "s1"}, false},
+		{map[string]any{"session": "s1", "user": "alice"}, true},
+		{map[string]any{"session": "s1"}, true},
+		{map[string]any{"session": "s2"}, false},
+		{nil, false},
+	}
+	for i, tt := range entries {
+		e := LogEntry{Attrs: tt.attrs}
+		if got := m.match(&e); got != tt.want {
+			t.Errorf("第 %d 条 match = %v, want %v", i+1, got, tt.want)
+		}
+	}
+}
+
+func TestCaptureHandlerAttrs(t *testing.T) {
+	replace := func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == "password" {
+			a.Value = slog.StringValue("***")
+		}
+		return a
+	}
+	logger := slog.New(CaptureLogs(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}), 0, replace))
+
+	last := lastLogID()
+	logger.With("component", "test").WithGroup("req").Info("请求",
+		"password", "secret", "error", errors.New("失败"), "elapsed", 1500*time.Millisecond,
+		slog.Group("peer", "port", 1080))
+
+	entries := logBuffer.query(LogFilter{Level: slog.LevelDebug}, 0, last)
+	if len(entries) != 1 {
+		t.Fatalf("新增日志 %d 条, want 1", len(entries))
+	}
+	want := map[string]any{
+		"component":     "test",
+		"req.password":  "***",
+		"req.error":     "失败",
+		"req.elapsed":   "1.5s",
+		"req.peer.port": int64(1080),
+	}
+	if got := entries[0].Attrs; !reflect.DeepEqual(got, want) {
+		t.Errorf("Attrs = %v, want %v", got, want)
+	}
+	if entries[0].Message != "请求" || entries[0].Level != "INFO" {
+		t.Errorf("entry = %+v", entries[0])
+	}
+	if !logger.Handler().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("Enabled 应与下一级处理器一致")
+	}
+}
+
+// lastLogID 返回全局缓冲区当前的最大序号
+func lastLogID() uint64 {
+	logBuffer.mu.Lock()
+	defer logBuffer.mu.Unlock()
+	return logBuffer.seq
+}
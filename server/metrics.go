@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 指标名称前缀
+const metricsNamespace = "socks5"
+
+// dialLatencyBuckets 连接目标耗时直方图的桶上界（秒）
+var dialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram 累积直方图，counts[i] 为落在 buckets[i] 内（不含更小的桶）的观测数
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// observe 记录一次观测值
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(dialLatencyBuckets))
+	}
+	for i, le := range dialLatencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// userBytes 已结束会话的转发字节数
+type userBytes struct {
+	up   int64
+	down int64
+}
+
+var (
+	metricsMutex  = sync.Mutex{}
+	sessionsTotal = make(map[string]int64)      // 按命令统计的会话总数
+	authAttempts  = make(map[[2]string]int64)   // 按认证方法和结果统计的认证次数
+	dialLatency   = make(map[string]*histogram) // 按结果统计的连接目标耗时
+	httpRequests  = make(map[[3]string]int64)   // 按方法、路由和状态码统计的管理接口请求数
+
+	// 已结束会话的转发字节数，进行中的会话在采集时从连接表累加，由 connectionsMutex 保护
+	finishedBytes     userBytes
+	finishedUserBytes = make(map[string]*userBytes)
+
+	udpDatagramsUp   atomic.Int64 // 客户端发往目标的UDP数据报数
+	udpDatagramsDown atomic.Int64 // 目标返回客户端的UDP数据报数
+)
+
+// RecordAuth 记录一次认证结果，method 为 none 或 password
+func RecordAuth(method string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	metricsMutex.Lock()
+	authAttempts[[2]string{method, result}]++
+	metricsMutex.Unlock()
+}
+
+// ObserveDial 记录一次连接目标的耗时
+func ObserveDial(d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metricsMutex.Lock()
+	h := dialLatency[result]
+	if h == nil {
+		h = &histogram{}
+		dialLatency[result] = h
+	}
+	h.observe(d.Seconds())
+	metricsMutex.Unlock()
+}
+
+// AddUDPDatagrams 累计转发的UDP数据报数，up 为客户端发往目标，down 为目标返回客户端
+func AddUDPDatagrams(up, down int64) {
+	if up != 0 {
+		udpDatagramsUp.Add(up)
+	}
+	if down != 0 {
+		udpDatagramsDown.Add(down)
+	}
+}
+
+// recordSessionStart 累计会话总数，由 AddConnection 调用
+func recordSessionStart(command string) {
+	metricsMutex.Lock()
+	sessionsTotal[command]++
+	metricsMutex.Unlock()
+}
+
+// recordSessionEnd 将结束会话的字节数计入累计值，调用方需持有连接表的写锁
+func recordSessionEnd(info *ConnectionInfo) {
+	up, down := atomic.LoadInt64(&info.BytesIn), atomic.LoadInt64(&info.BytesOut)
+	finishedBytes.up += up
+	finishedBytes.down += down
+	if info.User == "" {
+		return
+	}
+	u := finishedUserBytes[info.User]
+	if u == nil {
+		u = &userBytes{}
+		finishedUserBytes[info.User] = u
+	}
+	u.up += up
+	u.down += down
+}
+
+// metricsMiddleware 统计管理接口的请求数，未匹配路由的请求归入 unmatched，避免标签随路径无限增长
+func metricsMiddleware(c *gin.Context) {
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	key := [3]string{c.Request.Method, route, strconv.Itoa(c.Writer.Status())}
+	metricsMutex.Lock()
+	httpRequests[key]++
+	metricsMutex.Unlock()
+}
+
+// metricsWriter 生成 Prometheus 文本格式
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// header 输出指标的 HELP 和 TYPE 行
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", metricsNamespace, name, help, metricsNamespace, name, typ)
+}
+
+// sample 输出一个样本，labels 为交替的标签名和标签值
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(metricsNamespace + "_" + name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatMetricValue(value))
+	w.buf.WriteByte('\n')
+}
+
+// escapeLabelValue 转义标签值中的反斜杠、双引号和换行
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatMetricValue 格式化样本值
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys 返回排序后的键，输出顺序稳定便于比对
+func sortedKeys[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	return keys
+}
+
+// renderMetrics 生成全部指标
+func renderMetrics() []byte {
+	w := &metricsWriter{}
+
+	// 会话和转发字节数，进行中的会话与已结束会话在同一把锁下累加，保证计数单调
+	activeByCommand := make(map[string]int64)
+	bytesByUser := make(map[string]userBytes)
+	connectionsMutex.RLock()
+	bytesTotal := finishedBytes
+	for user, u := range finishedUserBytes {
+		bytesByUser[user] = *u
+	}
+	for _, conn := range activeConnections {
+		activeByCommand[conn.Command]++
+		up, down := atomic.LoadInt64(&conn.BytesIn), atomic.LoadInt64(&conn.BytesOut)
+		bytesTotal.up += up
+		bytesTotal.down += down
+		if conn.User != "" {
+			u := bytesByUser[conn.User]
+			u.up += up
+			u.down += down
+			bytesByUser[conn.User] = u
+		}
+	}
+	connectionsMutex.RUnlock()
+
+	statsMutex.RLock()
+	authenticated := totalConnections
+	rejected := make(map[string]int64, len(rejectedConnections))
+	for reason, n := range rejectedConnections {
+		rejected[reason] = n
+	}
+	statsMutex.RUnlock()
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	w.header("up", "gauge", "Whether the proxy is accepting new connections (0 while draining).")
+	up := 1.0
+	if isDraining() {
+		up = 0
+	}
+	w.sample("up", up)
+
+	w.header("uptime_seconds", "gauge", "Seconds since the process started.")
+	w.sample("uptime_seconds", time.Since(serverStartTime).Seconds())
+
+	w.header("connections_authenticated_total", "counter", "Client connections that completed authentication.")
+	w.sample("connections_authenticated_total", float64(authenticated))
+
+	w.header("sessions_active", "gauge", "Sessions currently relaying, by command.")
+	for _, cmd := range []string{"CONNECT", "BIND", "UDP"} {
+		w.sample("sessions_active", float64(activeByCommand[cmd]), "command", cmd)
+	}
+
+	w.header("sessions_total", "counter", "Sessions that passed request checks, by command.")
+	for _, cmd := range sortedKeys(sessionsTotal) {
+		w.sample("sessions_total", float64(sessionsTotal[cmd]), "command", cmd)
+	}
+
+	w.header("auth_attempts_total", "counter", "Authentication attempts, by method and result.")
+	for _, key := range sortedKeys(authAttempts) {
+		w.sample("auth_attempts_total", float64(authAttempts[key]), "method", key[0], "result", key[1])
+	}
+
+	w.header("relayed_bytes_total", "counter", "Bytes relayed, by direction (up: client to target, down: target to client).")
+	w.sample("relayed_bytes_total", float64(bytesTotal.up), "direction", "up")
+	w.sample("relayed_bytes_total", float64(bytesTotal.down), "direction", "down")
+
+	w.header("user_relayed_bytes_total", "counter", "Bytes relayed for authenticated users, by user and direction.")
+	for _, user := range sortedKeys(bytesByUser) {
+		u := bytesByUser[user]
+		w.sample("user_relayed_bytes_total", float64(u.up), "user", user, "direction", "up")
+		w.sample("user_relayed_bytes_total", float64(u.down), "user", user, "direction", "down")
+	}
+
+	w.header("dial_duration_seconds", "histogram", "Time taken to connect to CONNECT targets, by result.")
+	for _, result := range sortedKeys(dialLatency) {
+		h := dialLatency[result]
+		var cumulative uint64
+		for i, le := range dialLatencyBuckets {
+			cumulative += h.counts[i]
+			w.sample("dial_duration_seconds_bucket", float64(cumulative), "result", result, "le", formatMetricValue(le))
+		}
+		w.sample("dial_duration_seconds_bucket", float64(h.count), "result", result, "le", "+Inf")
+		w.sample("dial_duration_seconds_sum", h.sum, "result", result)
+		w.sample("dial_duration_seconds_count", float64(h.count), "result", result)
+	}
+
+	w.header("rejected_connections_total", "counter", "Connections and requests rejected, by reason (rate_limit_*, concurrency_*, quota, banned_*, ...).")
+	for _, reason := range sortedKeys(rejected) {
+		w.sample("rejected_connections_total", float64(rejected[reason]), "reason", reason)
+	}
+
+	w.header("udp_datagrams_total", "counter", "UDP datagrams relayed, by direction.")
+	w.sample("udp_datagrams_total", float64(udpDatagramsUp.Load()), "direction", "up")
+	w.sample("udp_datagrams_total", float64(udpDatagramsDown.Load()), "direction", "down")
+
+	w.header("admin_http_requests_total", "counter", "Requests served by the admin HTTP server, by method, route and status code.")
+	for _, key := range sortedKeys(httpRequests) {
+		w.sample("admin_http_requests_total", float64(httpRequests[key]), "method", key[0], "route", key[1], "code", key[2])
+	}
+
+	w.header("goroutines", "gauge", "Number of goroutines in the process.")
+	w.sample("goroutines", float64(runtime.NumGoroutine()))
+
+	return w.buf.Bytes()
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// relayedBytes 从指标文本中取出 relayed_bytes_total{direction="up"}
+func relayedBytes(t *testing.T, text []byte) int64 {
+	t.Helper()
+	m := regexp.MustCompile(`socks5_relayed_bytes_total\{direction="up"\} (\d+)`).FindSubmatch(text)
+	if m == nil {
+		t.Fatalf("未找到 relayed_bytes_total:\n%s", text)
+	}
+	n, _ := strconv.ParseInt(string(m[1]), 10, 64)
+	return n
+}
+
+func TestRenderMetricsBytesMonotonic(t *testing.T) {
+	const sessions = 200
+	before := relayedBytes(t, renderMetrics())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < sessions; i++ {
+			id := fmt.Sprintf("metrics-test-%d", i)
+			AddConnection(&ConnectionInfo{ID: id, User: "alice", Command: "CONNECT", BytesIn: 10, BytesOut: 20}, func() {})
+			RemoveConnection(id)
+		}
+	}()
+
+	last := before
+	for i := 0; i < sessions; i++ {
+		n := relayedBytes(t, renderMetrics())
+		if n < last {
+			t.Fatalf("转发字节数减少: %d -> %d", last, n)
+		}
+		last = n
+	}
+	wg.Wait()
+	if got := relayedBytes(t, renderMetrics()); got != before+10*sessions {
+		t.Fatalf("relayed_bytes_total = %d, want %d", got, before+10*sessions)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 重启方式
+const (
+	RestartModeDrain     = "drain"     // 等待进行中的会话结束后重启，超过 shutdown_timeout 后强制关闭
+	RestartModeImmediate = "immediate" // 立即关闭所有会话并重启
+)
+
+// 重启的阶段，除 reloading、running、failed 外由代理服务器报告
+const (
+	RestartReloading = "reloading" // 重新读取配置文件
+	RestartRunning   = "running"   // 新监听器已开始接受连接
+	RestartFailed    = "failed"    // 重启失败
+)
+
+// ErrRestartInProgress 已有重启正在进行
+var ErrRestartInProgress = errors.New("重启正在进行中")
+
+// RestartStatus 一次进程内重启的进度
+type RestartStatus struct {
+	Mode        string     `json:"mode"`                  // drain 或 immediate
+	Phase       string     `json:"phase"`                 // reloading、starting、draining 或 stopping、running、failed
+	StartedAt   time.Time  `json:"startedAt"`             // 开始重启的时间
+	AcceptingAt *time.Time `json:"acceptingAt,omitempty"` // 新监听器开始接受连接的时间
+	Addr        string     `json:"addr,omitempty"`        // 新监听器的地址
+	Changed     []string   `json:"changed"`               // 与重启前相比变化的配置项（yaml 键名）
+	Sessions    int        `json:"sessions"`              // 查询时的当前连接数，排空阶段即剩余的会话数
+	Error       string     `json:"error,omitempty"`
+}
+
+var (
+	restartMutex  sync.Mutex     // 保护 restartStatus
+	restartStatus *RestartStatus // 最近一次重启的进度，没有重启过时为nil
+	restarting    bool
+)
+
+// LastRestart 返回最近一次重启的进度，没有重启过时返回false
+func LastRestart() (RestartStatus, bool) {
+	restartMutex.Lock()
+	defer restartMutex.Unlock()
+	if restartStatus == nil {
+		return RestartStatus{}, false
+	}
+	status := *restartStatus
+	status.Sessions = GetActiveConnections()
+	return status, true
+}
+
+// setRestartPhase 更新重启的阶段
+func setRestartPhase(phase string) {
+	restartMutex.Lock()
+	restartStatus.Phase = phase
+	restartMutex.Unlock()
+	slog.Info("重启进度", "phase", phase)
+}
+
+// RestartProxy 重新读取配置文件，在进程内重启代理服务器，新监听器开始接受连接后返回
+// mode 为空时使用 RestartModeDrain；同一时间只能有一次重启，直到重启前的会话全部结束
+// 新监听器开始接受连接前配置的修改和重新加载等待重启完成，之后不再等待排空
+// 配置有错误时不停止代理服务器
+func RestartProxy(mode string) (RestartStatus, error) {
+	if mode == "" {
+		mode = RestartModeDrain
+	}
+	if mode != RestartModeDrain && mode != RestartModeImmediate {
+		return RestartStatus{}, fmt.Errorf("无效的重启方式: %q", mode)
+	}
+
+	restartMutex.Lock()
+	if restarting {
+		restartMutex.Unlock()
+		return RestartStatus{}, ErrRestartInProgress
+	}
+	restarting = true
+	restartStatus = &RestartStatus{Mode: mode, Phase: RestartReloading, StartedAt: time.Now(), Changed: []string{}}
+	restartMutex.Unlock()
+
+	wait, err := restartProxy(mode)
+	if err != nil {
+		restartMutex.Lock()
+		restartStatus.Phase = RestartFailed
+		restartStatus.Error = err.Error()
+		restarting = false
+		restartMutex.Unlock()
+		status, _ := LastRestart()
+		slog.Error("重启失败", "mode", mode, "error", err)
+		return status, err
+	}
+
+	finish := func() {
+		restartMutex.Lock()
+		restartStatus.Phase = RestartRunning
+		restarting = false
+		restartMutex.Unlock()
+	}
+	status, _ := LastRestart()
+	slog.Info("新监听器已开始接受连接", "mode", mode, "addr", status.Addr, "elapsed", status.AcceptingAt.Sub(status.StartedAt))
+	// 立即重启时关闭会话很快，等待完成后返回
+	if wait == nil || mode == RestartModeImmediate {
+		if wait != nil {
+			wait()
+		}
+		finish()
+		status, _ = LastRestart()
+		return status, nil
+	}
+	// 排空期间不持有 configMutex，不影响配置的查询、修改和重新加载
+	go func() {
+		wait()
+		finish()
+		slog.Info("重启完成，重启前的会话已全部结束", "mode", mode)
+	}()
+	return status, nil
+}
+
+// restartProxy 执行重启，进度写入 restartStatus，返回等待重启前的会话结束的函数
+func restartProxy(mode string) (func(), error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if liveConfig == nil || proxyController == nil {
+		return nil, fmt.Errorf("代理服务器未就绪")
+	}
+	syncLiveConfig()
+
+	// 没有配置文件时按运行中的配置重启
+	cfg := liveConfig.Socks5
+	if configPath != "" {
+		loaded, err := LoadConfig(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("读取配置文件失败: %v", err)
+		}
+		cfg = loaded.Socks5
+	}
+	changed := DiffSocks5Config(liveConfig.Socks5, cfg)
+	restartMutex.Lock()
+	restartStatus.Changed = append(restartStatus.Changed, changed...)
+	restartMutex.Unlock()
+
+	addr, wait, err := proxyController.Restart(cfg, mode == RestartModeDrain, setRestartPhase)
+	if err != nil {
+		return nil, err
+	}
+	logConfigDiff(liveConfig.Socks5, cfg, changed)
+	liveConfig.Socks5 = cfg
+
+	now := time.Now()
+	restartMutex.Lock()
+	restartStatus.AcceptingAt = &now
+	restartStatus.Addr = addr
+	restartMutex.Unlock()
+	return wait, nil
+}
@@ -0,0 +1,209 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-socket5/server"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// DefaultAccessLogTemplate text 格式的内置模板，空字段输出为 -
+const DefaultAccessLogTemplate = `{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}} {{.Session}} {{.Client}} {{or .User "-"}} ` +
+	`{{or .Command "-"}} {{or .Target "-"}} {{or .ResolvedIP "-"}} {{.Reply}} {{.BytesUp}} {{.BytesDown}} ` +
+	`{{printf "%.3f" .Duration}} {{.CloseReason}}`
+
+// AccessRecord 访问日志的一条记录，会话结束时输出
+type AccessRecord struct {
+	Time        time.Time `json:"time"` // 会话结束时间
+	Session     string    `json:"session"`
+	Client      string    `json:"client"`
+	User        string    `json:"user"`
+	Command     string    `json:"command"`
+	Target      string    `json:"target"`      // 请求的目标地址
+	ResolvedIP  string    `json:"resolvedIP"`  // 实际连接的目标IP（CONNECT）或连入方IP（BIND）
+	Reply       int       `json:"reply"`       // 最后发送的应答码，未发送应答时为 -1
+	BytesUp     int64     `json:"bytesUp"`     // 客户端发往目标的字节数
+	BytesDown   int64     `json:"bytesDown"`   // 目标返回客户端的字节数
+	Duration    float64   `json:"duration"`    // 会话时长（秒）
+	CloseReason string    `json:"closeReason"` // 会话结束的原因
+}
+
+// accessLogger 会话访问日志
+type accessLogger struct {
+	mu   sync.Mutex
+	cfg  server.AccessLogConfig
+	tmpl *template.Template // text 格式的模板，json 格式时为nil
+	out  io.WriteCloser     // 未启用时为nil
+}
+
+// nopCloser 关闭时不关闭标准输出
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// validateAccessLog 检查访问日志配置并解析模板，json 格式时模板为nil
+func validateAccessLog(cfg server.AccessLogConfig) (*template.Template, error) {
+	var tmpl *template.Template
+	switch strings.ToLower(cfg.Format) {
+	case "", "json":
+	case "text":
+		text := cfg.Template
+		if text == "" {
+			text = DefaultAccessLogTemplate
+		}
+		var err error
+		if tmpl, err = template.New("access").Parse(text); err != nil {
+			return nil, fmt.Errorf("解析访问日志模板失败: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("无效的访问日志格式: %q", cfg.Format)
+	}
+	if cfg.MaxSize < 0 || cfg.Rotate < 0 || cfg.MaxBackups < 0 {
+		return nil, fmt.Errorf("访问日志的轮转参数不能为负数")
+	}
+	return tmpl, nil
+}
+
+// set 替换访问日志配置，打开新的输出后关闭旧的输出
+func (a *accessLogger) set(cfg server.AccessLogConfig) error {
+	commit, _, err := a.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// prepare 检查配置并打开新的输出，不修改当前配置
+// 返回的 commit 切换到新的输出并关闭旧的输出，discard 关闭新打开的输出，两者只能调用其一
+func (a *accessLogger) prepare(cfg server.AccessLogConfig) (commit, discard func(), err error) {
+	tmpl, err := validateAccessLog(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out io.WriteCloser
+	switch cfg.Path {
+	case "":
+	case "stdout", "-":
+		out = nopCloser{os.Stdout}
+	default:
+		f, err := openRotatingFile(cfg.Path, cfg.MaxSize, cfg.Rotate, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("打开访问日志失败: %v", err)
+		}
+		out = f
+	}
+
+	commit = func() {
+		a.mu.Lock()
+		old := a.out
+		a.cfg, a.tmpl, a.out = cfg, tmpl, out
+		a.mu.Unlock()
+		if old != nil {
+			old.Close()
+		}
+	}
+	discard = func() {
+		if out != nil {
+			out.Close()
+		}
+	}
+	return commit, discard, nil
+}
+
+// get 返回当前的访问日志配置
+func (a *accessLogger) get() server.AccessLogConfig {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+// enabled 是否启用了访问日志
+func (a *accessLogger) enabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.out != nil
+}
+
+// write 输出一条记录，每条记录占一行
+func (a *accessLogger) write(rec *AccessRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.out == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if a.tmpl != nil {
+		if err := a.tmpl.Execute(&buf, rec); err != nil {
+			return err
+		}
+		if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	} else if err := json.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	_, err := a.out.Write(buf.Bytes())
+	return err
+}
+
+// close 关闭输出，之后的记录被丢弃
+func (a *accessLogger) close() {
+	a.mu.Lock()
+	out := a.out
+	a.out = nil
+	a.mu.Unlock()
+	if out != nil {
+		out.Close()
+	}
+}
+
+// accessRecord 生成会话的访问日志记录
+func (sess *session) accessRecord(now time.Time) *AccessRecord {
+	rec := &AccessRecord{
+		Time:        now,
+		Session:     sess.id,
+		Client:      sess.conn.RemoteAddr().String(),
+		User:        sess.user,
+		Command:     sess.command,
+		Target:      sess.target,
+		ResolvedIP:  sess.resolved,
+		Reply:       sess.reply,
+		Duration:    now.Sub(sess.start).Round(time.Millisecond).Seconds(),
+		CloseReason: sess.endReason(),
+	}
+	if sess.info != nil {
+		rec.BytesUp = atomic.LoadInt64(&sess.info.BytesIn)
+		rec.BytesDown = atomic.LoadInt64(&sess.info.BytesOut)
+	}
+	return rec
+}
+
+// logAccess 会话结束时输出访问日志
+func (s *Server) logAccess(sess *session) {
+	if !s.accessLog.enabled() {
+		return
+	}
+	if err := s.accessLog.write(sess.accessRecord(time.Now())); err != nil {
+		sess.log.Warn("写入访问日志失败", "error", err)
+	}
+}
+
+// accessLogAttrs 访问日志配置的日志属性
+func accessLogAttrs(cfg server.AccessLogConfig) []any {
+	format := cfg.Format
+	if format == "" {
+		format = "json"
+	}
+	return []any{slog.String("path", cfg.Path), slog.String("format", format),
+		slog.Int64("maxSize", cfg.MaxSize), slog.Duration("rotate", cfg.Rotate), slog.Int("maxBackups", cfg.MaxBackups)}
+}
@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestValidateAccessLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      server.AccessLogConfig
+		wantTmpl bool
+		wantErr  bool
+	}{
+		{"默认 json", server.AccessLogConfig{}, false, false},
+		{"text 默认模板", server.AccessLogConfig{Format: "TEXT"}, true, false},
+		{"自定义模板", server.AccessLogConfig{Format: "text", Template: "{{.User}}"}, true, false},
+		{"模板语法错误", server.AccessLogConfig{Format: "text", Template: "{{.User"}, false, true},
+		{"未知格式", server.AccessLogConfig{Format: "csv"}, false, true},
+		{"负数轮转参数", server.AccessLogConfig{MaxBackups: -1}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := validateAccessLog(tt.cfg)
+			if (err != nil) != tt.wantErr || (tmpl != nil) != tt.wantTmpl {
+				t.Errorf("validateAccessLog = %v, %v, wantTmpl %v, wantErr %v", tmpl, err, tt.wantTmpl, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccessLoggerWrite(t *testing.T) {
+	rec := &AccessRecord{
+		Time:        time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Session:     "abc",
+		Client:      "192.0.2.1:5000",
+		Command:     "CONNECT",
+		Target:      "example.com:443",
+		ResolvedIP:  "198.51.100.7",
+		Reply:       0,
+		BytesUp:     10,
+		BytesDown:   20,
+		Duration:    1.25,
+		CloseReason: "closed",
+	}
+	tests := []struct {
+		name string
+		cfg  server.AccessLogConfig
+		want string
+	}{
+		{"text", server.AccessLogConfig{Format: "text"},
+			"2026-01-02T03:04:05.000Z abc 192.0.2.1:5000 - CONNECT example.com:443 198.51.100.7 0 10 20 1.250 closed\n"},
+		{"自定义模板补换行", server.AccessLogConfig{Format: "text", Template: "{{.Session}} {{.Reply}}"}, "abc 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Path = filepath.Join(t.TempDir(), "access.log")
+			var a accessLogger
+			if err := a.set(tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.write(rec); err != nil {
+				t.Fatal(err)
+			}
+			a.close()
+			data, err := os.ReadFile(tt.cfg.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("access log = %q, want %q", data, tt.want)
+			}
+		})
+	}
+
+	// json 格式每条记录一行
+	path := filepath.Join(t.TempDir(), "access.json")
+	var a accessLogger
+	if err := a.set(server.AccessLogConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	a.write(rec)
+	a.write(rec)
+	a.close()
+	if err := a.write(rec); err != nil {
+		t.Errorf("关闭后写入返回 %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("json 记录 %d 行, want 2", len(lines))
+	}
+	var got AccessRecord
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != *rec {
+		t.Errorf("json 记录 = %+v, want %+v", got, *rec)
+	}
+}
@@ -0,0 +1,220 @@
+package socks5
+
+import (
+	"fmt"
+	"go-socket5/server"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket 令牌桶，容量为一秒的流量
+// 速率在每次取令牌时传入，运行期间修改限制对已有会话立即生效
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take 取出n个令牌，返回需要等待的时间，rate 为0时不限制
+// 令牌不足时允许透支，等待时间按透支量计算，长期平均速率不超过 rate
+func (b *tokenBucket) take(n int, rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(rate)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// bucketPair 上下行令牌桶
+type bucketPair struct {
+	up   tokenBucket
+	down tokenBucket
+}
+
+// take 按方向取令牌
+func (p *bucketPair) take(n int, up bool, limit server.BandwidthLimit) time.Duration {
+	if up {
+		return p.up.take(n, limit.Upload)
+	}
+	return p.down.take(n, limit.Download)
+}
+
+// userBuckets 一个用户所有会话共享的令牌桶，没有会话引用时删除
+type userBuckets struct {
+	bucketPair
+	refs int
+}
+
+// shaper 带宽整形，按全局、用户、连接三级令牌桶限速
+type shaper struct {
+	limits atomic.Pointer[server.BandwidthConfig]
+	global bucketPair
+
+	mu    sync.Mutex
+	users map[string]*userBuckets
+}
+
+// set 替换带宽限制
+func (sh *shaper) set(cfg server.BandwidthConfig) error {
+	if err := validateBandwidth(cfg); err != nil {
+		return err
+	}
+	users := make(map[string]server.BandwidthLimit, len(cfg.Users))
+	for name, limit := range cfg.Users {
+		users[name] = limit
+	}
+	cfg.Users = users
+	sh.limits.Store(&cfg)
+	return nil
+}
+
+// get 返回当前的带宽限制
+func (sh *shaper) get() server.BandwidthConfig {
+	cfg := sh.limits.Load()
+	if cfg == nil {
+		return server.BandwidthConfig{}
+	}
+	copied := *cfg
+	copied.Users = make(map[string]server.BandwidthLimit, len(cfg.Users))
+	for name, limit := range cfg.Users {
+		copied.Users[name] = limit
+	}
+	return copied
+}
+
+// validateBandwidth 检查带宽限制不能为负数
+func validateBandwidth(cfg server.BandwidthConfig) error {
+	check := func(name string, limit server.BandwidthLimit) error {
+		if limit.Upload < 0 || limit.Download < 0 {
+			return fmt.Errorf("%s 的带宽限制不能为负数", name)
+		}
+		return nil
+	}
+	if err := check("global", cfg.Global); err != nil {
+		return err
+	}
+	if err := check("per_user", cfg.PerUser); err != nil {
+		return err
+	}
+	if err := check("per_connection", cfg.PerConnection); err != nil {
+		return err
+	}
+	for name, limit := range cfg.Users {
+		if err := check("用户 "+name, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open 为会话创建整形器，user 为空（未认证）时不受用户级限制
+func (sh *shaper) open(user string, done <-chan struct{}) *sessionShaper {
+	ss := &sessionShaper{shaper: sh, user: user, done: done}
+	if user != "" {
+		sh.mu.Lock()
+		if sh.users == nil {
+			sh.users = make(map[string]*userBuckets)
+		}
+		ub := sh.users[user]
+		if ub == nil {
+			ub = &userBuckets{}
+			sh.users[user] = ub
+		}
+		ub.refs++
+		ss.userBuckets = ub
+		sh.mu.Unlock()
+	}
+	return ss
+}
+
+// sessionShaper 单个会话的带宽整形
+type sessionShaper struct {
+	shaper      *shaper
+	user        string
+	userBuckets *userBuckets // 未认证会话为nil
+	conn        bucketPair
+	done        <-chan struct{} // 会话终止时关闭，结束等待
+}
+
+// close 会话结束时释放用户令牌桶的引用
+func (ss *sessionShaper) close() {
+	if ss.userBuckets == nil {
+		return
+	}
+	sh := ss.shaper
+	sh.mu.Lock()
+	ss.userBuckets.refs--
+	if ss.userBuckets.refs == 0 {
+		delete(sh.users, ss.user)
+	}
+	sh.mu.Unlock()
+}
+
+// limits 返回当前生效的全局、用户和连接限制
+func (ss *sessionShaper) limits() (global, user, conn server.BandwidthLimit) {
+	cfg := ss.shaper.limits.Load()
+	if cfg == nil {
+		return
+	}
+	global, conn = cfg.Global, cfg.PerConnection
+	if ss.userBuckets != nil {
+		user = cfg.PerUser
+		if limit, ok := cfg.Users[ss.user]; ok {
+			user = limit
+		}
+	}
+	return
+}
+
+// limited 当前是否有任何一级限制作用于本会话
+func (ss *sessionShaper) limited() bool {
+	global, user, conn := ss.limits()
+	var none server.BandwidthLimit
+	return global != none || user != none || conn != none
+}
+
+// wait 转发n字节前等待令牌，up 为客户端发往目标方向
+// 会话被终止时提前返回false
+func (ss *sessionShaper) wait(n int, up bool) bool {
+	global, user, conn := ss.limits()
+	delay := ss.shaper.global.take(n, up, global)
+	if ss.userBuckets != nil {
+		if d := ss.userBuckets.take(n, up, user); d > delay {
+			delay = d
+		}
+	}
+	if d := ss.conn.take(n, up, conn); d > delay {
+		delay = d
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ss.done:
+		return false
+	}
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	var b tokenBucket
+	if d := b.take(1<<20, 0); d != 0 {
+		t.Fatalf("不限制时等待 %v", d)
+	}
+	// 初始容量为一秒的流量
+	if d := b.take(1000, 1000); d != 0 {
+		t.Fatalf("容量内等待 %v", d)
+	}
+	// 透支 500 个令牌需要等待约 0.5 秒
+	if d := b.take(500, 1000); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("透支后等待 %v, want ~500ms", d)
+	}
+}
+
+func TestValidateBandwidth(t *testing.T) {
+	tests := []struct {
+		cfg     server.BandwidthConfig
+		wantErr bool
+	}{
+		{server.BandwidthConfig{}, false},
+		{server.BandwidthConfig{Global: server.BandwidthLimit{Upload: 1024, Download: 2048}}, false},
+		{server.BandwidthConfig{Global: server.BandwidthLimit{Upload: -1}}, true},
+		{server.BandwidthConfig{PerUser: server.BandwidthLimit{Download: -1}}, true},
+		{server.BandwidthConfig{PerConnection: server.BandwidthLimit{Upload: -1}}, true},
+		{server.BandwidthConfig{Users: map[string]server.BandwidthLimit{"alice": {Download: -1}}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateBandwidth(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("validateBandwidth(%+v) = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSessionShaperLimits(t *testing.T) {
+	sh := &shaper{}
+	if err := sh.set(server.BandwidthConfig{
+		Global:        server.BandwidthLimit{Upload: 1000},
+		PerUser:       server.BandwidthLimit{Download: 2000},
+		PerConnection: server.BandwidthLimit{Upload: 3000},
+		Users:         map[string]server.BandwidthLimit{"vip": {Download: 9000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user string
+		want server.BandwidthLimit
+	}{
+		{"", server.BandwidthLimit{}},
+		{"alice", server.BandwidthLimit{Download: 2000}},
+		{"vip", server.BandwidthLimit{Download: 9000}},
+	}
+	for _, tt := range tests {
+		ss := sh.open(tt.user, nil)
+		global, user, conn := ss.limits()
+		if global.Upload != 1000 || conn.Upload != 3000 || user != tt.want {
+			t.Errorf("user %q: limits = %+v, %+v, %+v", tt.user, global, user, conn)
+		}
+		if !ss.limited() {
+			t.Errorf("user %q: limited = false", tt.user)
+		}
+		ss.close()
+	}
+
+	// 用户的令牌桶由所有会话共享，最后一个会话结束后删除
+	a, b := sh.open("alice", nil), sh.open("alice", nil)
+	if a.userBuckets != b.userBuckets {
+		t.Error("同一用户的会话没有共享令牌桶")
+	}
+	a.close()
+	if len(sh.users) != 1 {
+		t.Errorf("users = %d, want 1", len(sh.users))
+	}
+	b.close()
+	if len(sh.users) != 0 {
+		t.Errorf("users = %d, want 0", len(sh.users))
+	}
+
+	if (&shaper{}).open("alice", nil).limited() {
+		t.Error("没有配置时不应限速")
+	}
+}
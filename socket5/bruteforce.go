@@ -0,0 +1,445 @@
+package socks5
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"go-socket5/server"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 暴力破解防护的默认参数
+const (
+	defaultFailureWindow = 10 * time.Minute
+	defaultBanTime       = 15 * time.Minute
+	defaultMaxBanTime    = 24 * time.Hour
+	defaultAuthBackoff   = 500 * time.Millisecond
+	defaultMaxBackoff    = 8 * time.Second
+)
+
+// authGuardSweepInterval 清理过期失败记录的间隔
+const authGuardSweepInterval = time.Minute
+
+// maxAuthRecords 每类失败记录的上限，达到上限时淘汰最久没有失败的未封禁记录
+// 随机用户名和来源产生的记录不会无限增长
+const maxAuthRecords = 10000
+
+// evictScanLimit 淘汰时从最久没有失败的一端检查的记录数，淘汰的开销与记录总数无关
+const evictScanLimit = 32
+
+// 封禁记录的类型
+const (
+	banTypeIP   = "ip"
+	banTypeUser = "user"
+)
+
+// authRecord 一个来源IP、用户名或 (用户名, 来源IP) 的认证失败记录
+type authRecord struct {
+	failures    int       // 当前窗口内的失败次数
+	windowStart time.Time // 当前窗口的开始时间
+	bans        int       // 累计封禁次数，用于延长再次封禁的时长
+	bannedUntil time.Time
+	lastFailure time.Time
+}
+
+// userSource 用户名和来源IP
+type userSource struct {
+	user string
+	ip   string
+}
+
+// authRecords 一类失败记录，按最近一次失败的时间排列，调用方需持有 authGuard 的锁
+type authRecords[K comparable] struct {
+	index map[K]*list.Element
+	order list.List // 元素为 *authEntry[K]，最近失败的在前
+}
+
+// authEntry 失败记录及其键
+type authEntry[K comparable] struct {
+	key    K
+	record *authRecord
+}
+
+// newAuthRecords 创建空的失败记录表
+func newAuthRecords[K comparable]() *authRecords[K] {
+	return &authRecords[K]{index: make(map[K]*list.Element)}
+}
+
+// len 返回记录数
+func (t *authRecords[K]) len() int {
+	return len(t.index)
+}
+
+// get 返回 key 的记录，不存在时返回nil
+func (t *authRecords[K]) get(key K) *authRecord {
+	if e := t.index[key]; e != nil {
+		return e.Value.(*authEntry[K]).record
+	}
+	return nil
+}
+
+// touch 返回 key 的记录并移到最近失败的一端，不存在时创建
+// 记录数达到 maxAuthRecords 时先淘汰一条记录：在最久没有失败的 evictScanLimit 条中优先淘汰未封禁的，都封禁时淘汰最早到期的
+func (t *authRecords[K]) touch(key K, now time.Time) *authRecord {
+	if e := t.index[key]; e != nil {
+		t.order.MoveToFront(e)
+		return e.Value.(*authEntry[K]).record
+	}
+	if t.len() >= maxAuthRecords {
+		victim := t.order.Back()
+		for e, i := victim, 0; e != nil && i < evictScanLimit; e, i = e.Prev(), i+1 {
+			if evictBefore(e.Value.(*authEntry[K]).record, victim.Value.(*authEntry[K]).record, now) {
+				victim = e
+			}
+		}
+		t.remove(victim.Value.(*authEntry[K]).key)
+	}
+	r := &authRecord{}
+	t.index[key] = t.order.PushFront(&authEntry[K]{key: key, record: r})
+	return r
+}
+
+// remove 删除 key 的记录
+func (t *authRecords[K]) remove(key K) {
+	if e := t.index[key]; e != nil {
+		t.order.Remove(e)
+		delete(t.index, key)
+	}
+}
+
+// each 按最近失败的顺序遍历记录，fn 中可以删除当前记录
+func (t *authRecords[K]) each(fn func(key K, r *authRecord)) {
+	for e := t.order.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*authEntry[K])
+		fn(entry.key, entry.record)
+		e = next
+	}
+}
+
+// authGuard 用户名密码认证的暴力破解防护
+// 用户名的失败次数按 (用户名, 来源IP) 统计和封禁，其他来源的认证不受影响，
+// 攻击者无法通过猜测密码锁定他人的账号；分散在多个来源上的猜测按用户名累计的失败次数延迟应答
+type authGuard struct {
+	mu        sync.Mutex
+	cfg       server.BruteForceConfig
+	allowlist []*net.IPNet
+	ips       *authRecords[string]     // 按来源IP统计并封禁
+	users     *authRecords[userSource] // 按 (用户名, 来源IP) 统计并封禁
+	names     *authRecords[string]     // 按用户名统计，只用于计算延迟应答，不封禁
+	log       *slog.Logger
+}
+
+// setLogger 设置日志记录器
+func (g *authGuard) setLogger(logger *slog.Logger) {
+	g.mu.Lock()
+	g.log = logger
+	g.mu.Unlock()
+}
+
+// logger 返回日志记录器，调用方需持有锁
+func (g *authGuard) logger() *slog.Logger {
+	if g.log == nil {
+		return slog.Default()
+	}
+	return g.log
+}
+
+// parseAllowlist 解析白名单，单个IP按 /32 或 /128 处理
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+	for _, entry := range entries {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			list = append(list, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的白名单项: %q", entry)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return list, nil
+}
+
+// validateBruteForce 检查防护配置
+func validateBruteForce(cfg server.BruteForceConfig) error {
+	if cfg.MaxFailures < 0 || cfg.Window < 0 || cfg.BanTime < 0 || cfg.MaxBanTime < 0 ||
+		cfg.Backoff < 0 || cfg.MaxBackoff < 0 {
+		return fmt.Errorf("暴力破解防护参数不能为负数")
+	}
+	_, err := parseAllowlist(cfg.Allowlist)
+	return err
+}
+
+// set 替换防护配置，未设置的参数使用默认值，已有的失败和封禁记录保留
+func (g *authGuard) set(cfg server.BruteForceConfig) error {
+	if err := validateBruteForce(cfg); err != nil {
+		return err
+	}
+	allowlist, err := parseAllowlist(cfg.Allowlist)
+	if err != nil {
+		return err
+	}
+	if cfg.Window == 0 {
+		cfg.Window = defaultFailureWindow
+	}
+	if cfg.BanTime == 0 {
+		cfg.BanTime = defaultBanTime
+	}
+	if cfg.MaxBanTime == 0 {
+		cfg.MaxBanTime = defaultMaxBanTime
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = defaultAuthBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	cfg.Allowlist = append([]string(nil), cfg.Allowlist...)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cfg = cfg
+	g.allowlist = allowlist
+	if g.ips == nil {
+		g.ips = newAuthRecords[string]()
+		g.users = newAuthRecords[userSource]()
+		g.names = newAuthRecords[string]()
+	}
+	return nil
+}
+
+// get 返回当前的防护配置（已填充默认值）
+func (g *authGuard) get() server.BruteForceConfig {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cfg := g.cfg
+	cfg.Allowlist = append([]string(nil), g.cfg.Allowlist...)
+	return cfg
+}
+
+// exempt 防护未启用或来源在白名单中，调用方需持有锁
+func (g *authGuard) exempt(ip net.IP) bool {
+	if g.cfg.MaxFailures <= 0 {
+		return true
+	}
+	for _, ipNet := range g.allowlist {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// bannedIP 来源IP是否被封禁，返回剩余的封禁时间
+func (g *authGuard) bannedIP(ip net.IP) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.exempt(ip) {
+		return 0, false
+	}
+	return remainingBan(g.ips.get(ip.String()), time.Now())
+}
+
+// bannedUser 用户名是否对来源IP封禁，白名单中的来源不受用户名封禁影响
+func (g *authGuard) bannedUser(ip net.IP, user string) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.exempt(ip) {
+		return 0, false
+	}
+	return remainingBan(g.users.get(userSource{user, ip.String()}), time.Now())
+}
+
+// remainingBan 返回记录剩余的封禁时间
+func remainingBan(r *authRecord, now time.Time) (time.Duration, bool) {
+	if r == nil || !now.Before(r.bannedUntil) {
+		return 0, false
+	}
+	return r.bannedUntil.Sub(now), true
+}
+
+// failure 记录一次认证失败，达到阈值时封禁，返回应答前需要等待的时间
+func (g *authGuard) failure(ip net.IP, user string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.exempt(ip) {
+		return 0
+	}
+	now := time.Now()
+	source := userSource{user, ip.String()}
+	n := g.record(g.ips.touch(source.ip, now), now, "封禁IP", banTypeIP, source.ip)
+	if userFailures := g.record(g.users.touch(source, now), now, "封禁用户", banTypeUser, user, "ip", source.ip); userFailures > n {
+		n = userFailures
+	}
+
+	// 按较多的一方计算退避，分散在多个IP上的猜测同样会被减慢
+	if nameFailures := countFailure(g.names.touch(user, now), g.cfg.Window, now); nameFailures > n {
+		n = nameFailures
+	}
+	delay := g.cfg.Backoff
+	for i := 1; i < n && delay < g.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > g.cfg.MaxBackoff {
+		delay = g.cfg.MaxBackoff
+	}
+	return delay
+}
+
+// evictBefore a 是否应当先于 b 被淘汰：未封禁的先于封禁中的，同类中最久没有失败或最早到期的在先
+func evictBefore(a, b *authRecord, now time.Time) bool {
+	aBanned, bBanned := now.Before(a.bannedUntil), now.Before(b.bannedUntil)
+	if aBanned != bBanned {
+		return !aBanned
+	}
+	if aBanned {
+		return a.bannedUntil.Before(b.bannedUntil)
+	}
+	return a.lastFailure.Before(b.lastFailure)
+}
+
+// countFailure 累加一次失败，返回当前窗口内的失败次数
+func countFailure(r *authRecord, window time.Duration, now time.Time) int {
+	if now.Sub(r.windowStart) > window {
+		r.failures = 0
+		r.windowStart = now
+	}
+	r.failures++
+	r.lastFailure = now
+	return r.failures
+}
+
+// record 累加一次失败，达到阈值时封禁并记录审计日志，返回当前窗口内的失败次数，调用方需持有锁
+// attrs 为审计日志的属性
+func (g *authGuard) record(r *authRecord, now time.Time, msg string, attrs ...any) int {
+	failures := countFailure(r, g.cfg.Window, now)
+	if failures >= g.cfg.MaxFailures && !now.Before(r.bannedUntil) {
+		d := g.cfg.BanTime
+		for i := 0; i < r.bans && d < g.cfg.MaxBanTime; i++ {
+			d *= 2
+		}
+		if d > g.cfg.MaxBanTime {
+			d = g.cfg.MaxBanTime
+		}
+		r.bans++
+		r.bannedUntil = now.Add(d)
+		r.failures = 0
+		r.windowStart = now
+		attrs = append(attrs, "duration", d, "window", g.cfg.Window, "failures", failures, "bans", r.bans)
+		auditLog(g.logger(), msg, attrs...)
+	}
+	return failures
+}
+
+// success 认证成功后清除该用户在该来源上当前窗口的失败次数，累计封禁次数保留
+// 来源IP和用户名的失败次数不清除，攻击者无法用自己的有效账号重置其来源上猜测其他用户的失败次数
+func (g *authGuard) success(ip net.IP, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r := g.users.get(userSource{user, ip.String()}); r != nil {
+		r.failures = 0
+	}
+}
+
+// list 返回生效中的封禁，按到期时间排序
+func (g *authGuard) list() []server.BanInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	bans := make([]server.BanInfo, 0)
+	g.ips.each(func(ip string, r *authRecord) {
+		if now.Before(r.bannedUntil) {
+			bans = append(bans, server.BanInfo{Type: banTypeIP, Value: ip, Until: r.bannedUntil, Failures: r.failures, Bans: r.bans})
+		}
+	})
+	g.users.each(func(source userSource, r *authRecord) {
+		if now.Before(r.bannedUntil) {
+			bans = append(bans, server.BanInfo{
+				Type: banTypeUser, Value: source.user, IP: source.ip, Until: r.bannedUntil, Failures: r.failures, Bans: r.bans,
+			})
+		}
+	})
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// unban 解除封禁并清除记录，ip 和 user 都为空时解除全部，返回解除的封禁数
+// 只指定 ip 时同时解除该来源的用户名封禁，只指定 user 时解除该用户名在所有来源上的封禁
+func (g *authGuard) unban(ip, user string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	count := 0
+	if user == "" {
+		g.ips.each(func(key string, r *authRecord) {
+			if ip != "" && key != ip {
+				return
+			}
+			if now.Before(r.bannedUntil) {
+				count++
+				auditLog(g.logger(), "解除封禁IP", banTypeIP, key)
+			}
+			g.ips.remove(key)
+		})
+	}
+	g.users.each(func(source userSource, r *authRecord) {
+		if (ip != "" && source.ip != ip) || (user != "" && source.user != user) {
+			return
+		}
+		if now.Before(r.bannedUntil) {
+			count++
+			auditLog(g.logger(), "解除封禁用户", banTypeUser, source.user, "ip", source.ip)
+		}
+		g.users.remove(source)
+	})
+	if ip == "" {
+		g.names.each(func(name string, _ *authRecord) {
+			if user == "" || name == user {
+				g.names.remove(name)
+			}
+		})
+	}
+	return count
+}
+
+// run 定期清理过期的记录，ctx 结束时返回
+// 封禁到期后记录再保留 MaxBanTime，期间再次被封禁时封禁时长继续翻倍
+func (g *authGuard) run(ctx context.Context) {
+	ticker := time.NewTicker(authGuardSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			g.mu.Lock()
+			sweepRecords(g.ips, now, g.cfg)
+			sweepRecords(g.users, now, g.cfg)
+			sweepRecords(g.names, now, g.cfg)
+			g.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweepRecords 删除超过 Window 和 MaxBanTime 都没有失败或封禁的记录，调用方需持有锁
+func sweepRecords[K comparable](records *authRecords[K], now time.Time, cfg server.BruteForceConfig) {
+	records.each(func(key K, r *authRecord) {
+		last := r.lastFailure
+		if r.bannedUntil.After(last) {
+			last = r.bannedUntil
+		}
+		if now.Sub(last) > cfg.Window && now.Sub(last) > cfg.MaxBanTime {
+			records.remove(key)
+		}
+	})
+}
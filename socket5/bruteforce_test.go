@@ -0,0 +1,153 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func newTestAuthGuard(t *testing.T) *authGuard {
+	t.Helper()
+	g := &authGuard{}
+	if err := g.set(server.BruteForceConfig{MaxFailures: 3, Backoff: time.Millisecond, MaxBackoff: 8 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestAuthGuardUserBanIsPerSource(t *testing.T) {
+	g := newTestAuthGuard(t)
+	attacker, owner := net.ParseIP("198.51.100.1"), net.ParseIP("203.0.113.7")
+
+	// 攻击者的失败只封禁攻击者自己
+	for i := 0; i < 3; i++ {
+		g.failure(attacker, "alice")
+	}
+	if _, banned := g.bannedUser(attacker, "alice"); !banned {
+		t.Error("攻击者的来源未被封禁")
+	}
+	if _, banned := g.bannedUser(owner, "alice"); banned {
+		t.Error("其他来源的同名用户被封禁")
+	}
+	if _, banned := g.bannedIP(owner); banned {
+		t.Error("其他来源的IP被封禁")
+	}
+
+	// 分散在多个来源上的猜测按用户名累计失败次数延迟应答
+	var delay time.Duration
+	for i := 0; i < 5; i++ {
+		delay = g.failure(net.IPv4(192, 0, 2, byte(i+1)), "bob")
+	}
+	if delay != 8*time.Millisecond {
+		t.Errorf("delay = %v, want %v", delay, 8*time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		if _, banned := g.bannedUser(net.IPv4(192, 0, 2, byte(i+1)), "bob"); banned {
+			t.Errorf("来源 %d 被封禁", i+1)
+		}
+	}
+
+	bans := g.list()
+	if len(bans) != 2 {
+		t.Fatalf("bans = %+v", bans)
+	}
+	if n := g.unban("", "alice"); n != 1 {
+		t.Errorf("unban(user) = %d, want 1", n)
+	}
+	if _, banned := g.bannedUser(attacker, "alice"); banned {
+		t.Error("解除封禁后仍被封禁")
+	}
+}
+
+func TestAuthGuardRecordLimit(t *testing.T) {
+	g := newTestAuthGuard(t)
+	ip := net.ParseIP("198.51.100.1")
+	for i := 0; i < maxAuthRecords+100; i++ {
+		g.failure(ip, fmt.Sprintf("user%d", i))
+	}
+	if g.users.len() > maxAuthRecords || g.names.len() > maxAuthRecords {
+		t.Errorf("记录数超过上限: users=%d names=%d", g.users.len(), g.names.len())
+	}
+	// 最近的记录保留
+	if g.names.get(fmt.Sprintf("user%d", maxAuthRecords+99)) == nil {
+		t.Error("最近的记录被淘汰")
+	}
+}
+
+func TestAuthRecordsEviction(t *testing.T) {
+	now := time.Now()
+	records := newAuthRecords[int]()
+	records.touch(0, now).bannedUntil = now.Add(time.Hour)
+	for i := 1; i < maxAuthRecords; i++ {
+		records.touch(i, now).lastFailure = now
+	}
+	// 最久没有失败的记录封禁中时淘汰其后未封禁的记录
+	records.touch(maxAuthRecords, now)
+	if records.len() != maxAuthRecords {
+		t.Errorf("len = %d, want %d", records.len(), maxAuthRecords)
+	}
+	if records.get(0) == nil {
+		t.Error("封禁中的记录被淘汰")
+	}
+	if records.get(1) != nil {
+		t.Error("未封禁的记录没有被淘汰")
+	}
+	// 再次失败的记录移到最近一端
+	records.touch(2, now)
+	records.touch(maxAuthRecords+1, now)
+	if records.get(2) == nil || records.get(3) != nil {
+		t.Error("没有按最近失败的顺序淘汰")
+	}
+}
+
+func TestAuthGuardSuccessKeepsIPFailures(t *testing.T) {
+	g := newTestAuthGuard(t)
+	ip := net.ParseIP("198.51.100.1")
+
+	// 用自己的有效账号登录不能清除猜测其他用户累计的IP失败次数
+	g.failure(ip, "alice")
+	g.failure(ip, "bob")
+	g.success(ip, "mallory")
+	g.failure(ip, "carol")
+	if _, banned := g.bannedIP(ip); !banned {
+		t.Error("认证成功后来源IP的失败次数被清除")
+	}
+
+	// 认证成功只清除该用户在该来源上的失败次数
+	g.failure(ip, "dave")
+	g.failure(ip, "dave")
+	g.success(ip, "dave")
+	if r := g.users.get(userSource{"dave", ip.String()}); r == nil || r.failures != 0 {
+		t.Errorf("dave 的失败记录 = %+v", r)
+	}
+	if r := g.names.get("dave"); r == nil || r.failures != 2 {
+		t.Errorf("用户名 dave 的失败记录 = %+v", r)
+	}
+}
+
+func TestEvictBefore(t *testing.T) {
+	now := time.Now()
+	old := &authRecord{lastFailure: now.Add(-time.Hour)}
+	recent := &authRecord{lastFailure: now}
+	banned := &authRecord{lastFailure: now.Add(-2 * time.Hour), bannedUntil: now.Add(time.Hour)}
+	bannedLonger := &authRecord{bannedUntil: now.Add(2 * time.Hour)}
+	tests := []struct {
+		name string
+		a, b *authRecord
+		want bool
+	}{
+		{"较旧的先淘汰", old, recent, true},
+		{"较新的后淘汰", recent, old, false},
+		{"未封禁的先于封禁中的", recent, banned, true},
+		{"封禁中的后于未封禁的", banned, old, false},
+		{"先到期的封禁先淘汰", banned, bannedLonger, true},
+	}
+	for _, tt := range tests {
+		if got := evictBefore(tt.a, tt.b, now); got != tt.want {
+			t.Errorf("%s: evictBefore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
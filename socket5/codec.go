@@ -0,0 +1,408 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// 用户名密码认证子协议常量（RFC 1929）
+const (
+	// UserPassVersion 用户名密码认证子协议版本
+	UserPassVersion = 0x01
+	// UserPassSuccess 认证成功
+	UserPassSuccess = 0x00
+	// UserPassFailure 认证失败
+	UserPassFailure = 0x01
+
+	// NoAcceptableMethods 没有可接受的认证方法
+	NoAcceptableMethods = 0xFF
+)
+
+var (
+	// ErrVersionMismatch 协议版本不匹配
+	ErrVersionMismatch = errors.New("协议版本不匹配")
+	// ErrAddrTypeNotSupported 不支持的地址类型
+	ErrAddrTypeNotSupported = errors.New("不支持的地址类型")
+	// ErrFieldTooLong 字段超过255字节
+	ErrFieldTooLong = errors.New("字段长度超过255字节")
+	// ErrFragmentNotSupported 不支持UDP分片
+	ErrFragmentNotSupported = errors.New("不支持UDP分片")
+)
+
+// Addr SOCKS5地址，对应报文中的 ATYP + ADDR + PORT
+type Addr struct {
+	Type byte   // 地址类型 IPv4/Domain/IPv6
+	IP   net.IP // IPv4或IPv6地址
+	Name string // 域名
+	Port uint16 // 端口
+}
+
+// ParseAddr 将 host:port 格式的地址解析为SOCKS5地址
+func ParseAddr(address string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口: %s", portStr)
+	}
+	return NewAddr(host, uint16(port))
+}
+
+// NewAddr 根据主机和端口创建SOCKS5地址，主机可以是IP或域名
+func NewAddr(host string, port uint16) (*Addr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return addrFromIP(ip, port), nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("无效的域名长度: %d", len(host))
+	}
+	return &Addr{Type: Domain, Name: host, Port: port}, nil
+}
+
+// AddrFromNetAddr 将net.Addr转换为SOCKS5地址，不支持的类型返回 0.0.0.0:0
+func AddrFromNetAddr(addr net.Addr) *Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return addrFromIP(a.IP, uint16(a.Port))
+	case *net.UDPAddr:
+		return addrFromIP(a.IP, uint16(a.Port))
+	}
+	return addrFromIP(net.IPv4zero, 0)
+}
+
+// addrFromIP 根据IP版本选择地址类型
+func addrFromIP(ip net.IP, port uint16) *Addr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &Addr{Type: IPv4, IP: ip4, Port: port}
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return &Addr{Type: IPv6, IP: ip16, Port: port}
+	}
+	return &Addr{Type: IPv4, IP: net.IPv4zero.To4(), Port: port}
+}
+
+// Host 返回地址中的主机部分
+func (a *Addr) Host() string {
+	if a.Type == Domain {
+		return a.Name
+	}
+	return a.IP.String()
+}
+
+// String 返回 host:port 格式的地址，IPv6地址带方括号
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+// MarshalBinary 编码为 ATYP + ADDR + PORT
+func (a *Addr) MarshalBinary() ([]byte, error) {
+	var data []byte
+	switch a.Type {
+	case IPv4:
+		ip := a.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("无效的IPv4地址: %v", a.IP)
+		}
+		data = append([]byte{IPv4}, ip...)
+	case IPv6:
+		ip := a.IP.To16()
+		if ip == nil {
+			return nil, fmt.Errorf("无效的IPv6地址: %v", a.IP)
+		}
+		data = append([]byte{IPv6}, ip...)
+	case Domain:
+		if len(a.Name) == 0 || len(a.Name) > 255 {
+			return nil, fmt.Errorf("无效的域名长度: %d", len(a.Name))
+		}
+		data = append([]byte{Domain, byte(len(a.Name))}, a.Name...)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrAddrTypeNotSupported, a.Type)
+	}
+	return binary.BigEndian.AppendUint16(data, a.Port), nil
+}
+
+// ReadFrom 从数据流中读取 ATYP + ADDR + PORT
+func (a *Addr) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	atyp := make([]byte, 1)
+	if err := readFull(r, atyp, &n); err != nil {
+		return n, err
+	}
+	a.Type = atyp[0]
+
+	switch a.Type {
+	case IPv4, IPv6:
+		size := net.IPv4len
+		if a.Type == IPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if err := readFull(r, ip, &n); err != nil {
+			return n, err
+		}
+		a.IP, a.Name = ip, ""
+	case Domain:
+		length := make([]byte, 1)
+		if err := readFull(r, length, &n); err != nil {
+			return n, err
+		}
+		name := make([]byte, int(length[0]))
+		if err := readFull(r, name, &n); err != nil {
+			return n, err
+		}
+		a.IP, a.Name = nil, string(name)
+	default:
+		return n, fmt.Errorf("%w: %d", ErrAddrTypeNotSupported, a.Type)
+	}
+
+	port := make([]byte, 2)
+	if err := readFull(r, port, &n); err != nil {
+		return n, err
+	}
+	a.Port = binary.BigEndian.Uint16(port)
+	return n, nil
+}
+
+// Greeting 客户端认证方法协商报文 VER + NMETHODS + METHODS
+type Greeting struct {
+	Methods []byte // 客户端支持的认证方法
+}
+
+// MarshalBinary 编码认证方法协商报文
+func (g *Greeting) MarshalBinary() ([]byte, error) {
+	if len(g.Methods) == 0 || len(g.Methods) > 255 {
+		return nil, fmt.Errorf("无效的认证方法数量: %d", len(g.Methods))
+	}
+	data := []byte{Version, byte(len(g.Methods))}
+	return append(data, g.Methods...), nil
+}
+
+// ReadFrom 读取认证方法协商报文
+func (g *Greeting) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	header := make([]byte, 2)
+	if err := readFull(r, header, &n); err != nil {
+		return n, err
+	}
+	if header[0] != Version {
+		return n, fmt.Errorf("%w: 期望 %d, 实际 %d", ErrVersionMismatch, Version, header[0])
+	}
+	if header[1] == 0 {
+		return n, errors.New("认证方法数量为0")
+	}
+	g.Methods = make([]byte, int(header[1]))
+	err := readFull(r, g.Methods, &n)
+	return n, err
+}
+
+// MethodSelection 服务端认证方法选择报文 VER + METHOD
+type MethodSelection struct {
+	Method byte // 选择的认证方法，NoAcceptableMethods 表示没有可接受的方法
+}
+
+// MarshalBinary 编码认证方法选择报文
+func (m *MethodSelection) MarshalBinary() ([]byte, error) {
+	return []byte{Version, m.Method}, nil
+}
+
+// ReadFrom 读取认证方法选择报文
+func (m *MethodSelection) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	data := make([]byte, 2)
+	if err := readFull(r, data, &n); err != nil {
+		return n, err
+	}
+	if data[0] != Version {
+		return n, fmt.Errorf("%w: 期望 %d, 实际 %d", ErrVersionMismatch, Version, data[0])
+	}
+	m.Method = data[1]
+	return n, nil
+}
+
+// UserPassRequest 用户名密码认证请求 VER + ULEN + UNAME + PLEN + PASSWD
+type UserPassRequest struct {
+	Username string // 用户名
+	Password string // 密码
+}
+
+// MarshalBinary 编码用户名密码认证请求
+func (u *UserPassRequest) MarshalBinary() ([]byte, error) {
+	if len(u.Username) == 0 || len(u.Username) > 255 || len(u.Password) > 255 {
+		return nil, ErrFieldTooLong
+	}
+	data := []byte{UserPassVersion, byte(len(u.Username))}
+	data = append(data, u.Username...)
+	data = append(data, byte(len(u.Password)))
+	return append(data, u.Password...), nil
+}
+
+// ReadFrom 读取用户名密码认证请求
+func (u *UserPassRequest) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	header := make([]byte, 2)
+	if err := readFull(r, header, &n); err != nil {
+		return n, err
+	}
+	if header[0] != UserPassVersion {
+		return n, fmt.Errorf("%w: 认证子协议期望 %d, 实际 %d", ErrVersionMismatch, UserPassVersion, header[0])
+	}
+
+	// UNAME + PLEN
+	buffer := make([]byte, int(header[1])+1)
+	if err := readFull(r, buffer, &n); err != nil {
+		return n, err
+	}
+	password := make([]byte, int(buffer[len(buffer)-1]))
+	if err := readFull(r, password, &n); err != nil {
+		return n, err
+	}
+	u.Username = string(buffer[:len(buffer)-1])
+	u.Password = string(password)
+	return n, nil
+}
+
+// UserPassReply 用户名密码认证结果 VER + STATUS
+type UserPassReply struct {
+	Status byte // UserPassSuccess 或 UserPassFailure
+}
+
+// MarshalBinary 编码用户名密码认证结果
+func (u *UserPassReply) MarshalBinary() ([]byte, error) {
+	return []byte{UserPassVersion, u.Status}, nil
+}
+
+// ReadFrom 读取用户名密码认证结果
+func (u *UserPassReply) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	data := make([]byte, 2)
+	if err := readFull(r, data, &n); err != nil {
+		return n, err
+	}
+	if data[0] != UserPassVersion {
+		return n, fmt.Errorf("%w: 认证子协议期望 %d, 实际 %d", ErrVersionMismatch, UserPassVersion, data[0])
+	}
+	u.Status = data[1]
+	return n, nil
+}
+
+// Request 客户端请求 VER + CMD + RSV + ATYP + DST.ADDR + DST.PORT
+type Request struct {
+	Command byte // Connect/Bind/UDP
+	Addr    Addr // 目标地址
+}
+
+// MarshalBinary 编码客户端请求
+func (q *Request) MarshalBinary() ([]byte, error) {
+	addr, err := q.Addr.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{Version, q.Command, Zero}, addr...), nil
+}
+
+// ReadFrom 读取客户端请求，地址类型不支持时返回 ErrAddrTypeNotSupported
+func (q *Request) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	header := make([]byte, 3)
+	if err := readFull(r, header, &n); err != nil {
+		return n, err
+	}
+	if header[0] != Version {
+		return n, fmt.Errorf("%w: 期望 %d, 实际 %d", ErrVersionMismatch, Version, header[0])
+	}
+	q.Command = header[1]
+	m, err := q.Addr.ReadFrom(r)
+	return n + m, err
+}
+
+// Reply 服务端应答 VER + REP + RSV + ATYP + BND.ADDR + BND.PORT
+type Reply struct {
+	Code byte // 应答码
+	Addr Addr // 绑定地址，未设置时编码为 0.0.0.0:0
+}
+
+// MarshalBinary 编码服务端应答
+func (p *Reply) MarshalBinary() ([]byte, error) {
+	bind := p.Addr
+	if bind.Type == 0 {
+		bind = *addrFromIP(net.IPv4zero, 0)
+	}
+	addr, err := bind.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{Version, p.Code, Zero}, addr...), nil
+}
+
+// ReadFrom 读取服务端应答
+func (p *Reply) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	header := make([]byte, 3)
+	if err := readFull(r, header, &n); err != nil {
+		return n, err
+	}
+	if header[0] != Version {
+		return n, fmt.Errorf("%w: 期望 %d, 实际 %d", ErrVersionMismatch, Version, header[0])
+	}
+	p.Code = header[1]
+	m, err := p.Addr.ReadFrom(r)
+	return n + m, err
+}
+
+// UDPHeader UDP数据报头 RSV + FRAG + ATYP + DST.ADDR + DST.PORT
+type UDPHeader struct {
+	Frag byte // 分片序号，0表示独立数据报
+	Addr Addr // 目标地址（客户端发出）或来源地址（服务端回送）
+}
+
+// MarshalBinary 编码UDP数据报头
+func (h *UDPHeader) MarshalBinary() ([]byte, error) {
+	addr, err := h.Addr.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{Zero, Zero, h.Frag}, addr...), nil
+}
+
+// ReadFrom 读取UDP数据报头
+func (h *UDPHeader) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	header := make([]byte, 3)
+	if err := readFull(r, header, &n); err != nil {
+		return n, err
+	}
+	h.Frag = header[2]
+	m, err := h.Addr.ReadFrom(r)
+	return n + m, err
+}
+
+// ParseUDPDatagram 解析SOCKS5 UDP数据报，返回报头和数据部分
+// 分片的数据报返回 ErrFragmentNotSupported
+func ParseUDPDatagram(datagram []byte) (*UDPHeader, []byte, error) {
+	header := &UDPHeader{}
+	n, err := header.ReadFrom(bytes.NewReader(datagram))
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, errors.New("UDP数据报长度不足")
+		}
+		return nil, nil, err
+	}
+	if header.Frag != 0 {
+		return header, nil, fmt.Errorf("%w: %d", ErrFragmentNotSupported, header.Frag)
+	}
+	return header, datagram[n:], nil
+}
+
+// readFull 读满buf并累加已读字节数
+func readFull(r io.Reader, buf []byte, n *int64) error {
+	m, err := io.ReadFull(r, buf)
+	*n += int64(m)
+	return err
+}
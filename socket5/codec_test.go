@@ -0,0 +1,219 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// message 报文类型都实现的编解码接口
+type message interface {
+	encoding.BinaryMarshaler
+	io.ReaderFrom
+}
+
+func TestMessageEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		wire []byte
+		zero message // 用于解码的空报文
+	}{
+		{"greeting", &Greeting{Methods: []byte{NoAuthenticationRequired, AccountPasswordAuthentication}},
+			[]byte{5, 2, 0, 2}, &Greeting{}},
+		{"method selection", &MethodSelection{Method: AccountPasswordAuthentication},
+			[]byte{5, 2}, &MethodSelection{}},
+		{"user/pass request", &UserPassRequest{Username: "bob", Password: "pw"},
+			[]byte{1, 3, 'b', 'o', 'b', 2, 'p', 'w'}, &UserPassRequest{}},
+		{"user/pass empty password", &UserPassRequest{Username: "bob"},
+			[]byte{1, 3, 'b', 'o', 'b', 0}, &UserPassRequest{}},
+		{"user/pass reply", &UserPassReply{Status: UserPassFailure},
+			[]byte{1, 1}, &UserPassReply{}},
+		{"request ipv4", &Request{Command: Connect, Addr: Addr{Type: IPv4, IP: net.IPv4(192, 0, 2, 1).To4(), Port: 80}},
+			[]byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80}, &Request{}},
+		{"request domain", &Request{Command: UDP, Addr: Addr{Type: Domain, Name: "a.io", Port: 443}},
+			[]byte{5, 3, 0, 3, 4, 'a', '.', 'i', 'o', 1, 187}, &Request{}},
+		{"reply ipv6", &Reply{Code: ReplyHostUnreachable, Addr: Addr{Type: IPv6, IP: net.ParseIP("2001:db8::1"), Port: 1}},
+			append(append([]byte{5, 4, 0, 4}, net.ParseIP("2001:db8::1")...), 0, 1), &Reply{}},
+		{"udp header", &UDPHeader{Addr: Addr{Type: IPv4, IP: net.IPv4(10, 0, 0, 1).To4(), Port: 53}},
+			[]byte{0, 0, 0, 1, 10, 0, 0, 1, 0, 53}, &UDPHeader{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.wire) {
+				t.Fatalf("MarshalBinary = %v, want %v", data, tt.wire)
+			}
+			// 数据分多次到达时同样能完整读取
+			n, err := tt.zero.ReadFrom(io.MultiReader(bytes.NewReader(data[:1]), bytes.NewReader(data[1:])))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(data)) {
+				t.Errorf("ReadFrom 读取 %d 字节, want %d", n, len(data))
+			}
+			if !reflect.DeepEqual(tt.zero, tt.msg) {
+				t.Errorf("ReadFrom = %+v, want %+v", tt.zero, tt.msg)
+			}
+		})
+	}
+}
+
+func TestMessageDecodingErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		wire []byte
+		want error
+	}{
+		{"greeting version", &Greeting{}, []byte{4, 1, 0}, ErrVersionMismatch},
+		{"greeting truncated", &Greeting{}, []byte{5, 2, 0}, io.ErrUnexpectedEOF},
+		{"user/pass version", &UserPassRequest{}, []byte{5, 1, 'a', 0}, ErrVersionMismatch},
+		{"request version", &Request{}, []byte{4, 1, 0, 1, 1, 2, 3, 4, 0, 80}, ErrVersionMismatch},
+		{"request address type", &Request{}, []byte{5, 1, 0, 9}, ErrAddrTypeNotSupported},
+		{"request truncated", &Request{}, []byte{5, 1, 0, 1, 1, 2}, io.ErrUnexpectedEOF},
+		{"reply empty", &Reply{}, nil, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.ReadFrom(bytes.NewReader(tt.wire)); !errors.Is(err, tt.want) {
+				t.Errorf("ReadFrom err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    *Addr
+	}{
+		{"192.0.2.1:80", &Addr{Type: IPv4, IP: net.IPv4(192, 0, 2, 1).To4(), Port: 80}},
+		{"[2001:db8::1]:443", &Addr{Type: IPv6, IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		{"example.com:8080", &Addr{Type: Domain, Name: "example.com", Port: 8080}},
+		{"example.com", nil},
+		{"example.com:65536", nil},
+		{":80", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddr(tt.address)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseAddr(%q) = %+v, want error", tt.address, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAddr(%q) = %+v, %v, want %+v", tt.address, got, err, tt.want)
+		}
+		if err == nil && got.String() != tt.address {
+			t.Errorf("String() = %s, want %s", got, tt.address)
+		}
+	}
+}
+
+func TestParseUDPDatagram(t *testing.T) {
+	header, payload, err := ParseUDPDatagram([]byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Addr.String() != "127.0.0.1:53" || string(payload) != "hi" {
+		t.Errorf("ParseUDPDatagram = %s, %q", header.Addr.String(), payload)
+	}
+
+	if _, _, err := ParseUDPDatagram([]byte{0, 0, 1, 1, 127, 0, 0, 1, 0, 53}); !errors.Is(err, ErrFragmentNotSupported) {
+		t.Errorf("分片数据报 err = %v, want %v", err, ErrFragmentNotSupported)
+	}
+	if _, _, err := ParseUDPDatagram([]byte{0, 0, 0, 1, 127}); err == nil {
+		t.Error("长度不足的数据报没有返回错误")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, address := range []string{"192.168.1.10:1080", "[2001:db8::1]:443", "example.com:80"} {
+		addr, err := ParseAddr(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name string
+			src  message
+			dst  message
+		}{
+			{"Addr", addr, &Addr{}},
+			{"Request", &Request{Command: Connect, Addr: *addr}, &Request{}},
+			{"Reply", &Reply{Code: ReplyConnectionRefused, Addr: *addr}, &Reply{}},
+			{"UDPHeader", &UDPHeader{Addr: *addr}, &UDPHeader{}},
+		}
+		for _, tt := range tests {
+			data, err := tt.src.MarshalBinary()
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.name, address, err)
+			}
+			n, err := tt.dst.ReadFrom(bytes.NewReader(data))
+			if err != nil || n != int64(len(data)) {
+				t.Fatalf("%s %s: ReadFrom = %d, %v, want %d", tt.name, address, n, err, len(data))
+			}
+			if !reflect.DeepEqual(tt.dst, tt.src) {
+				t.Errorf("%s %s: 往返不一致 %+v, want %+v", tt.name, address, tt.dst, tt.src)
+			}
+		}
+
+		header, _ := (&UDPHeader{Addr: *addr}).MarshalBinary()
+		parsed, payload, err := ParseUDPDatagram(append(header, "payload"...))
+		if err != nil || parsed.Addr.String() != address || string(payload) != "payload" {
+			t.Errorf("ParseUDPDatagram %s = %v, %q, %v", address, parsed, payload, err)
+		}
+	}
+}
+
+func TestCodecFieldLimits(t *testing.T) {
+	methods := make([]byte, 255)
+	for i := range methods {
+		methods[i] = byte(i)
+	}
+	long := strings.Repeat("x", 255)
+	tests := []struct {
+		name string
+		src  message
+		dst  message
+	}{
+		{"255个认证方法", &Greeting{Methods: methods}, &Greeting{}},
+		{"255字节的用户名和密码", &UserPassRequest{Username: long, Password: long}, &UserPassRequest{}},
+		{"255字节的域名", &Addr{Type: Domain, Name: long, Port: 80}, &Addr{}},
+	}
+	for _, tt := range tests {
+		data, err := tt.src.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := tt.dst.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(tt.dst, tt.src) {
+			t.Errorf("%s: 往返不一致", tt.name)
+		}
+	}
+
+	// 超过255的字段无法编码
+	tooLong := strings.Repeat("x", 256)
+	for name, msg := range map[string]message{
+		"256个认证方法":  &Greeting{Methods: make([]byte, 256)},
+		"没有认证方法":    &Greeting{},
+		"256字节的用户名": &UserPassRequest{Username: tooLong},
+		"256字节的密码":  &UserPassRequest{Username: "u", Password: tooLong},
+		"256字节的域名":  &Addr{Type: Domain, Name: tooLong},
+	} {
+		if _, err := msg.MarshalBinary(); err == nil {
+			t.Errorf("%s: MarshalBinary 没有返回错误", name)
+		}
+	}
+}
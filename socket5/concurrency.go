@@ -0,0 +1,187 @@
+package socks5
+
+import (
+	"fmt"
+	"go-socket5/server"
+	"net"
+	"sort"
+	"sync"
+)
+
+// 并发上限的维度
+const (
+	concurrencyUser = "user"
+	concurrencyIP   = "ip"
+	concurrencyNet  = "network"
+)
+
+// concurrencyNetwork 网段并发上限
+type concurrencyNetwork struct {
+	key   string // 配置中的CIDR，作为计数的键
+	ipNet *net.IPNet
+	max   int
+}
+
+// concurrencyLimiter 按认证用户、来源IP和来源网段限制并发会话数
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	cfg      server.ConcurrencyConfig
+	networks []concurrencyNetwork
+	users    map[string]int // 各维度当前的会话数
+	ips      map[string]int
+	nets     map[string]int
+}
+
+// parseConcurrencyNetworks 解析网段上限，按前缀从长到短排序，日志和错误信息更稳定
+func parseConcurrencyNetworks(networks map[string]int) ([]concurrencyNetwork, error) {
+	list := make([]concurrencyNetwork, 0, len(networks))
+	for cidr, max := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段 %q: %v", cidr, err)
+		}
+		if max < 0 {
+			return nil, fmt.Errorf("网段 %s 的并发上限不能为负数", cidr)
+		}
+		list = append(list, concurrencyNetwork{key: cidr, ipNet: ipNet, max: max})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		bi, _ := list[i].ipNet.Mask.Size()
+		bj, _ := list[j].ipNet.Mask.Size()
+		if bi != bj {
+			return bi > bj
+		}
+		return list[i].key < list[j].key
+	})
+	return list, nil
+}
+
+// validateConcurrency 检查并发上限配置
+func validateConcurrency(cfg server.ConcurrencyConfig) error {
+	if cfg.PerUser < 0 || cfg.PerIP < 0 {
+		return fmt.Errorf("并发上限不能为负数")
+	}
+	for name, max := range cfg.Users {
+		if max < 0 {
+			return fmt.Errorf("用户 %s 的并发上限不能为负数", name)
+		}
+	}
+	_, err := parseConcurrencyNetworks(cfg.Networks)
+	return err
+}
+
+// set 替换并发上限，已占用的名额保留，超出新上限的会话不会被断开
+func (c *concurrencyLimiter) set(cfg server.ConcurrencyConfig) error {
+	if err := validateConcurrency(cfg); err != nil {
+		return err
+	}
+	users := make(map[string]int, len(cfg.Users))
+	for name, max := range cfg.Users {
+		users[name] = max
+	}
+	cfg.Users = users
+	networks, err := parseConcurrencyNetworks(cfg.Networks)
+	if err != nil {
+		return err
+	}
+	nets := make(map[string]int, len(cfg.Networks))
+	for cidr, max := range cfg.Networks {
+		nets[cidr] = max
+	}
+	cfg.Networks = nets
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+	c.networks = networks
+	if c.users == nil {
+		c.users = make(map[string]int)
+		c.ips = make(map[string]int)
+		c.nets = make(map[string]int)
+	}
+	return nil
+}
+
+// get 返回当前的并发上限
+func (c *concurrencyLimiter) get() server.ConcurrencyConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg := c.cfg
+	cfg.Users = make(map[string]int, len(c.cfg.Users))
+	for name, max := range c.cfg.Users {
+		cfg.Users[name] = max
+	}
+	cfg.Networks = make(map[string]int, len(c.cfg.Networks))
+	for cidr, max := range c.cfg.Networks {
+		cfg.Networks[cidr] = max
+	}
+	return cfg
+}
+
+// acquire 占用一个会话名额，任一维度超过上限时返回该维度且不占用名额
+// 成功时返回释放名额的函数，会话结束时调用
+func (c *concurrencyLimiter) acquire(user string, ip net.IP) (release func(), scope string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users == nil {
+		return func() {}, "", true
+	}
+
+	userMax := 0
+	if user != "" {
+		userMax = c.cfg.PerUser
+		if max, ok := c.cfg.Users[user]; ok {
+			userMax = max
+		}
+		if userMax > 0 && c.users[user] >= userMax {
+			return nil, concurrencyUser, false
+		}
+	}
+	ipKey := ip.String()
+	if c.cfg.PerIP > 0 && c.ips[ipKey] >= c.cfg.PerIP {
+		return nil, concurrencyIP, false
+	}
+	var matched []string
+	for _, n := range c.networks {
+		if !n.ipNet.Contains(ip) {
+			continue
+		}
+		if n.max > 0 && c.nets[n.key] >= n.max {
+			return nil, concurrencyNet, false
+		}
+		matched = append(matched, n.key)
+	}
+
+	// 所有维度都有名额时才占用，计数与配置无关，修改上限后释放仍然对称
+	if user != "" {
+		c.users[user]++
+	}
+	c.ips[ipKey]++
+	for _, key := range matched {
+		c.nets[key]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if user != "" {
+				decrementKey(c.users, user)
+			}
+			decrementKey(c.ips, ipKey)
+			for _, key := range matched {
+				decrementKey(c.nets, key)
+			}
+		})
+	}, "", true
+}
+
+// decrementKey 计数减一，减到0时删除键
+func decrementKey(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+// countingUserStore 记录校验密码的次数
+type countingUserStore struct {
+	UserStore
+	calls atomic.Int32
+}
+
+func (c *countingUserStore) Authenticate(username, password string) bool {
+	c.calls.Add(1)
+	return c.UserStore.Authenticate(username, password)
+}
+
+func TestMaxConnectionsReply(t *testing.T) {
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0, 2}})
+	store := &countingUserStore{UserStore: NewMemoryUserStore(map[string]string{"alice": "secret"})}
+	s.SetUsers(store)
+
+	s.connMutex.Lock()
+	s.connCount = MaxConcurrentConnections
+	s.connMutex.Unlock()
+
+	// 无认证的客户端发送请求后读到拒绝应答
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port}
+	conn, err := client.TcpProxy("127.0.0.1", 9)
+	if err == nil {
+		conn.Close()
+		t.Fatal("超过最大并发连接数的请求成功")
+	}
+	if !errors.Is(err, ErrConnectionNotAllowed) {
+		t.Fatalf("err = %v, want %v", err, ErrConnectionNotAllowed)
+	}
+
+	// 选择用户名密码认证后不等待认证数据，直接应答拒绝
+	raw, err := net.Dial("tcp", net.JoinHostPort(s.Config.Host, strconv.Itoa(int(s.Config.Port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := raw.Write([]byte{Version, 1, AccountPasswordAuthentication}); err != nil {
+		t.Fatal(err)
+	}
+	var selection MethodSelection
+	if _, err := selection.ReadFrom(raw); err != nil || selection.Method != AccountPasswordAuthentication {
+		t.Fatalf("选择的认证方法 = %d, %v", selection.Method, err)
+	}
+	var reply Reply
+	if _, err := reply.ReadFrom(raw); err != nil || reply.Code != ReplyConnectionNotAllowed {
+		t.Fatalf("应答 = %#x, %v, want %#x", reply.Code, err, ReplyConnectionNotAllowed)
+	}
+	if n := store.calls.Load(); n != 0 {
+		t.Errorf("校验了 %d 次密码，want 0", n)
+	}
+	// 服务器应答后才释放名额
+	for deadline := time.Now().Add(time.Second); s.rejecting.Load() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("rejecting = %d, want 0", s.rejecting.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.getConnCount(); n != MaxConcurrentConnections {
+		t.Errorf("connCount = %d, want %d", n, MaxConcurrentConnections)
+	}
+}
+
+func TestConcurrencyLimiterAcquire(t *testing.T) {
+	var c concurrencyLimiter
+	if err := c.set(server.ConcurrencyConfig{
+		PerUser:  2,
+		PerIP:    3,
+		Users:    map[string]int{"vip": 0},
+		Networks: map[string]int{"10.0.0.0/8": 4, "10.1.0.0/16": 0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	type step struct {
+		user  string
+		ip    string
+		scope string // 期望被拒绝的维度，为空表示成功
+	}
+	steps := []step{
+		{"alice", "192.0.2.1", ""},
+		{"alice", "192.0.2.2", ""},
+		{"alice", "192.0.2.3", concurrencyUser},
+		{"vip", "192.0.2.1", ""}, // 用户上限为0表示不限制
+		{"", "192.0.2.1", ""},
+		{"", "192.0.2.1", concurrencyIP},
+		{"", "10.0.0.1", ""},
+		{"", "10.0.0.2", ""},
+		{"", "10.1.0.1", ""},
+		{"", "10.2.0.1", ""},
+		{"", "10.3.0.1", concurrencyNet}, // 网段内所有来源共享上限
+		{"", "192.0.2.9", ""},
+	}
+	var releases []func()
+	for i, s := range steps {
+		release, scope, ok := c.acquire(s.user, net.ParseIP(s.ip))
+		if scope != s.scope || ok != (s.scope == "") {
+			t.Fatalf("第 %d 步 acquire(%q, %s) = %q, %v, want %q", i+1, s.user, s.ip, scope, ok, s.scope)
+		}
+		if ok {
+			releases = append(releases, release)
+		}
+	}
+
+	// 释放后名额归还，重复释放不会多减
+	for _, release := range releases {
+		release()
+		release()
+	}
+	if len(c.users) != 0 || len(c.ips) != 0 || len(c.nets) != 0 {
+		t.Errorf("释放后仍有计数: users=%v ips=%v nets=%v", c.users, c.ips, c.nets)
+	}
+}
+
+func TestValidateConcurrency(t *testing.T) {
+	tests := []struct {
+		cfg     server.ConcurrencyConfig
+		wantErr bool
+	}{
+		{server.ConcurrencyConfig{}, false},
+		{server.ConcurrencyConfig{PerUser: 1, PerIP: 1, Networks: map[string]int{"2001:db8::/32": 10}}, false},
+		{server.ConcurrencyConfig{PerIP: -1}, true},
+		{server.ConcurrencyConfig{Users: map[string]int{"alice": -1}}, true},
+		{server.ConcurrencyConfig{Networks: map[string]int{"10.0.0.0": 1}}, true},
+		{server.ConcurrencyConfig{Networks: map[string]int{"10.0.0.0/8": -1}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateConcurrency(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("validateConcurrency(%+v) = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
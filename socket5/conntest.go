@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-socket5/server"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connTestPhaseNames 连接测试各阶段的名称
+var connTestPhaseNames = map[string]string{
+	server.ConnTestHandshake: "SOCKS5握手",
+	server.ConnTestDNS:       "域名解析",
+	server.ConnTestConnect:   "连接目标",
+	server.ConnTestTLS:       "TLS握手",
+	server.ConnTestHTTP:      "HTTP请求",
+}
+
+// TestConnection 以 req 中的用户通过本地监听器代理连接目标，测量 SOCKS5 握手、域名解析、连接目标以及可选的 TLS 握手和 HTTP 请求的耗时
+// 测试连接与普通会话一样受黑名单、限流等策略约束；失败时 FailedPhase 为失败的阶段，代理服务器返回失败应答时 ReplyCode 为应答码
+func (s *Server) TestConnection(req server.ConnTestRequest) server.ConnTestResult {
+	start := time.Now()
+	result := server.ConnTestResult{User: req.User}
+	target := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+	finish := func(phase string, err error) server.ConnTestResult {
+		result.Timings.Total = elapsedMillis(start)
+		result.Latency = time.Since(start).Round(time.Millisecond).String()
+		if err != nil {
+			result.FailedPhase = phase
+			result.Message = fmt.Sprintf("%s失败: %v", connTestPhaseNames[phase], err)
+			var replyErr *ReplyError
+			if errors.As(err, &replyErr) {
+				code := int(replyErr.Code)
+				result.ReplyCode = &code
+			}
+		} else {
+			result.Success = true
+			result.Message = fmt.Sprintf("连接到 %s 成功", target)
+			if result.HTTPStatus != 0 {
+				result.Message += fmt.Sprintf("，HTTP 状态码 %d", result.HTTPStatus)
+			}
+		}
+		s.logger().Info("连接测试", "target", target, "user", req.User, "success", result.Success,
+			"failedPhase", result.FailedPhase, "total", time.Since(start))
+		return result
+	}
+
+	listener := s.listener()
+	if listener == nil {
+		return finish(server.ConnTestHandshake, errors.New("代理服务器未在监听"))
+	}
+	proxy := localDialAddr(listener.Addr())
+	result.Proxy = proxy
+
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = server.DefaultConnTestTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	host, portStr, _ := net.SplitHostPort(proxy)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	client := &Client{Host: host, Port: uint16(port), UserName: req.User, Password: req.Password, Logger: s.Logger}
+	logger := client.logger()
+
+	// 连接本地代理并认证
+	phaseStart := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxy)
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(deadline)
+		err = client.auth(conn, logger)
+	}
+	result.Timings.Handshake = elapsedMillisPtr(phaseStart)
+	if err != nil {
+		return finish(server.ConnTestHandshake, err)
+	}
+
+	// 解析失败时仍发送 CONNECT 请求，以获得代理服务器的应答码
+	var dnsErr error
+	if net.ParseIP(req.Host) == nil {
+		phaseStart = time.Now()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, req.Host)
+		result.Timings.DNS = elapsedMillisPtr(phaseStart)
+		dnsErr = err
+		for _, addr := range addrs {
+			result.ResolvedIPs = append(result.ResolvedIPs, addr.IP.String())
+		}
+	}
+
+	// 由代理服务器连接目标，域名目标按域名发送，与普通客户端一样匹配黑名单
+	phaseStart = time.Now()
+	err = client.tcp(conn, logger, req.Host, uint16(req.Port))
+	result.Timings.Connect = elapsedMillisPtr(phaseStart)
+	if err != nil {
+		// 代理服务器同样无法解析时归为域名解析失败，被规则拒绝等其他应答归为连接目标失败
+		if dnsErr != nil && errors.Is(err, ErrHostUnreachable) {
+			return finish(server.ConnTestDNS, fmt.Errorf("%v，代理服务器应答: %w", dnsErr, err))
+		}
+		return finish(server.ConnTestConnect, err)
+	}
+
+	var stream net.Conn = conn
+	if req.TLS {
+		phaseStart = time.Now()
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: req.Host})
+		err := tlsConn.HandshakeContext(ctx)
+		result.Timings.TLS = elapsedMillisPtr(phaseStart)
+		if err != nil {
+			return finish(server.ConnTestTLS, err)
+		}
+		result.TLSVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+		stream = tlsConn
+	}
+
+	if req.HTTP {
+		phaseStart = time.Now()
+		status, err := testHTTP(ctx, stream, req)
+		result.Timings.HTTP = elapsedMillisPtr(phaseStart)
+		if err != nil {
+			return finish(server.ConnTestHTTP, err)
+		}
+		result.HTTPStatus = status
+	}
+	return finish("", nil)
+}
+
+// testHTTP 在已建立的连接上发送 GET 请求，返回响应的状态码，不读取响应体
+func testHTTP(ctx context.Context, conn net.Conn, req server.ConnTestRequest) (int, error) {
+	scheme := "http"
+	if req.TLS {
+		scheme = "https"
+	}
+	path := req.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(req.Host, strconv.Itoa(req.Port)), path)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("User-Agent", "go-socket5-test")
+	httpReq.Close = true
+	if err := httpReq.Write(conn); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), httpReq)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// localDialAddr 返回连接本地监听器的地址，监听在未指定地址上时使用 127.0.0.1（[::] 同时监听 IPv4）
+func localDialAddr(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.IsUnspecified() {
+		return addr.String()
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(tcpAddr.Port))
+}
+
+// elapsedMillis 返回从 start 起经过的毫秒数
+func elapsedMillis(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// elapsedMillisPtr 与 elapsedMillis 相同，用于可省略的耗时字段
+func elapsedMillisPtr(start time.Time) *float64 {
+	ms := elapsedMillis(start)
+	return &ms
+}
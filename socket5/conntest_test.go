@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"fmt"
+	"go-socket5/server"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTestConnection(t *testing.T) {
+	handle := func(conn net.Conn) { io.Copy(io.Discard, conn) }
+	allowed := startTarget(t, handle)
+	blocked := startTarget(t, handle)
+	s := startServer(t, server.Socks5Config{
+		Host:      "127.0.0.1",
+		User:      "alice",
+		Password:  "secret",
+		AuthList:  []int{2},
+		BlackList: []string{fmt.Sprintf("127.0.0.1:%d", blocked.Port)},
+	})
+
+	result := s.TestConnection(server.ConnTestRequest{Host: "127.0.0.1", Port: allowed.Port, User: "alice", Password: "secret"})
+	if !result.Success || result.FailedPhase != "" || result.ReplyCode != nil {
+		t.Fatalf("连接允许的目标: %+v", result)
+	}
+	if result.Proxy != s.listener().Addr().String() || result.User != "alice" {
+		t.Errorf("Proxy = %q, User = %q", result.Proxy, result.User)
+	}
+	timings := result.Timings
+	// 目标为IP地址时不解析域名，未请求的 TLS 和 HTTP 阶段省略
+	if timings.Handshake == nil || timings.Connect == nil || timings.DNS != nil || timings.TLS != nil || timings.HTTP != nil {
+		t.Errorf("各阶段耗时 = %+v", timings)
+	} else if *timings.Handshake < 0 || *timings.Connect < 0 || timings.Total < *timings.Handshake+*timings.Connect {
+		t.Errorf("握手 %v ms，连接 %v ms，总耗时 %v ms", *timings.Handshake, *timings.Connect, timings.Total)
+	}
+
+	result = s.TestConnection(server.ConnTestRequest{Host: "127.0.0.1", Port: blocked.Port, User: "alice", Password: "secret"})
+	if result.Success || result.FailedPhase != server.ConnTestConnect {
+		t.Fatalf("连接黑名单中的目标: %+v", result)
+	}
+	if result.ReplyCode == nil || *result.ReplyCode != int(ReplyConnectionNotAllowed) {
+		t.Errorf("ReplyCode = %v, want %d", result.ReplyCode, ReplyConnectionNotAllowed)
+	}
+	if result.Timings.Handshake == nil || result.Timings.Connect == nil {
+		t.Errorf("各阶段耗时 = %+v", result.Timings)
+	}
+
+	result = s.TestConnection(server.ConnTestRequest{Host: "127.0.0.1", Port: allowed.Port, User: "alice", Password: "wrong"})
+	if result.Success || result.FailedPhase != server.ConnTestHandshake || result.Timings.Connect != nil {
+		t.Errorf("密码错误: %+v", result)
+	}
+}
@@ -26,3 +26,25 @@ const (
 	// Zero 成功状态码
 	Zero = 0x00
 )
+
+// 应答码（RFC 1928 REP字段）
+const (
+	// ReplySucceeded 成功
+	ReplySucceeded = 0x00
+	// ReplyGeneralFailure 服务器一般性故障
+	ReplyGeneralFailure = 0x01
+	// ReplyConnectionNotAllowed 规则不允许的连接
+	ReplyConnectionNotAllowed = 0x02
+	// ReplyNetworkUnreachable 网络不可达
+	ReplyNetworkUnreachable = 0x03
+	// ReplyHostUnreachable 主机不可达
+	ReplyHostUnreachable = 0x04
+	// ReplyConnectionRefused 连接被拒绝
+	ReplyConnectionRefused = 0x05
+	// ReplyTTLExpired TTL过期
+	ReplyTTLExpired = 0x06
+	// ReplyCommandNotSupported 不支持的命令
+	ReplyCommandNotSupported = 0x07
+	// ReplyAddressNotSupported 不支持的地址类型
+	ReplyAddressNotSupported = 0x08
+)
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ReplyError 服务端返回的失败应答
+// 可以用 errors.Is 与 ErrConnectionRefused 等预定义错误比较
+type ReplyError struct {
+	Code byte // 应答码
+}
+
+// Error 返回应答码对应的错误描述
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("SOCKS5请求失败: %s (0x%02x)", replyMessage(e.Code), e.Code)
+}
+
+// Is 应答码相同即视为同一错误
+func (e *ReplyError) Is(target error) bool {
+	t, ok := target.(*ReplyError)
+	return ok && t.Code == e.Code
+}
+
+// 各应答码对应的错误
+var (
+	ErrGeneralFailure       = &ReplyError{Code: ReplyGeneralFailure}
+	ErrConnectionNotAllowed = &ReplyError{Code: ReplyConnectionNotAllowed}
+	ErrNetworkUnreachable   = &ReplyError{Code: ReplyNetworkUnreachable}
+	ErrHostUnreachable      = &ReplyError{Code: ReplyHostUnreachable}
+	ErrConnectionRefused    = &ReplyError{Code: ReplyConnectionRefused}
+	ErrTTLExpired           = &ReplyError{Code: ReplyTTLExpired}
+	ErrCommandNotSupported  = &ReplyError{Code: ReplyCommandNotSupported}
+	ErrAddressNotSupported  = &ReplyError{Code: ReplyAddressNotSupported}
+)
+
+// replyMessage 应答码描述
+func replyMessage(code byte) string {
+	switch code {
+	case ReplySucceeded:
+		return "成功"
+	case ReplyGeneralFailure:
+		return "服务器一般性故障"
+	case ReplyConnectionNotAllowed:
+		return "规则不允许的连接"
+	case ReplyNetworkUnreachable:
+		return "网络不可达"
+	case ReplyHostUnreachable:
+		return "主机不可达"
+	case ReplyConnectionRefused:
+		return "连接被拒绝"
+	case ReplyTTLExpired:
+		return "TTL过期"
+	case ReplyCommandNotSupported:
+		return "不支持的命令"
+	case ReplyAddressNotSupported:
+		return "不支持的地址类型"
+	default:
+		return "未知错误"
+	}
+}
+
+// replyError 将应答码转换为错误，成功返回nil
+func replyError(code byte) error {
+	if code == ReplySucceeded {
+		return nil
+	}
+	return &ReplyError{Code: code}
+}
+
+// replyCodeFromError 将拨号、策略等错误映射为应答码
+func replyCodeFromError(err error) byte {
+	if err == nil {
+		return ReplySucceeded
+	}
+
+	// 服务端策略拒绝等已经是应答错误
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return ReplyHostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT):
+		return ReplyTTLExpired
+	}
+
+	// 域名不存在或解析失败时目标主机不可达
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ReplyTTLExpired
+		}
+		return ReplyHostUnreachable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ReplyTTLExpired
+	}
+	return ReplyGeneralFailure
+}
@@ -0,0 +1,57 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReplyCodeFromError(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"nil", nil, ReplySucceeded},
+		{"policy", ErrConnectionNotAllowed, ReplyConnectionNotAllowed},
+		{"wrapped policy", fmt.Errorf("blacklist: %w", ErrConnectionNotAllowed), ReplyConnectionNotAllowed},
+		{"refused", dialErr(syscall.ECONNREFUSED), ReplyConnectionRefused},
+		{"network unreachable", dialErr(syscall.ENETUNREACH), ReplyNetworkUnreachable},
+		{"host unreachable", dialErr(syscall.EHOSTUNREACH), ReplyHostUnreachable},
+		{"connect timeout", dialErr(syscall.ETIMEDOUT), ReplyTTLExpired},
+		{"no such host", &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, ReplyHostUnreachable},
+		{"dns timeout", &net.DNSError{Err: "timeout", Name: "x.invalid", IsTimeout: true}, ReplyTTLExpired},
+		{"dial deadline", &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}, ReplyTTLExpired},
+		{"other", errors.New("boom"), ReplyGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCodeFromError(tt.err); got != tt.want {
+				t.Errorf("replyCodeFromError(%v) = 0x%02x, want 0x%02x", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	if err := replyError(ReplySucceeded); err != nil {
+		t.Errorf("replyError(0) = %v, want nil", err)
+	}
+	err := replyError(ReplyConnectionRefused)
+	if !errors.Is(err, ErrConnectionRefused) || errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("errors.Is 没有按应答码比较: %v", err)
+	}
+	if got := replyCodeFromError(err); got != ReplyConnectionRefused {
+		t.Errorf("replyCodeFromError(%v) = 0x%02x", err, got)
+	}
+	if msg := replyError(0x42).Error(); msg != "SOCKS5请求失败: 未知错误 (0x42)" {
+		t.Errorf("Error() = %q", msg)
+	}
+}
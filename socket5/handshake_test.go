@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+// handshakeBytes 返回一次用户名密码认证的 CONNECT 握手的全部客户端报文
+func handshakeBytes(t *testing.T, user, password string, target *net.TCPAddr) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, msg := range []interface{ MarshalBinary() ([]byte, error) }{
+		&Greeting{Methods: []byte{AccountPasswordAuthentication}},
+		&UserPassRequest{Username: user, Password: password},
+		&Request{Command: Connect, Addr: *AddrFromNetAddr(target)},
+	} {
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestHandshakeFraming(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", User: "u", Password: "p", AuthList: []int{2}})
+	proxy := net.JoinHostPort(s.Config.Host, strconv.Itoa(int(s.Config.Port)))
+	handshake := handshakeBytes(t, "u", "p", target)
+
+	tests := []struct {
+		name  string
+		write func(conn net.Conn) error
+	}{
+		// 客户端不等应答，把握手和首个数据包一次发出
+		{"pipelined", func(conn net.Conn) error {
+			_, err := conn.Write(append(append([]byte{}, handshake...), "ping"...))
+			return err
+		}},
+		// 每次只发一个字节
+		{"byte by byte", func(conn net.Conn) error {
+			for _, b := range append(append([]byte{}, handshake...), "ping"...) {
+				if _, err := conn.Write([]byte{b}); err != nil {
+					return err
+				}
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.(*net.TCPConn).SetNoDelay(true)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := tt.write(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			var selection MethodSelection
+			var auth UserPassReply
+			var reply Reply
+			for _, msg := range []io.ReaderFrom{&selection, &auth, &reply} {
+				if _, err := msg.ReadFrom(conn); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if selection.Method != AccountPasswordAuthentication || auth.Status != UserPassSuccess || reply.Code != ReplySucceeded {
+				t.Fatalf("method = %d, auth = %d, reply = %d", selection.Method, auth.Status, reply.Code)
+			}
+
+			// 握手之后已经发出的数据不能丢失
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("echo = %q, %v, want %q", buf, err, "ping")
+			}
+		})
+	}
+}
+
+func TestHandshakeFieldLimits(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	user, password := strings.Repeat("u", 255), strings.Repeat("p", 255)
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", User: user, Password: password, AuthList: []int{2}})
+	proxy := net.JoinHostPort(s.Config.Host, strconv.Itoa(int(s.Config.Port)))
+
+	// 完整的255个认证方法，分多次写入
+	methods := make([]byte, 255)
+	for i := range methods {
+		methods[i] = byte(i)
+	}
+	greeting, err := (&Greeting{Methods: methods}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetNoDelay(true)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for len(greeting) > 0 {
+		n := 100
+		if n > len(greeting) {
+			n = len(greeting)
+		}
+		if _, err := conn.Write(greeting[:n]); err != nil {
+			t.Fatal(err)
+		}
+		greeting = greeting[n:]
+		time.Sleep(5 * time.Millisecond)
+	}
+	var selection MethodSelection
+	if _, err := selection.ReadFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+	if selection.Method != AccountPasswordAuthentication {
+		t.Fatalf("method = %d, want %d", selection.Method, AccountPasswordAuthentication)
+	}
+
+	// 255字节的用户名和密码
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port, UserName: user, Password: password}
+	proxied, err := client.TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatalf("255字节的用户名和密码认证失败: %v", err)
+	}
+	defer proxied.Close()
+	proxied.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := proxied.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(proxied, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo = %q, %v", buf, err)
+	}
+
+	client.Password = password[:254] + "x"
+	if conn, err := client.TcpProxy("127.0.0.1", uint16(target.Port)); err == nil {
+		conn.Close()
+		t.Error("错误的255字节密码认证成功")
+	}
+}
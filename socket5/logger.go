@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go-socket5/server"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// 日志属性名
+const (
+	LogKeySession   = "session"   // 会话ID，会话内的每条日志都带有该属性
+	LogKeyComponent = "component" // 输出日志的组件：server、client
+	LogKeyAudit     = "audit"     // 审计事件标记
+	LogKeyPayload   = "payload"   // 认证报文和转发数据，默认脱敏
+	LogKeyPassword  = "password"  // 密码，默认脱敏
+)
+
+// redactedValue 脱敏后的属性值
+const redactedValue = "[REDACTED]"
+
+// NewLogger 按配置创建日志记录器，输出到 w
+// 除非配置了 ShowSecrets，LogKeyPassword 和 LogKeyPayload 属性的值都会被替换为 [REDACTED]
+func NewLogger(cfg server.LogConfig, w io.Writer) (*slog.Logger, error) {
+	level, err := ParseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if !cfg.ShowSecrets {
+		opts.ReplaceAttr = redactAttr
+	}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("无效的日志格式: %q", cfg.Format)
+	}
+}
+
+// CaptureLogs 将日志同时保留在管理接口的内存缓冲区中，供 /api/logs 查询和实时推送
+// 缓冲区中的日志与输出一样脱敏
+func CaptureLogs(logger *slog.Logger, cfg server.LogConfig) *slog.Logger {
+	var replace func(groups []string, a slog.Attr) slog.Attr
+	if !cfg.ShowSecrets {
+		replace = redactAttr
+	}
+	return slog.New(server.CaptureLogs(logger.Handler(), cfg.BufferSize, replace))
+}
+
+// ParseLogLevel 解析日志级别：debug、info、warn、error，空字符串为 info
+func ParseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("无效的日志级别: %q", level)
+	}
+}
+
+// redactAttr 替换敏感属性的值
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Key {
+	case LogKeyPassword, LogKeyPayload:
+		return slog.String(a.Key, redactedValue)
+	}
+	return a
+}
+
+// hexAttr 以十六进制输出报文，仅用于调试级别
+func hexAttr(key string, b []byte) slog.Attr {
+	return slog.String(key, hex.EncodeToString(b))
+}
+
+// auditLog 输出审计日志，策略拒绝、封禁等安全相关事件统一带有 audit=true 属性
+func auditLog(logger *slog.Logger, msg string, args ...any) {
+	logger.Info(msg, append([]any{LogKeyAudit, true}, args...)...)
+}
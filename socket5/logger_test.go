@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go-socket5/server"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"INFO", slog.LevelInfo, false},
+		{"warning", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"trace", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLogLevel(tt.level)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseLogLevel(%q) = %v, %v, want %v, wantErr %v", tt.level, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNewLoggerRedaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    server.LogConfig
+		want   []string
+		absent []string
+	}{
+		{"text", server.LogConfig{Level: "debug"},
+			[]string{"password=[REDACTED]", "payload=[REDACTED]", "user=alice"}, []string{"hunter2", "0102"}},
+		{"json", server.LogConfig{Format: "json"},
+			[]string{`"password":"[REDACTED]"`, `"payload":"[REDACTED]"`}, []string{"hunter2", "0102"}},
+		{"show secrets", server.LogConfig{ShowSecrets: true},
+			[]string{"password=hunter2", "payload=0102"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := NewLogger(tt.cfg, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger.Info("认证", "user", "alice", LogKeyPassword, "hunter2", hexAttr(LogKeyPayload, []byte{1, 2}))
+			out := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("日志缺少 %q: %s", want, out)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(out, absent) {
+					t.Errorf("日志包含 %q: %s", absent, out)
+				}
+			}
+		})
+	}
+
+	if _, err := NewLogger(server.LogConfig{Format: "xml"}, &bytes.Buffer{}); err == nil {
+		t.Error("无效的日志格式没有返回错误")
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(server.LogConfig{Level: "warn"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("忽略")
+	logger.Warn("警告")
+	out := buf.String()
+	if strings.Contains(out, "忽略") || !strings.Contains(out, "警告") {
+		t.Errorf("日志级别过滤不正确: %s", out)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(server.LogConfig{}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog(logger, "封禁IP", "ip", "192.0.2.1")
+	if out := buf.String(); !strings.Contains(out, "audit=true ip=192.0.2.1") {
+		t.Errorf("审计日志缺少 audit 属性: %s", out)
+	}
+}
@@ -0,0 +1,452 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 支持的密码哈希算法
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+	HashScrypt   = "scrypt"
+)
+
+// 密码哈希参数
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeyLen  = 32
+	saltLen       = 16
+)
+
+// 校验哈希时允许的参数上限，避免一条配置让每次握手都分配大量内存或计算过久
+const (
+	maxBcryptCost    = 14
+	maxHashMemory    = 256 << 20 // argon2id 的 m 和 scrypt 的 128*N*r，字节
+	maxHashTime      = 16        // argon2id 的 t
+	maxHashThreads   = 16        // argon2id 和 scrypt 的 p
+	maxScryptR       = 32
+	maxHashKeyLength = 128 // 哈希和盐的最大字节数
+)
+
+// 验证缓存参数
+const (
+	verifyCacheTTL  = 5 * time.Minute
+	verifyCacheSize = 4096
+)
+
+// b64 PHC字符串使用的无填充base64编码
+var b64 = base64.RawStdEncoding
+
+// hashPrefix 匹配 $方案$ 开头的哈希，如 $2y$、$apr1$、$6$、$argon2id$
+var hashPrefix = regexp.MustCompile(`^\$[0-9a-z-]+\$`)
+
+// cryptAlphabet crypt(3) 使用的base64字母表
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HashPassword 使用指定算法生成密码哈希，algorithm 为空时使用bcrypt
+//
+// 生成的格式：
+//
+//	bcrypt:   $2a$10$...
+//	argon2id: $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+//	scrypt:   $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+func HashPassword(algorithm, password string) (string, error) {
+	switch algorithm {
+	case "", HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashArgon2id:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case HashScrypt:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, scryptKeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+			scryptLogN, scryptR, scryptP, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("不支持的哈希算法: %s", algorithm)
+	}
+}
+
+// newSalt 生成随机盐
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// isSlowHash 是否为需要缓存验证结果的慢哈希
+func isSlowHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2") ||
+		strings.HasPrefix(stored, "$argon2id$") ||
+		strings.HasPrefix(stored, "$scrypt$")
+}
+
+// isHashed 是否为哈希格式（$方案$... 或 {SHA}），哈希格式的值不会按明文比较
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, "{SHA}") || hashPrefix.MatchString(stored)
+}
+
+// checkPasswordHash 检查哈希是否为支持的格式，用于加载时拒绝无法校验的哈希
+func checkPasswordHash(stored string) error {
+	switch {
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum, err := base64.StdEncoding.DecodeString(stored[len("{SHA}"):])
+		if err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("{SHA} 哈希格式错误")
+		}
+		return nil
+	case strings.HasPrefix(stored, "$apr1$"), strings.HasPrefix(stored, "$1$"):
+		_, _, _, err := parseMD5Crypt(stored)
+		return err
+	case strings.HasPrefix(stored, "$2"):
+		return checkBcryptCost(stored)
+	case strings.HasPrefix(stored, "$argon2id$"):
+		_, _, err := parseArgon2id(stored)
+		return err
+	case strings.HasPrefix(stored, "$scrypt$"):
+		_, _, err := parseScrypt(stored)
+		return err
+	}
+	if scheme := hashPrefix.FindString(stored); scheme != "" {
+		return fmt.Errorf("不支持的哈希格式 %s，支持 bcrypt、apr1、{SHA}、argon2id 和 scrypt", scheme)
+	}
+	return fmt.Errorf("不是支持的哈希格式，支持 bcrypt、apr1、{SHA}、argon2id 和 scrypt")
+}
+
+// verifyPassword 校验密码，stored 为配置中保存的密码或哈希
+// 支持明文、htpasswd 的 {SHA} 和 apr1、MD5-crypt、bcrypt、argon2id 和 scrypt，比较均为常量时间
+// 不支持的哈希格式始终校验失败，不会按明文比较
+func verifyPassword(stored, password string) bool {
+	if !isSlowHash(stored) {
+		switch {
+		case strings.HasPrefix(stored, "{SHA}"):
+			sum := sha1.Sum([]byte(password))
+			stored = stored[len("{SHA}"):]
+			password = base64.StdEncoding.EncodeToString(sum[:])
+		case strings.HasPrefix(stored, "$apr1$"), strings.HasPrefix(stored, "$1$"):
+			magic, salt, _, err := parseMD5Crypt(stored)
+			if err != nil {
+				return false
+			}
+			password = md5Crypt(password, salt, magic)
+		case isHashed(stored):
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	// 慢哈希先查缓存，避免每次握手都重新计算
+	key := defaultVerifyCache.key(stored, password)
+	if defaultVerifyCache.lookup(key) {
+		return true
+	}
+	ok, err := verifyHash(stored, password)
+	if err != nil || !ok {
+		return false
+	}
+	defaultVerifyCache.add(key)
+	return true
+}
+
+// verifyHash 校验慢哈希
+func verifyHash(stored, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(stored, "$2"):
+		if err := checkBcryptCost(stored); err != nil {
+			return false, err
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(stored, "$argon2id$"):
+		params, salt, err := parseArgon2id(stored)
+		if err != nil {
+			return false, err
+		}
+		key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.threads, uint32(len(params.hash)))
+		return subtle.ConstantTimeCompare(key, params.hash) == 1, nil
+	case strings.HasPrefix(stored, "$scrypt$"):
+		params, salt, err := parseScrypt(stored)
+		if err != nil {
+			return false, err
+		}
+		key, err := scrypt.Key([]byte(password), salt, 1<<params.logN, params.r, params.p, len(params.hash))
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(key, params.hash) == 1, nil
+	}
+	return false, fmt.Errorf("未知的哈希格式")
+}
+
+// checkBcryptCost 检查bcrypt哈希的格式和代价
+func checkBcryptCost(stored string) error {
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		return err
+	}
+	if cost > maxBcryptCost {
+		return fmt.Errorf("bcrypt代价 %d 超过上限 %d", cost, maxBcryptCost)
+	}
+	return nil
+}
+
+// argon2Params argon2id哈希的参数
+type argon2Params struct {
+	memory     uint32 // KiB
+	iterations uint32
+	threads    uint8
+	hash       []byte
+}
+
+// parseArgon2id 解析argon2id哈希并检查参数范围
+func parseArgon2id(stored string) (argon2Params, []byte, error) {
+	var version, memory, iterations, threads int
+	salt, hash, err := parsePHC(stored, 5, func(fields []string) error {
+		if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+			return err
+		}
+		_, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+		return err
+	})
+	if err != nil {
+		return argon2Params{}, nil, err
+	}
+	if version != argon2.Version {
+		return argon2Params{}, nil, fmt.Errorf("不支持的argon2版本: %d", version)
+	}
+	if memory < 8*threads || memory > maxHashMemory>>10 || iterations < 1 || iterations > maxHashTime ||
+		threads < 1 || threads > maxHashThreads || len(hash) == 0 {
+		return argon2Params{}, nil, fmt.Errorf("argon2参数无效或超过上限（m≤%d，t≤%d，p≤%d）", maxHashMemory>>10, maxHashTime, maxHashThreads)
+	}
+	return argon2Params{memory: uint32(memory), iterations: uint32(iterations), threads: uint8(threads), hash: hash}, salt, nil
+}
+
+// scryptParams scrypt哈希的参数
+type scryptParams struct {
+	logN, r, p int
+	hash       []byte
+}
+
+// parseScrypt 解析scrypt哈希并检查参数范围，内存占用约为 128*N*r 字节
+func parseScrypt(stored string) (scryptParams, []byte, error) {
+	var logN, r, p int
+	salt, hash, err := parsePHC(stored, 4, func(fields []string) error {
+		_, err := fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &logN, &r, &p)
+		return err
+	})
+	if err != nil {
+		return scryptParams{}, nil, err
+	}
+	if logN < 1 || logN > 30 || r < 1 || r > maxScryptR || p < 1 || p > maxHashThreads ||
+		128*(1<<logN)*r > maxHashMemory || len(hash) == 0 {
+		return scryptParams{}, nil, fmt.Errorf("scrypt参数无效或超过上限（128*N*r≤%d字节，r≤%d，p≤%d）", maxHashMemory, maxScryptR, maxHashThreads)
+	}
+	return scryptParams{logN: logN, r: r, p: p, hash: hash}, salt, nil
+}
+
+// dummyHash 用户不存在时用于校验的哈希，使未知用户与已知用户的认证耗时相近
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash 返回随机密码的bcrypt哈希，不会有密码与之匹配
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		password, _ := newSalt()
+		dummyHash, _ = HashPassword(HashBcrypt, b64.EncodeToString(password))
+	})
+	return dummyHash
+}
+
+// parseMD5Crypt 解析 $apr1$盐$哈希 或 $1$盐$哈希，返回 $apr1$ 或 $1$ 前缀、盐和哈希
+func parseMD5Crypt(stored string) (magic, salt, hash string, err error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || len(parts[2]) == 0 || len(parts[2]) > 8 || len(parts[3]) != 22 {
+		return "", "", "", fmt.Errorf("MD5-crypt 哈希格式错误")
+	}
+	return "$" + parts[1] + "$", parts[2], parts[3], nil
+}
+
+// md5Crypt 计算 MD5-crypt 哈希，magic 为 $1$ 或 Apache 的 $apr1$，两者仅前缀不同
+func md5Crypt(password, salt, magic string) string {
+	pw := []byte(password)
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		if i < 16 {
+			d.Write(alt[:i])
+		} else {
+			d.Write(alt[:])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return magic + salt + "$" + string(out)
+}
+
+// parsePHC 解析 $算法$参数...$盐$哈希 格式的字符串
+// fields 为按$拆分后的段数（不含开头的空段），params 负责解析参数段
+func parsePHC(stored string, fields int, params func([]string) error) (salt, hash []byte, err error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != fields+1 {
+		return nil, nil, fmt.Errorf("哈希格式错误")
+	}
+	if err := params(parts); err != nil {
+		return nil, nil, fmt.Errorf("哈希参数错误: %v", err)
+	}
+	if salt, err = b64.DecodeString(parts[len(parts)-2]); err != nil {
+		return nil, nil, err
+	}
+	if hash, err = b64.DecodeString(parts[len(parts)-1]); err != nil {
+		return nil, nil, err
+	}
+	if len(salt) > maxHashKeyLength || len(hash) > maxHashKeyLength {
+		return nil, nil, fmt.Errorf("盐或哈希过长")
+	}
+	return salt, hash, nil
+}
+
+// verifyCache 最近验证成功的密码缓存
+// 键为进程内随机密钥对 哈希+密码 计算的HMAC，内存中不保存明文密码
+type verifyCache struct {
+	mu      sync.Mutex
+	secret  []byte
+	entries map[[sha256.Size]byte]time.Time // 键到过期时间
+}
+
+// defaultVerifyCache 全局验证缓存
+var defaultVerifyCache = newVerifyCache()
+
+// newVerifyCache 创建验证缓存
+func newVerifyCache() *verifyCache {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &verifyCache{
+		secret:  secret,
+		entries: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// key 计算缓存键，哈希变更后旧的缓存自然失效
+func (c *verifyCache) key(stored, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(stored))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	var key [sha256.Size]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// lookup 查询缓存是否命中且未过期
+func (c *verifyCache) lookup(key [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expire, ok := c.entries[key]
+	if ok && time.Now().After(expire) {
+		delete(c.entries, key)
+		return false
+	}
+	return ok
+}
+
+// add 加入缓存，缓存已满时先清理过期项，仍然满则清空
+func (c *verifyCache) add(key [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= verifyCacheSize {
+		now := time.Now()
+		for k, expire := range c.entries {
+			if now.After(expire) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= verifyCacheSize {
+			c.entries = make(map[[sha256.Size]byte]time.Time)
+		}
+	}
+	c.entries[key] = time.Now().Add(verifyCacheTTL)
+}
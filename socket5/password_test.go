@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	const sha6 = "$6$abc$IdWKNKTJEb8LxY7CGg8YBXlvtfZzFw7Mp/r6niK9YB2mdvgY..TKjv1T..8RadRt2qvUHYRLr/TsVArtr91iR1"
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"明文", "secret", "secret", true},
+		{"明文错误", "secret", "Secret", false},
+		{"SHA", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"SHA错误", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "wrong", false},
+		{"SHA哈希本身", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "5en6G6MezRroT3XKqkdPOmY/BfQ=", false},
+		{"apr1", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret", true},
+		{"apr1空密码", "$apr1$xy$43..WIhbfuznGvwoCyUek/", "", true},
+		{"apr1错误", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "wrong", false},
+		{"apr1哈希本身", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", false},
+		{"MD5-crypt", "$1$abcdefgh$cHJi5PXp/ki/ktXzqlk6I1", "secret", true},
+		{"不支持的sha512crypt", sha6, "secret", false},
+		{"不支持的哈希本身", sha6, sha6, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyPassword(tt.stored, tt.password); got != tt.want {
+				t.Errorf("verifyPassword(%q, %q) = %v, want %v", tt.stored, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id, HashScrypt} {
+		hash, err := HashPassword(algorithm, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if err := checkPasswordHash(hash); err != nil {
+			t.Errorf("%s: checkPasswordHash: %v", algorithm, err)
+		}
+		if !verifyPassword(hash, "secret") {
+			t.Errorf("%s: 正确的密码校验失败", algorithm)
+		}
+		if verifyPassword(hash, "wrong") || verifyPassword(hash, hash) {
+			t.Errorf("%s: 错误的密码校验成功", algorithm)
+		}
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		users   int
+		wantErr string
+	}{
+		{"支持的格式", "# comment\n\nalice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\ncarol:$1$abcdefgh$cHJi5PXp/ki/ktXzqlk6I1\n", 3, ""},
+		{"缺少冒号", "alice\n", 0, "第 1 行"},
+		{"明文", "alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:secret\n", 0, "第 2 行"},
+		{"crypt", "alice:abJnggxhB/yWI\n", 0, "第 1 行"},
+		{"sha512crypt", "alice:$6$abc$IdWKNKTJEb8LxY7CGg8YBXlvtfZzFw7Mp/r6niK9YB2mdvgY..TKjv1T..8RadRt2qvUHYRLr/TsVArtr91iR1\n", 0, "$6$"},
+		{"apr1截断", "alice:$apr1$abcdefgh$h9FWgU\n", 0, "第 1 行"},
+		{"SHA格式错误", "alice:{SHA}abc\n", 0, "第 1 行"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := parseHtpasswd([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != tt.users {
+				t.Errorf("len(users) = %d, want %d", len(users), tt.users)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  string
+		wantErr bool
+	}{
+		{"argon2id", "$argon2id$v=19$m=65536,t=1,p=4$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", false},
+		{"argon2id内存过大", "$argon2id$v=19$m=4194304,t=1,p=4$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", true},
+		{"argon2id迭代过多", "$argon2id$v=19$m=65536,t=1000,p=4$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", true},
+		{"argon2id并行度过大", "$argon2id$v=19$m=65536,t=1,p=255$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", true},
+		{"scrypt", "$scrypt$ln=15,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", false},
+		{"scrypt内存过大", "$scrypt$ln=20,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", true},
+		{"scrypt并行度过大", "$scrypt$ln=15,r=8,p=1000$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g", true},
+		{"bcrypt", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", false},
+		{"bcrypt代价过大", "$2a$31$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", true},
+		{"bcrypt截断", "$2a$10$N9qo8uLOickgx2ZMRZoMye", true},
+		{"sha512crypt", "$6$abc$IdWKNKTJEb8LxY7CGg8YBXlvtfZzFw7Mp/r6niK9YB2mdvgY..TKjv1T..8RadRt2qvUHYRLr/TsVArtr91iR1", true},
+		{"拼写错误", "$argon2i$v=19$m=65536,t=1,p=4$c2FsdA$aGFzaA", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPasswordHash(tt.stored)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkPasswordHash() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && verifyPassword(tt.stored, tt.stored) {
+				t.Error("无法校验的哈希按明文比较成功")
+			}
+		})
+	}
+}
+
+func TestPasswordEntry(t *testing.T) {
+	tests := []struct {
+		name, password, passwordHash, want string
+		wantErr                            bool
+	}{
+		{"明文", "secret", "", "secret", false},
+		{"哈希优先", "secret", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", false},
+		{"password_hash不是哈希", "", "secret", "", true},
+		{"password_hash不支持", "", "$6$abc$IdWKNKTJEb8LxY7CGg8YBXlvtfZzFw7Mp", "", true},
+		{"password为哈希", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", false},
+		{"password为不支持的哈希", "$5$abc$def", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := passwordEntry(tt.password, tt.passwordHash)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("passwordEntry() = %q, %v, want %q, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryUserStoreUnknownUser(t *testing.T) {
+	store := NewMemoryUserStore(map[string]string{"alice": "secret"})
+	if !store.Authenticate("alice", "secret") {
+		t.Error("已知用户认证失败")
+	}
+	if store.Authenticate("mallory", "secret") || store.Authenticate("", "") {
+		t.Error("未知用户认证成功")
+	}
+}
@@ -0,0 +1,446 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-socket5/server"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// quotaCheckInterval 累计连接时间、检查超额和保存用量的间隔
+const quotaCheckInterval = 10 * time.Second
+
+// 字节配额的周期
+const (
+	QuotaDay   = "day"
+	QuotaWeek  = "week"
+	QuotaMonth = "month"
+)
+
+// quotaUsage 一个用户的配额用量，持久化到状态文件
+type quotaUsage struct {
+	Bytes       int64         `json:"bytes"`       // 当前周期已用字节数
+	PeriodStart time.Time     `json:"periodStart"` // Bytes 所属周期的开始时间
+	Time        time.Duration `json:"time"`        // 当天已用连接时间
+	Day         time.Time     `json:"day"`         // Time 所属日期的零点
+}
+
+// quotaTracker 用户配额统计
+type quotaTracker struct {
+	mu       sync.Mutex
+	cfg      server.QuotaConfig
+	usage    map[string]*quotaUsage
+	sessions map[*session]time.Time // 进行中的认证会话及上次累计连接时间的时间点
+	dirty    bool                   // 用量有变化尚未保存
+	log      *slog.Logger
+
+	saveMu sync.Mutex // 串行化状态文件的写入
+}
+
+// validateQuotas 检查配额配置
+func validateQuotas(cfg server.QuotaConfig) error {
+	check := func(name string, limit server.QuotaLimit) error {
+		if limit.Bytes < 0 || limit.DailyTime < 0 {
+			return fmt.Errorf("%s 的配额不能为负数", name)
+		}
+		switch limit.Period {
+		case "", QuotaDay, QuotaWeek, QuotaMonth:
+			return nil
+		}
+		return fmt.Errorf("%s 的配额周期无效: %q", name, limit.Period)
+	}
+	if err := check("default", cfg.Default); err != nil {
+		return err
+	}
+	for name, limit := range cfg.Users {
+		if err := check("用户 "+name, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLogger 设置日志记录器
+func (q *quotaTracker) setLogger(logger *slog.Logger) {
+	q.mu.Lock()
+	q.log = logger
+	q.mu.Unlock()
+}
+
+// logger 返回日志记录器，调用方需持有锁
+func (q *quotaTracker) logger() *slog.Logger {
+	if q.log == nil {
+		return slog.Default()
+	}
+	return q.log
+}
+
+// set 替换配额配置，状态文件变化时从新文件加载用量
+func (q *quotaTracker) set(cfg server.QuotaConfig) error {
+	commit, err := q.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// prepare 检查配额配置，状态文件变化时先加载用量，不修改当前配置
+// 返回的 commit 替换配置，不会失败
+func (q *quotaTracker) prepare(cfg server.QuotaConfig) (func(), error) {
+	if err := validateQuotas(cfg); err != nil {
+		return nil, err
+	}
+	users := make(map[string]server.QuotaLimit, len(cfg.Users))
+	for name, limit := range cfg.Users {
+		users[name] = limit
+	}
+	cfg.Users = users
+
+	q.mu.Lock()
+	reload := q.usage == nil || cfg.StateFile != q.cfg.StateFile
+	logger := q.logger()
+	q.mu.Unlock()
+	var usage map[string]*quotaUsage
+	if reload {
+		var err error
+		if usage, err = loadQuotaUsage(cfg.StateFile, logger); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if reload {
+			q.usage = usage
+		}
+		if q.sessions == nil {
+			q.sessions = make(map[*session]time.Time)
+		}
+		q.cfg = cfg
+	}, nil
+}
+
+// get 返回当前的配额配置
+func (q *quotaTracker) get() server.QuotaConfig {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cfg := q.cfg
+	cfg.Users = make(map[string]server.QuotaLimit, len(q.cfg.Users))
+	for name, limit := range q.cfg.Users {
+		cfg.Users[name] = limit
+	}
+	return cfg
+}
+
+// limitFor 返回用户的配额，调用方需持有锁
+func (q *quotaTracker) limitFor(user string) server.QuotaLimit {
+	limit, ok := q.cfg.Users[user]
+	if !ok {
+		limit = q.cfg.Default
+	}
+	if limit.Period == "" {
+		limit.Period = QuotaMonth
+	}
+	return limit
+}
+
+// usageFor 返回用户的用量，跨周期或跨天时先清零，调用方需持有锁
+func (q *quotaTracker) usageFor(user string, limit server.QuotaLimit, now time.Time) *quotaUsage {
+	u := q.usage[user]
+	if u == nil {
+		u = &quotaUsage{}
+		q.usage[user] = u
+	}
+	if start := periodStart(limit.Period, now); !u.PeriodStart.Equal(start) {
+		u.Bytes = 0
+		u.PeriodStart = start
+		q.dirty = true
+	}
+	if day := periodStart(QuotaDay, now); !u.Day.Equal(day) {
+		u.Time = 0
+		u.Day = day
+		q.dirty = true
+	}
+	return u
+}
+
+// exhausted 用户配额是否已用完，调用方需持有锁
+func (q *quotaTracker) exhausted(user string, now time.Time) (string, bool) {
+	limit := q.limitFor(user)
+	if limit.Bytes == 0 && limit.DailyTime == 0 {
+		return "", false
+	}
+	u := q.usageFor(user, limit, now)
+	if limit.Bytes > 0 && u.Bytes >= limit.Bytes {
+		return "流量配额已用完", true
+	}
+	if limit.DailyTime > 0 && u.Time >= limit.DailyTime {
+		return "当天连接时间已用完", true
+	}
+	return "", false
+}
+
+// begin 会话开始转发前检查配额，未用完时开始统计，用完时返回原因
+// 未认证的会话和没有配额的用户不受配额限制，也不统计用量，转发时不经过配额的锁
+// 会话开始后才为用户设置的配额从下一个会话起统计
+func (q *quotaTracker) begin(sess *session) (string, bool) {
+	if sess.user == "" {
+		return "", true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		return "", true
+	}
+	if limit := q.limitFor(sess.user); limit.Bytes == 0 && limit.DailyTime == 0 {
+		return "", true
+	}
+	now := time.Now()
+	if reason, exhausted := q.exhausted(sess.user, now); exhausted {
+		return reason, false
+	}
+	q.sessions[sess] = now
+	sess.quota = q
+	return "", true
+}
+
+// end 会话结束时累计剩余的连接时间
+func (q *quotaTracker) end(sess *session) {
+	if sess.quota == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if last, ok := q.sessions[sess]; ok {
+		q.addTime(sess.user, time.Since(last), time.Now())
+		delete(q.sessions, sess)
+	}
+}
+
+// addTime 累计连接时间，调用方需持有锁
+func (q *quotaTracker) addTime(user string, d time.Duration, now time.Time) {
+	u := q.usageFor(user, q.limitFor(user), now)
+	u.Time += d
+	q.dirty = true
+}
+
+// addBytes 累计转发字节数，配额用完且配置了 cut_off 时返回true
+func (q *quotaTracker) addBytes(user string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	u := q.usageFor(user, q.limitFor(user), now)
+	u.Bytes += n
+	q.dirty = true
+	if !q.cfg.CutOff {
+		return false
+	}
+	_, exhausted := q.exhausted(user, now)
+	return exhausted
+}
+
+// check 累计进行中会话的连接时间，返回配额已用完需要断开的会话
+func (q *quotaTracker) check() []*session {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for sess, last := range q.sessions {
+		q.addTime(sess.user, now.Sub(last), now)
+		q.sessions[sess] = now
+	}
+	if !q.cfg.CutOff {
+		return nil
+	}
+	var cut []*session
+	for sess := range q.sessions {
+		if _, exhausted := q.exhausted(sess.user, now); exhausted {
+			cut = append(cut, sess)
+		}
+	}
+	return cut
+}
+
+// run 定期累计连接时间、断开超额会话并保存用量，ctx 结束时返回
+func (q *quotaTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, sess := range q.check() {
+				if sess.close(closeQuota) {
+					auditLog(sess.log, "配额已用完，断开会话", "user", sess.user)
+				}
+			}
+			q.save()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// save 用量有变化时写入状态文件
+func (q *quotaTracker) save() {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	q.mu.Lock()
+	if !q.dirty || q.cfg.StateFile == "" {
+		q.mu.Unlock()
+		return
+	}
+	path := q.cfg.StateFile
+	logger := q.logger()
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		logger.Error("序列化配额用量失败", "error", err)
+		return
+	}
+
+	// 先写临时文件再重命名，避免写到一半时进程退出导致文件损坏
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		logger.Error("保存配额用量失败", "path", path, "error", err)
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+}
+
+// reset 清零用户的用量
+func (q *quotaTracker) reset(user string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.usage[user]; !ok {
+		return false
+	}
+	delete(q.usage, user)
+	now := time.Now()
+	for sess := range q.sessions {
+		if sess.user == user {
+			q.sessions[sess] = now
+		}
+	}
+	q.dirty = true
+	return true
+}
+
+// status 返回用户配额的使用情况，users 为需要列出的用户（如用户存储中的全部用户）
+func (q *quotaTracker) status(users []string) []server.QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.usage == nil {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, name := range users {
+		names[name] = true
+	}
+	for name := range q.usage {
+		names[name] = true
+	}
+	for name := range q.cfg.Users {
+		names[name] = true
+	}
+
+	now := time.Now()
+	list := make([]server.QuotaStatus, 0, len(names))
+	for name := range names {
+		limit := q.limitFor(name)
+		// 只查询不创建用量记录，没有用量的用户不写入状态文件
+		var u quotaUsage
+		exhausted := false
+		if _, ok := q.usage[name]; ok {
+			u = *q.usageFor(name, limit, now)
+			_, exhausted = q.exhausted(name, now)
+		}
+		list = append(list, server.QuotaStatus{
+			User:       name,
+			Period:     limit.Period,
+			BytesUsed:  u.Bytes,
+			BytesLimit: limit.Bytes,
+			ResetAt:    periodEnd(limit.Period, now),
+			TimeUsed:   int64(u.Time / time.Second),
+			TimeLimit:  int64(limit.DailyTime / time.Second),
+			Exhausted:  exhausted,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].User < list[j].User })
+	return list
+}
+
+// loadQuotaUsage 读取状态文件，path 为空或文件不存在时返回空用量
+func loadQuotaUsage(path string, logger *slog.Logger) (map[string]*quotaUsage, error) {
+	usage := make(map[string]*quotaUsage)
+	if path == "" {
+		return usage, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("解析配额状态文件 %s 失败: %v", path, err)
+	}
+	for name, u := range usage {
+		if u == nil {
+			delete(usage, name)
+		}
+	}
+	logger.Info("已加载配额用量", "path", path, "users", len(usage))
+	return usage, nil
+}
+
+// periodStart 返回 now 所在周期的开始时间（本地时间），周为周一开始
+func periodStart(period string, now time.Time) time.Time {
+	y, m, d := now.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	switch period {
+	case QuotaDay:
+		return day
+	case QuotaWeek:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	default:
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	}
+}
+
+// periodEnd 返回 now 所在周期的结束时间，即下一周期的开始
+func periodEnd(period string, now time.Time) time.Time {
+	start := periodStart(period, now)
+	switch period {
+	case QuotaDay:
+		return start.AddDate(0, 0, 1)
+	case QuotaWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
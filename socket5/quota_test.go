@@ -0,0 +1,133 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestQuotaBeginSkipsUnlimitedUsers(t *testing.T) {
+	var q quotaTracker
+	if err := q.set(server.QuotaConfig{
+		Users: map[string]server.QuotaLimit{
+			"limited": {Bytes: 100},
+			"timed":   {DailyTime: time.Hour},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user    string
+		tracked bool
+	}{
+		{"", false},
+		{"unlimited", false},
+		{"limited", true},
+		{"timed", true},
+	}
+	for _, tt := range tests {
+		sess := &session{user: tt.user}
+		if _, ok := q.begin(sess); !ok {
+			t.Fatalf("%q: begin 拒绝了会话", tt.user)
+		}
+		if tracked := sess.quota != nil; tracked != tt.tracked {
+			t.Errorf("%q: tracked = %v, want %v", tt.user, tracked, tt.tracked)
+		}
+		q.end(sess)
+		if _, ok := q.usage[tt.user]; ok != tt.tracked {
+			t.Errorf("%q: 用量记录存在 = %v, want %v", tt.user, ok, tt.tracked)
+		}
+	}
+
+	// 超过配额后拒绝新会话
+	if q.addBytes("limited", 100) {
+		t.Error("未配置 cut_off 时不应断开")
+	}
+	if reason, ok := q.begin(&session{user: "limited"}); ok || reason == "" {
+		t.Errorf("配额用完后 begin = %q, %v", reason, ok)
+	}
+}
+
+func TestQuotaPeriods(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	// 2026-01-07 是周三
+	now := time.Date(2026, 1, 7, 15, 30, 0, 0, loc)
+	tests := []struct {
+		period     string
+		start, end time.Time
+	}{
+		{QuotaDay, time.Date(2026, 1, 7, 0, 0, 0, 0, loc), time.Date(2026, 1, 8, 0, 0, 0, 0, loc)},
+		{QuotaWeek, time.Date(2026, 1, 5, 0, 0, 0, 0, loc), time.Date(2026, 1, 12, 0, 0, 0, 0, loc)},
+		{QuotaMonth, time.Date(2026, 1, 1, 0, 0, 0, 0, loc), time.Date(2026, 2, 1, 0, 0, 0, 0, loc)},
+		{"", time.Date(2026, 1, 1, 0, 0, 0, 0, loc), time.Date(2026, 2, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		if got := periodStart(tt.period, now); !got.Equal(tt.start) {
+			t.Errorf("periodStart(%q) = %v, want %v", tt.period, got, tt.start)
+		}
+		if got := periodEnd(tt.period, now); !got.Equal(tt.end) {
+			t.Errorf("periodEnd(%q) = %v, want %v", tt.period, got, tt.end)
+		}
+	}
+
+	// 周日属于以上周一开始的一周
+	sunday := time.Date(2026, 1, 11, 23, 0, 0, 0, loc)
+	if got := periodStart(QuotaWeek, sunday); !got.Equal(time.Date(2026, 1, 5, 0, 0, 0, 0, loc)) {
+		t.Errorf("periodStart(week, 周日) = %v", got)
+	}
+}
+
+func TestValidateQuotas(t *testing.T) {
+	tests := []struct {
+		cfg     server.QuotaConfig
+		wantErr bool
+	}{
+		{server.QuotaConfig{}, false},
+		{server.QuotaConfig{Default: server.QuotaLimit{Bytes: 1 << 30, Period: QuotaWeek}}, false},
+		{server.QuotaConfig{Default: server.QuotaLimit{Bytes: -1}}, true},
+		{server.QuotaConfig{Default: server.QuotaLimit{Period: "year"}}, true},
+		{server.QuotaConfig{Users: map[string]server.QuotaLimit{"alice": {DailyTime: -time.Second}}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateQuotas(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("validateQuotas(%+v) = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestQuotaExhaustedResetsEachPeriod(t *testing.T) {
+	var q quotaTracker
+	if err := q.set(server.QuotaConfig{
+		Default: server.QuotaLimit{Bytes: 100, Period: QuotaDay, DailyTime: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 7, 12, 0, 0, 0, time.Local)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tests := []struct {
+		name   string
+		bytes  int64
+		time   time.Duration
+		now    time.Time
+		reason string
+	}{
+		{"未用完", 99, 0, day, ""},
+		{"流量用完", 1, 0, day, "流量配额已用完"},
+		{"下一周期清零", 0, 0, day.AddDate(0, 0, 1), ""},
+		{"连接时间用完", 0, time.Hour, day.AddDate(0, 0, 1), "当天连接时间已用完"},
+		{"第二天清零", 0, 0, day.AddDate(0, 0, 2), ""},
+	}
+	for _, tt := range tests {
+		u := q.usageFor("alice", q.limitFor("alice"), tt.now)
+		u.Bytes += tt.bytes
+		u.Time += tt.time
+		reason, exhausted := q.exhausted("alice", tt.now)
+		if reason != tt.reason || exhausted != (tt.reason != "") {
+			t.Errorf("%s: exhausted = %q, %v, want %q", tt.name, reason, exhausted, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"go-socket5/server"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 默认子网前缀长度
+const (
+	defaultSubnetV4 = 24
+	defaultSubnetV6 = 64
+)
+
+// rateLimitSweepInterval 清理空闲令牌桶的间隔
+const rateLimitSweepInterval = time.Minute
+
+// rateBucket 单个键的令牌桶
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// keyedLimiter 按键计算的令牌桶限流器，令牌在取用时按流逝时间补充，不需要后台补充
+type keyedLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// burstOf 返回桶容量
+func burstOf(limit server.RateLimit) float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, limit.Rate)
+}
+
+// allow 取一个令牌，令牌不足时返回false
+func (l *keyedLimiter) allow(key string, limit server.RateLimit, now time.Time) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	burst := burstOf(limit)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBucket)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &rateBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep 删除已经补满的令牌桶，补满的桶与不存在的桶行为一致，删除不影响限流结果
+func (l *keyedLimiter) sweep(limit server.RateLimit, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit.Rate <= 0 {
+		l.buckets = nil
+		return
+	}
+	burst := burstOf(limit)
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// connLimiter 新连接速率限制，按来源IP、来源子网和认证用户分别计算
+type connLimiter struct {
+	cfg    atomic.Pointer[server.RateLimitConfig]
+	ip     keyedLimiter
+	subnet keyedLimiter
+	user   keyedLimiter
+}
+
+// validateRateLimits 检查速率限制配置
+func validateRateLimits(cfg server.RateLimitConfig) error {
+	for name, limit := range map[string]server.RateLimit{
+		"per_ip": cfg.PerIP, "per_subnet": cfg.PerSubnet, "per_user": cfg.PerUser,
+	} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("%s 的速率限制不能为负数", name)
+		}
+	}
+	if cfg.SubnetV4 < 0 || cfg.SubnetV4 > 32 {
+		return fmt.Errorf("subnet_v4 必须在 0-32 之间: %d", cfg.SubnetV4)
+	}
+	if cfg.SubnetV6 < 0 || cfg.SubnetV6 > 128 {
+		return fmt.Errorf("subnet_v6 必须在 0-128 之间: %d", cfg.SubnetV6)
+	}
+	return nil
+}
+
+// set 替换速率限制配置，已有的令牌桶保留
+func (c *connLimiter) set(cfg server.RateLimitConfig) error {
+	if err := validateRateLimits(cfg); err != nil {
+		return err
+	}
+	old := c.cfg.Load()
+	c.cfg.Store(&cfg)
+	// 子网前缀变化后原来的键失去意义
+	if old != nil && (old.SubnetV4 != cfg.SubnetV4 || old.SubnetV6 != cfg.SubnetV6) {
+		c.subnet.mu.Lock()
+		c.subnet.buckets = nil
+		c.subnet.mu.Unlock()
+	}
+	return nil
+}
+
+// get 返回当前的速率限制配置
+func (c *connLimiter) get() server.RateLimitConfig {
+	if cfg := c.cfg.Load(); cfg != nil {
+		return *cfg
+	}
+	return server.RateLimitConfig{}
+}
+
+// allowAddr 检查来源IP和来源子网的速率限制，返回被限制的维度
+func (c *connLimiter) allowAddr(addr net.Addr) (string, bool) {
+	cfg := c.cfg.Load()
+	if cfg == nil {
+		return "", true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", true
+	}
+	now := time.Now()
+	if !c.ip.allow(tcpAddr.IP.String(), cfg.PerIP, now) {
+		return "ip", false
+	}
+	if !c.subnet.allow(subnetKey(tcpAddr.IP, cfg), cfg.PerSubnet, now) {
+		return "subnet", false
+	}
+	return "", true
+}
+
+// allowUser 检查认证用户的速率限制，未认证的会话不受限制
+func (c *connLimiter) allowUser(user string) bool {
+	cfg := c.cfg.Load()
+	if cfg == nil || user == "" {
+		return true
+	}
+	return c.user.allow(user, cfg.PerUser, time.Now())
+}
+
+// run 定期清理空闲的令牌桶，ctx 结束时返回
+func (c *connLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			cfg := c.get()
+			c.ip.sweep(cfg.PerIP, now)
+			c.subnet.sweep(cfg.PerSubnet, now)
+			c.user.sweep(cfg.PerUser, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subnetKey 返回IP所在子网，作为子网限流的键
+func subnetKey(ip net.IP, cfg *server.RateLimitConfig) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := cfg.SubnetV4
+		if bits == 0 {
+			bits = defaultSubnetV4
+		}
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(bits, 32)), Mask: net.CIDRMask(bits, 32)}).String()
+	}
+	bits := cfg.SubnetV6
+	if bits == 0 {
+		bits = defaultSubnetV6
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(bits, 128)), Mask: net.CIDRMask(bits, 128)}).String()
+}
@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestKeyedLimiterAllow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		limit server.RateLimit
+		steps []time.Duration // 每次请求相对 start 的时间
+		want  []bool
+	}{
+		{"不限制", server.RateLimit{}, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+		{"突发用完后拒绝", server.RateLimit{Rate: 1, Burst: 2}, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"按时间补充", server.RateLimit{Rate: 2, Burst: 1}, []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond}, []bool{true, false, false, true}},
+		{"补充不超过容量", server.RateLimit{Rate: 10, Burst: 2}, []time.Duration{0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, false}},
+		{"默认容量为速率", server.RateLimit{Rate: 3}, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"小于1的速率容量为1", server.RateLimit{Rate: 0.5}, []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l keyedLimiter
+			for i, step := range tt.steps {
+				if got := l.allow("k", tt.limit, start.Add(step)); got != tt.want[i] {
+					t.Errorf("第 %d 次请求 = %v, want %v", i+1, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyedLimiterKeysAndSweep(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit := server.RateLimit{Rate: 1, Burst: 1}
+	var l keyedLimiter
+	if !l.allow("a", limit, now) || l.allow("a", limit, now) {
+		t.Fatal("a 的令牌桶不符合预期")
+	}
+	if !l.allow("b", limit, now) {
+		t.Fatal("不同的键应使用独立的令牌桶")
+	}
+
+	// 未补满的桶保留，补满后删除
+	l.sweep(limit, now.Add(500*time.Millisecond))
+	if len(l.buckets) != 2 {
+		t.Fatalf("buckets = %d, want 2", len(l.buckets))
+	}
+	l.sweep(limit, now.Add(time.Second))
+	if len(l.buckets) != 0 {
+		t.Fatalf("buckets = %d, want 0", len(l.buckets))
+	}
+}
+
+func TestSubnetKey(t *testing.T) {
+	tests := []struct {
+		ip   string
+		cfg  server.RateLimitConfig
+		want string
+	}{
+		{"192.0.2.77", server.RateLimitConfig{}, "192.0.2.0/24"},
+		{"192.0.2.77", server.RateLimitConfig{SubnetV4: 16}, "192.0.0.0/16"},
+		{"::ffff:192.0.2.77", server.RateLimitConfig{}, "192.0.2.0/24"},
+		{"2001:db8:1:2:3::1", server.RateLimitConfig{}, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3::1", server.RateLimitConfig{SubnetV6: 48}, "2001:db8:1::/48"},
+	}
+	for _, tt := range tests {
+		if got := subnetKey(net.ParseIP(tt.ip), &tt.cfg); got != tt.want {
+			t.Errorf("subnetKey(%s, %+v) = %s, want %s", tt.ip, tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	tests := []struct {
+		cfg     server.RateLimitConfig
+		wantErr bool
+	}{
+		{server.RateLimitConfig{}, false},
+		{server.RateLimitConfig{PerIP: server.RateLimit{Rate: 5, Burst: 10}, SubnetV4: 32, SubnetV6: 128}, false},
+		{server.RateLimitConfig{PerUser: server.RateLimit{Rate: -1}}, true},
+		{server.RateLimitConfig{PerSubnet: server.RateLimit{Burst: -1}}, true},
+		{server.RateLimitConfig{SubnetV4: 33}, true},
+		{server.RateLimitConfig{SubnetV6: -1}, true},
+	}
+	for _, tt := range tests {
+		if err := validateRateLimits(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("validateRateLimits(%+v) = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
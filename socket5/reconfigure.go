@@ -0,0 +1,306 @@
+package socks5
+
+import (
+	"fmt"
+	"go-socket5/server"
+	"time"
+)
+
+// defaultRestartTimeout 未配置 shutdown_timeout 时重启等待会话结束的时间
+const defaultRestartTimeout = 30 * time.Second
+
+// 重启的阶段，通过 Restart 的 progress 回调报告
+const (
+	RestartStarting = "starting" // 关闭原监听器，按新配置初始化并监听
+	RestartDraining = "draining" // 新监听器已开始接受连接，等待重启前的会话结束
+	RestartStopping = "stopping" // 新监听器已开始接受连接，正在关闭重启前的会话
+)
+
+// ConfigFromSocks5 将配置文件中的 socks5 配置转换为服务器配置
+func ConfigFromSocks5(cfg server.Socks5Config) Config {
+	return Config{
+		Host:             cfg.Host,
+		Port:             uint16(cfg.Port),
+		BlackList:        cfg.BlackList,
+		ResolveBlackList: cfg.BlackListResolve,
+		AuthList:         toUint8Slice(cfg.AuthList),
+
+		HandshakeTimeout:   cfg.HandshakeTimeout,
+		DialTimeout:        cfg.DialTimeout,
+		IdleTimeout:        cfg.IdleTimeout,
+		MaxSessionLifetime: cfg.MaxSessionLifetime,
+
+		Bandwidth: cfg.Bandwidth,
+		Quotas:    cfg.Quotas,
+
+		RateLimits:  cfg.RateLimits,
+		Concurrency: cfg.Concurrency,
+		BruteForce:  cfg.BruteForce,
+
+		AccessLog: cfg.AccessLog,
+	}
+}
+
+// toUint8Slice 将[]int转[]uint8
+func toUint8Slice(arr []int) []uint8 {
+	r := make([]uint8, len(arr))
+	for i, v := range arr {
+		r[i] = uint8(v)
+	}
+	return r
+}
+
+// ValidateConfig 检查配置文件中的 socks5 配置，不修改运行中的服务器
+// 用户文件会被读取一次，访问日志文件不会被打开
+func ValidateConfig(cfg server.Socks5Config) error {
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("无效的端口: %d", cfg.Port)
+	}
+	for _, method := range cfg.AuthList {
+		if method != NoAuthenticationRequired && method != AccountPasswordAuthentication {
+			return fmt.Errorf("不支持的认证方法: %d", method)
+		}
+	}
+	if _, err := NewUserStoreFromConfig(cfg, nil); err != nil {
+		return fmt.Errorf("用户配置错误: %v", err)
+	}
+	if _, err := ParseRules(cfg.BlackList); err != nil {
+		return fmt.Errorf("黑名单配置错误: %v", err)
+	}
+	if err := validateBandwidth(cfg.Bandwidth); err != nil {
+		return fmt.Errorf("带宽限制配置错误: %v", err)
+	}
+	if err := validateQuotas(cfg.Quotas); err != nil {
+		return fmt.Errorf("配额配置错误: %v", err)
+	}
+	if err := validateRateLimits(cfg.RateLimits); err != nil {
+		return fmt.Errorf("速率限制配置错误: %v", err)
+	}
+	if err := validateConcurrency(cfg.Concurrency); err != nil {
+		return fmt.Errorf("并发上限配置错误: %v", err)
+	}
+	if err := validateBruteForce(cfg.BruteForce); err != nil {
+		return fmt.Errorf("暴力破解防护配置错误: %v", err)
+	}
+	if _, err := validateAccessLog(cfg.AccessLog); err != nil {
+		return fmt.Errorf("访问日志配置错误: %v", err)
+	}
+	return nil
+}
+
+// ApplyConfig 将配置文件中的 socks5 配置应用到运行中的服务器，只应用 fields 中列出的配置项（yaml 键名）
+// 先检查全部配置并打开需要的文件，有错误时不修改任何配置；不能热更新的配置项（超时等）被忽略
+// 应用后的配置同步到 Config 和 Users，重新 Start 时继续使用
+func (s *Server) ApplyConfig(cfg server.Socks5Config, fields []string) error {
+	if err := ValidateConfig(cfg); err != nil {
+		return err
+	}
+	changed := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		changed[field] = true
+	}
+	next := ConfigFromSocks5(cfg)
+
+	// 用户文件、配额状态文件和访问日志先加载或打开，此时运行中的配置不变
+	var commits []func()
+	discard := func() {}
+	if changed["user"] || changed["password"] || changed["users"] || changed["users_file"] || changed["htpasswd_file"] {
+		store, err := NewUserStoreFromConfig(cfg, s.logger())
+		if err != nil {
+			return err
+		}
+		commits = append(commits, func() {
+			s.SetUsers(store)
+			s.mu.Lock()
+			s.Users = store
+			s.mu.Unlock()
+			s.logger().Info("已重新加载用户")
+		})
+	}
+	if changed["quotas"] {
+		commit, err := s.prepareQuotas(next.Quotas)
+		if err != nil {
+			return fmt.Errorf("应用 quotas 失败: %v", err)
+		}
+		commits = append(commits, func() {
+			commit()
+			s.mu.Lock()
+			s.Config.Quotas = next.Quotas
+			s.mu.Unlock()
+		})
+	}
+	if changed["access_log"] {
+		commit, cancel, err := s.prepareAccessLog(next.AccessLog)
+		if err != nil {
+			return fmt.Errorf("应用 access_log 失败: %v", err)
+		}
+		discard = cancel
+		commits = append(commits, func() {
+			commit()
+			s.mu.Lock()
+			s.Config.AccessLog = next.AccessLog
+			s.mu.Unlock()
+		})
+	}
+
+	// 监听地址是最后一个可能失败的步骤，监听失败时 SetListenAddr 恢复原监听器
+	if changed["host"] || changed["port"] {
+		if err := s.SetListenAddr(next.Host, next.Port); err != nil {
+			discard()
+			return err
+		}
+	}
+	for _, commit := range commits {
+		commit()
+	}
+
+	// 其余配置项只在内存中替换，已经通过 ValidateConfig 检查，不会失败
+	steps := []struct {
+		field string
+		apply func() error
+		save  func(c *Config)
+	}{
+		{"auth_list", func() error { return s.SetAuthList(next.AuthList) }, func(c *Config) { c.AuthList = next.AuthList }},
+		{"blacklist", func() error { return s.SetBlackList(next.BlackList) }, func(c *Config) { c.BlackList = next.BlackList }},
+		{"blacklist_resolve", func() error { s.SetResolveBlackList(next.ResolveBlackList); return nil },
+			func(c *Config) { c.ResolveBlackList = next.ResolveBlackList }},
+		{"bandwidth", func() error { return s.SetBandwidth(next.Bandwidth) }, func(c *Config) { c.Bandwidth = next.Bandwidth }},
+		{"rate_limits", func() error { return s.SetRateLimits(next.RateLimits) }, func(c *Config) { c.RateLimits = next.RateLimits }},
+		{"concurrency", func() error { return s.SetConcurrency(next.Concurrency) }, func(c *Config) { c.Concurrency = next.Concurrency }},
+		{"brute_force", func() error { return s.SetBruteForce(next.BruteForce) }, func(c *Config) { c.BruteForce = next.BruteForce }},
+	}
+	for _, step := range steps {
+		if !changed[step.field] {
+			continue
+		}
+		if err := step.apply(); err != nil {
+			return fmt.Errorf("应用 %s 失败: %v", step.field, err)
+		}
+		s.mu.Lock()
+		step.save(&s.Config)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Restart 在进程内按 cfg 重启服务器，新监听器开始接受连接后返回其地址
+// 先关闭原监听器并按新配置监听，再处理重启前的会话：drain 为 true 时等待会话结束，超过 shutdown_timeout 后强制关闭；否则立即关闭
+// 返回的 wait 等待重启前的会话全部结束，期间新会话正常处理；没有重启前的会话时 wait 为 nil
+// cfg 有错误时不停止服务器；按新配置监听失败时恢复原配置重新监听，重启前的会话不受影响，并返回错误
+// progress 非nil时在进入每个阶段时调用
+func (s *Server) Restart(cfg server.Socks5Config, drain bool, progress func(phase string)) (string, func(), error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		return "", nil, err
+	}
+	users, err := NewUserStoreFromConfig(cfg, s.logger())
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 停止原监听器和后台任务，重启前的会话继续运行
+	progress(RestartStarting)
+	logger := s.logger()
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.listen != nil {
+		s.listen.Close()
+		s.listen = nil
+	}
+	old := make(map[*session]struct{}, len(s.sessions))
+	for sess := range s.sessions {
+		old[sess] = struct{}{}
+	}
+	oldConfig, oldUsers := s.Config, s.Users
+	s.Config, s.Users = ConfigFromSocks5(cfg), users
+	s.mu.Unlock()
+	// 配额状态文件可能变化，先保存当前用量
+	s.quotas.save()
+
+	listener, serveCtx, err := s.listenAndInit()
+	if err != nil {
+		logger.Error("按新配置启动失败，恢复原配置", "error", err)
+		s.mu.Lock()
+		s.Config, s.Users = oldConfig, oldUsers
+		s.mu.Unlock()
+		if listener, serveCtx, restoreErr := s.listenAndInit(); restoreErr != nil {
+			logger.Error("按原配置启动失败", "error", restoreErr)
+		} else if listener != nil {
+			go s.serve(serveCtx, listener)
+		}
+		return "", nil, err
+	}
+	if listener == nil {
+		return "", nil, fmt.Errorf("服务器已关闭")
+	}
+	go s.serve(serveCtx, listener)
+
+	retired := s.retireSessions(old)
+	if retired == nil {
+		return listener.Addr().String(), nil, nil
+	}
+	timeout := cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultRestartTimeout
+	}
+	if drain {
+		progress(RestartDraining)
+		logger.Info("新监听器已开始接受连接，等待重启前的会话结束", "sessions", len(old), "timeout", timeout)
+	} else {
+		progress(RestartStopping)
+		logger.Info("新监听器已开始接受连接，关闭重启前的会话", "sessions", len(old))
+		s.closeRetiring()
+	}
+	wait := func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-retired:
+			logger.Info("重启前的会话已全部结束")
+			return
+		case <-timer.C:
+		}
+		logger.Warn("等待会话结束超时，强制关闭重启前的会话")
+		s.closeRetiring()
+		<-retired
+	}
+	return listener.Addr().String(), wait, nil
+}
+
+// retireSessions 将仍在进行中的 sessions 标记为重启前的会话，返回的通道在它们全部结束时关闭
+// 都已结束时返回nil
+func (s *Server) retireSessions(sessions map[*session]struct{}) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range sessions {
+		if _, ok := s.sessions[sess]; !ok {
+			continue
+		}
+		if s.retiring == nil {
+			s.retiring = make(map[*session]struct{})
+			s.retired = make(chan struct{})
+		}
+		s.retiring[sess] = struct{}{}
+	}
+	if s.retiring == nil {
+		return nil
+	}
+	return s.retired
+}
+
+// closeRetiring 关闭所有重启前的会话
+func (s *Server) closeRetiring() {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.retiring))
+	for sess := range s.retiring {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+	for _, sess := range sessions {
+		sess.close(closeShutdown)
+	}
+}
@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-socket5/server"
+)
+
+func TestApplyConfigAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	badState := filepath.Join(dir, "quota.json")
+	if err := os.WriteFile(badState, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	base := server.Socks5Config{Host: "127.0.0.1", User: "alice", Password: "secret", AuthList: []int{2}}
+	s := startServer(t, base)
+	addr := s.listener().Addr().String()
+
+	tests := []struct {
+		name   string
+		modify func(cfg *server.Socks5Config)
+		fields []string
+	}{
+		{"访问日志无法打开", func(cfg *server.Socks5Config) {
+			cfg.AccessLog.Path = filepath.Join(dir, "missing", "access.log")
+		}, []string{"users", "blacklist", "auth_list", "access_log"}},
+		{"配额状态文件损坏", func(cfg *server.Socks5Config) {
+			cfg.Quotas.StateFile = badState
+		}, []string{"users", "blacklist", "auth_list", "quotas"}},
+		{"监听失败", func(cfg *server.Socks5Config) {
+			cfg.Host = "192.0.2.1"
+			cfg.AccessLog.Path = filepath.Join(dir, "access.log")
+		}, []string{"users", "blacklist", "auth_list", "access_log", "host"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Users = []server.UserConfig{{Username: "bob", Password: "secret"}}
+			cfg.BlackList = []string{"example.com"}
+			cfg.AuthList = []int{0}
+			tt.modify(&cfg)
+			before := s.Config
+
+			if err := s.ApplyConfig(cfg, tt.fields); err == nil {
+				t.Fatal("ApplyConfig 应当失败")
+			}
+			if !reflect.DeepEqual(s.Config, before) {
+				t.Errorf("Config 被修改: %+v", s.Config)
+			}
+			if s.rules.Load().Len() != 0 {
+				t.Error("黑名单已生效")
+			}
+			if s.userStore().Authenticate("bob", "secret") || !s.userStore().Authenticate("alice", "secret") {
+				t.Error("用户已替换")
+			}
+			if got := *s.authList.Load(); !reflect.DeepEqual(got, []uint8{2}) {
+				t.Errorf("认证方法已替换: %v", got)
+			}
+			if s.listener().Addr().String() != addr {
+				t.Errorf("监听地址已修改: %s", s.listener().Addr())
+			}
+			if s.AccessLog().Path != "" {
+				t.Errorf("访问日志已替换: %+v", s.AccessLog())
+			}
+		})
+	}
+
+	cfg := base
+	cfg.BlackList = []string{"example.com"}
+	cfg.AccessLog.Path = filepath.Join(dir, "access.log")
+	if err := s.ApplyConfig(cfg, []string{"blacklist", "access_log"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.rules.Load().Len() != 1 || s.AccessLog().Path != cfg.AccessLog.Path {
+		t.Error("配置未生效")
+	}
+}
+
+func TestReloadConfigKeepsOldConfigOnError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	data, err := os.ReadFile("../config/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := strings.NewReplacer("host: 0.0.0.0", "host: 127.0.0.1", "port: 1080", "port: 0").Replace(string(data))
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startServer(t, cfg.Socks5)
+	server.SetProxyController(s)
+	server.SetLiveConfig(path, cfg)
+
+	// 新用户和黑名单有效，但访问日志无法打开
+	broken := strings.NewReplacer(
+		"password: test", "password: changed",
+		"blacklist: []", "blacklist: [example.com]",
+		`path: "" # 访问日志路径`, `path: "`+filepath.Join(dir, "missing", "access.log")+`" # 访问日志路径`,
+	).Replace(original)
+	if err := os.WriteFile(path, []byte(broken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ReloadConfig(); err == nil {
+		t.Fatal("ReloadConfig 应当失败")
+	}
+	if !s.userStore().Authenticate("test", "test") || s.userStore().Authenticate("test", "changed") {
+		t.Error("用户已替换")
+	}
+	if s.rules.Load().Len() != 0 {
+		t.Error("黑名单已生效")
+	}
+	live, _ := server.LiveSocks5Config()
+	if live.Password != "test" || len(live.BlackList) != 0 || live.AccessLog.Path != "" {
+		t.Errorf("运行中的配置被修改: %+v", live)
+	}
+
+	// 修正后重新加载全部生效
+	fixed := strings.Replace(broken, filepath.Join(dir, "missing", "access.log"), filepath.Join(dir, "access.log"), 1)
+	if err := os.WriteFile(path, []byte(fixed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	update, err := server.ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.userStore().Authenticate("test", "changed") || s.rules.Load().Len() != 1 {
+		t.Errorf("配置未生效: %+v", update)
+	}
+}
@@ -0,0 +1,176 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 转发参数
+const (
+	relayBufferSize  = 32 * 1024  // 逐块复制的缓冲区大小
+	relaySpliceChunk = 256 * 1024 // splice 每次最多转发的字节数，转发完一段统计一次
+)
+
+// relayBufferPool 转发缓冲区池，避免每个会话分配新的缓冲区
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// closeWriter 支持半关闭的连接，如 *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay 在客户端和目标之间双向转发数据，两个方向都结束后返回
+// 一个方向读到EOF后对写入端执行半关闭（CloseWrite），反方向继续转发，直到对端也关闭
+// 任一方向出错时关闭两端连接，让另一个方向尽快结束
+func (s *Server) relay(sess *session, client *bufferedConn, target net.Conn) {
+	// 进入转发阶段，取消握手阶段设置的超时
+	client.SetDeadline(time.Time{})
+
+	shape := s.bandwidth.open(sess.user, sess.done)
+	defer shape.close()
+
+	// 需要按数据块刷新空闲计时或限速时不使用 splice，一段转发完成前无法得知活动情况
+	fast := sess.timeouts.idle <= 0 && !shape.limited() && isTCPConn(client) && isTCPConn(target)
+
+	var wg sync.WaitGroup
+	var up, down int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		up = copyHalf(target, client, fast, halfStats{
+			count: func(n int64) { sess.addBytes(n, 0) },
+			wait:  func(n int) bool { return shape.wait(n, true) },
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		down = copyHalf(client, target, fast, halfStats{
+			count: func(n int64) { sess.addBytes(0, n) },
+			wait:  func(n int) bool { return shape.wait(n, false) },
+		})
+	}()
+	wg.Wait()
+
+	sess.log.Info("转发结束", "up", up, "down", down, "duration", time.Since(sess.start).Round(time.Millisecond))
+}
+
+// halfStats 单个转发方向的计数和限速回调
+type halfStats struct {
+	count func(int64)    // 累加已转发的字节数
+	wait  func(int) bool // 转发前等待带宽令牌，会话被终止时返回false
+}
+
+// copyHalf 单向复制 src 到 dst，结束后半关闭 dst，返回复制的字节数
+func copyHalf(dst, src net.Conn, fast bool, stats halfStats) int64 {
+	var written int64
+	var err error
+	if fast {
+		written, err = copySplice(dst, src, stats.count)
+	} else {
+		written, err = copyBuffered(dst, src, stats)
+	}
+
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		// 出错时关闭两端，避免另一个方向一直阻塞
+		dst.Close()
+		src.Close()
+		return written
+	}
+	closeWrite(dst)
+	return written
+}
+
+// copySplice 两端都是TCP连接时使用 io.Copy 复制，Linux上会使用 splice 零拷贝
+// 每次最多转发 relaySpliceChunk 字节，转发完一段就统计一次，连接统计不会等到会话结束才更新
+func copySplice(dst, src net.Conn, count func(int64)) (int64, error) {
+	var written int64
+	dstConn, srcConn := unwrapConn(dst), src
+
+	// 握手阶段已读入缓冲区的数据需要先发出
+	if bc, ok := src.(*bufferedConn); ok {
+		if n := bc.reader.Buffered(); n > 0 {
+			buffered, _ := bc.reader.Peek(n)
+			m, err := dstConn.Write(buffered)
+			bc.reader.Discard(m)
+			written += int64(m)
+			count(int64(m))
+			if err != nil {
+				return written, err
+			}
+		}
+		srcConn = bc.Conn
+	}
+
+	for {
+		// *net.TCPConn 的 ReadFrom 对包装了TCP连接的 *io.LimitedReader 同样使用 splice
+		n, err := io.Copy(dstConn, &io.LimitedReader{R: srcConn, N: relaySpliceChunk})
+		if n > 0 {
+			written += n
+			count(n)
+		}
+		if err != nil || n < relaySpliceChunk {
+			// 未读满一段且没有错误说明读到了EOF
+			return written, err
+		}
+	}
+}
+
+// copyBuffered 使用池化缓冲区逐块复制，每块数据写出前等待带宽令牌，写出后计数并刷新活动时间
+func copyBuffered(dst, src net.Conn, stats halfStats) (int64, error) {
+	bufp := relayBufferPool.Get().(*[]byte)
+	defer relayBufferPool.Put(bufp)
+	buf := *bufp
+
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !stats.wait(n) {
+				return written, net.ErrClosed
+			}
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			stats.count(int64(m))
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// unwrapConn 返回带缓冲连接内部的原始连接，写入时不需要经过缓冲
+func unwrapConn(c net.Conn) net.Conn {
+	if bc, ok := c.(*bufferedConn); ok {
+		return bc.Conn
+	}
+	return c
+}
+
+// isTCPConn 是否为TCP连接（带缓冲连接按内部连接判断）
+func isTCPConn(c net.Conn) bool {
+	_, ok := unwrapConn(c).(*net.TCPConn)
+	return ok
+}
+
+// closeWrite 半关闭连接的写方向，不支持半关闭时直接关闭
+func closeWrite(c net.Conn) {
+	if cw, ok := unwrapConn(c).(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
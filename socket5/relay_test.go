@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", User: "alice", Password: "secret", AuthList: []int{2}})
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port, UserName: "alice", Password: "secret"}
+	proxy, err := client.UdpProxy("127.0.0.1", uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	relay := proxy.UdpConn.RemoteAddr().(*net.UDPAddr)
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	for _, msg := range []string{"ping", "pong"} {
+		reply, err := proxy.SendAndReceiveUdpPacket([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != "echo:"+msg {
+			t.Errorf("reply = %q, want %q", reply, "echo:"+msg)
+		}
+		// 客户端没有发送过数据的来源不能向客户端注入数据报
+		if _, err := stranger.WriteToUDP([]byte("inject"), relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	proxy.UdpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if data, err := proxy.ReceiveUdpPacket(); err == nil {
+		t.Errorf("收到未知来源的数据报 %q", data)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}, IdleTimeout: 200 * time.Millisecond})
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port}
+
+	conn, err := client.TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 两个方向都没有数据时会话在空闲超时后被关闭
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("会话没有在空闲超时后关闭: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("会话在 %v 后关闭，早于空闲超时", elapsed)
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	// 目标读到 EOF 后才应答，客户端半关闭后仍能收到数据
+	target := startTarget(t, func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got:"), data...))
+	})
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}})
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port}
+
+	conn, err := client.TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := bytes.Repeat([]byte("x"), 256<<10)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("got:"), payload...); !bytes.Equal(reply, want) {
+		t.Errorf("收到 %d 字节, want %d", len(reply), len(want))
+	}
+}
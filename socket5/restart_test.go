@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+// echoThrough 通过 conn 发送数据并读取目标的回显
+func echoThrough(conn net.Conn, msg string) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return errors.New("回显不一致: " + string(buf))
+	}
+	return nil
+}
+
+// proxyClient 返回连接到 addr 的客户端
+func proxyClient(t *testing.T, addr string) *Client {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &Client{Host: host, Port: uint16(p)}
+}
+
+func TestRestartProxy(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	cfg := server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}, ShutdownTimeout: 300 * time.Millisecond}
+	s := startServer(t, cfg)
+	server.SetProxyController(s)
+	server.SetLiveConfig("", &server.ProjectConfig{Socks5: cfg})
+
+	if _, err := server.RestartProxy("later"); err == nil {
+		t.Error("无效的重启方式没有返回错误")
+	}
+
+	conn, err := proxyClient(t, s.listener().Addr().String()).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 立即重启：新监听器开始接受连接后关闭重启前的会话
+	var phases []string
+	addr, wait, err := s.Restart(cfg, false, func(phase string) { phases = append(phases, phase) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(phases) != 2 || phases[0] != RestartStarting || phases[1] != RestartStopping {
+		t.Errorf("phases = %v", phases)
+	}
+	if wait == nil {
+		t.Fatal("有重启前的会话时 wait 为 nil")
+	}
+	wait()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("重启后会话没有被关闭: %v", err)
+	}
+	conn, err = proxyClient(t, addr).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatalf("重启后连接失败: %v", err)
+	}
+	defer conn.Close()
+
+	// 排空重启：新监听器立即接受连接，重启前的会话继续转发，超时后被强制关闭
+	status, err := server.RestartProxy(server.RestartModeDrain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != RestartDraining || status.Addr == "" || status.AcceptingAt == nil {
+		t.Errorf("RestartProxy = %+v", status)
+	}
+	if _, err := server.RestartProxy(server.RestartModeDrain); !errors.Is(err, server.ErrRestartInProgress) {
+		t.Errorf("排空期间再次重启 = %v, want %v", err, server.ErrRestartInProgress)
+	}
+	if err := echoThrough(conn, "draining"); err != nil {
+		t.Errorf("排空期间重启前的会话中断: %v", err)
+	}
+	next, err := proxyClient(t, status.Addr).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatalf("排空期间新连接失败: %v", err)
+	}
+	defer next.Close()
+
+	// 排空期间不持有配置锁
+	done := make(chan struct{})
+	go func() {
+		server.LiveSocks5Config()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Error("排空期间读取配置被阻塞")
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if status, _ := server.LastRestart(); status.Phase == server.RestartRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("排空超时后重启没有完成")
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("排空超时后会话没有被关闭: %v", err)
+	}
+	if err := echoThrough(next, "after"); err != nil {
+		t.Errorf("排空结束后新会话中断: %v", err)
+	}
+	next.Close()
+
+	// 没有进行中的会话时直接完成
+	for deadline := time.Now().Add(2 * time.Second); s.getConnCount() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("connCount = %d", s.getConnCount())
+		}
+	}
+	if status, err = server.RestartProxy(server.RestartModeDrain); err != nil || status.Phase != server.RestartRunning {
+		t.Errorf("RestartProxy = %+v, %v", status, err)
+	}
+}
+
+func TestRestartKeepsSessionsOnFailure(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	cfg := server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}}
+	s := startServer(t, cfg)
+	conn, err := proxyClient(t, s.listener().Addr().String()).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 新地址无法监听时恢复原配置，重启前的会话不受影响
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	bad := cfg
+	bad.Port = busy.Addr().(*net.TCPAddr).Port
+	if _, _, err := s.Restart(bad, true, nil); err == nil {
+		t.Fatal("监听失败时 Restart 没有返回错误")
+	}
+	if err := echoThrough(conn, "still here"); err != nil {
+		t.Errorf("重启失败后会话中断: %v", err)
+	}
+	if s.listener() == nil {
+		t.Fatal("重启失败后没有恢复监听")
+	}
+	next, err := proxyClient(t, s.listener().Addr().String()).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatalf("重启失败后新连接失败: %v", err)
+	}
+	next.Close()
+}
+
+func TestRestartTimeoutsApplyToNewSessions(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	cfg := server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}}
+	s := startServer(t, cfg)
+	old, err := proxyClient(t, s.listener().Addr().String()).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	// 重启时修改空闲超时，重启前的会话继续使用建立时的超时
+	cfg.IdleTimeout = 100 * time.Millisecond
+	addr, _, err := s.Restart(cfg, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := proxyClient(t, addr).TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+
+	next.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(next); err != nil {
+		t.Errorf("新会话没有按新的空闲超时关闭: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := echoThrough(old, "still here"); err != nil {
+		t.Errorf("重启前的会话被新的空闲超时关闭: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat 轮转文件名中的时间格式
+const rotateTimeFormat = "20060102-150405"
+
+// rotatingFile 按大小和时间轮转的日志文件
+// 轮转时当前文件重命名为 path.20060102-150405，超过 maxBackups 的旧文件被删除
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // 单个文件的最大字节数，0 表示不按大小轮转
+	interval   time.Duration // 按时间轮转的间隔，按整点对齐（UTC），0 表示不按时间轮转
+	maxBackups int           // 保留的轮转文件数，0 表示全部保留
+
+	mu     sync.Mutex
+	file   *os.File // 轮转失败时为 nil，下次写入时重新打开
+	closed bool
+	size   int64
+	period time.Time // 当前文件所属的时间段
+}
+
+// openRotatingFile 以追加方式打开日志文件
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := f.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open 打开文件并记录已有的大小，调用方需持有锁
+func (f *rotatingFile) open(now time.Time) error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.period = f.periodOf(now)
+	return nil
+}
+
+// periodOf 返回时间所属的轮转时间段
+func (f *rotatingFile) periodOf(now time.Time) time.Time {
+	if f.interval <= 0 {
+		return time.Time{}
+	}
+	return now.Truncate(f.interval)
+}
+
+// Write 写入数据，写入前按需轮转，单次写入的数据不会被拆到两个文件中
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	if f.file == nil {
+		if err := f.open(now); err != nil {
+			return 0, err
+		}
+	}
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.interval > 0 && !f.periodOf(now).Equal(f.period)) {
+		// 轮转失败但重新打开了原文件时继续写入，不丢弃日志
+		if err := f.rotate(now); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate 关闭当前文件，重命名后打开新文件，调用方需持有锁
+// 重命名失败时以追加方式重新打开原文件；打开失败时 f.file 为 nil，由下次写入重试
+func (f *rotatingFile) rotate(now time.Time) error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+
+	name := f.path + "." + now.Format(rotateTimeFormat)
+	// 同一秒内多次轮转时追加序号，避免覆盖
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%s.%d", f.path, now.Format(rotateTimeFormat), i)
+	}
+	if err := os.Rename(f.path, name); err != nil && !os.IsNotExist(err) {
+		return errors.Join(err, f.open(now))
+	}
+	if err := f.open(now); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// rotatedFile 轮转生成的文件
+type rotatedFile struct {
+	name string
+	time time.Time // 文件名中的时间戳
+	seq  int       // 同一秒内的序号，第一个文件为 0
+}
+
+// parseRotatedName 解析轮转文件名的后缀，格式为 20060102-150405 或 20060102-150405.N
+func parseRotatedName(suffix string) (time.Time, int, bool) {
+	stamp, seq, hasSeq := strings.Cut(suffix, ".")
+	t, err := time.Parse(rotateTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if !hasSeq {
+		return t, 0, true
+	}
+	n, err := strconv.Atoi(seq)
+	if err != nil || n <= 0 {
+		return time.Time{}, 0, false
+	}
+	return t, n, true
+}
+
+// prune 删除超过 maxBackups 的旧文件，调用方需持有锁
+// 按文件名中的时间戳和序号排序，不能按字符串排序，否则 .10 会排在 .2 之前
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	prefix := f.path + "."
+	var backups []rotatedFile
+	for _, name := range names {
+		// 只处理轮转生成的文件
+		if t, seq, ok := parseRotatedName(strings.TrimPrefix(name, prefix)); ok {
+			backups = append(backups, rotatedFile{name: name, time: t, seq: seq})
+		}
+	}
+	if len(backups) <= f.maxBackups {
+		return
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].time.Equal(backups[j].time) {
+			return backups[i].time.Before(backups[j].time)
+		}
+		return backups[i].seq < backups[j].seq
+	})
+	for _, backup := range backups[:len(backups)-f.maxBackups] {
+		os.Remove(backup.name)
+	}
+}
+
+// Close 关闭文件
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
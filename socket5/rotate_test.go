@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseRotatedName(t *testing.T) {
+	tests := []struct {
+		suffix string
+		seq    int
+		ok     bool
+	}{
+		{"20260101-120000", 0, true},
+		{"20260101-120000.1", 1, true},
+		{"20260101-120000.10", 10, true},
+		{"20260101-120000.0", 0, false},
+		{"20260101-120000.gz", 0, false},
+		{"20260101-120000x", 0, false},
+		{"20261301-120000", 0, false},
+		{"bak", 0, false},
+	}
+	for _, tt := range tests {
+		_, seq, ok := parseRotatedName(tt.suffix)
+		if seq != tt.seq || ok != tt.ok {
+			t.Errorf("parseRotatedName(%q) = %d, %v, want %d, %v", tt.suffix, seq, ok, tt.seq, tt.ok)
+		}
+	}
+}
+
+func TestRotatingFilePrune(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	for _, suffix := range []string{
+		"20251231-235959.3",
+		"20260101-000000",
+		"20260101-000000.1",
+		"20260101-000000.2",
+		"20260101-000000.10",
+		"20260101-000001",
+		"bak",
+		"20260101-000000.gz",
+	} {
+		if err := os.WriteFile(path+"."+suffix, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &rotatingFile{path: path, maxBackups: 3}
+	f.prune()
+
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, name := range names {
+		got = append(got, filepath.Base(name))
+	}
+	want := []string{
+		"access.log.20260101-000000.10",
+		"access.log.20260101-000000.2",
+		"access.log.20260101-000000.gz",
+		"access.log.20260101-000001",
+		"access.log.bak",
+	}
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("剩余文件 %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("剩余文件 %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRotatingFileMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// 单次写入不拆分，超过大小时先轮转再写入
+	for _, line := range []string{"0123456\n", "abc\n", "defgh\n", "ijklmnop\n", "q\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "q\n" {
+		t.Errorf("当前文件 = %q, want %q", data, "q\n")
+	}
+
+	// 三次轮转只保留最近的两个
+	backups, _ := filepath.Glob(path + ".*")
+	var contents []string
+	for _, name := range backups {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	sort.Strings(contents)
+	if want := []string{"abc\ndefgh\n", "ijklmnop\n"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("轮转文件内容 %q, want %q", contents, want)
+	}
+}
+
+func TestRotatingFileReopenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("0123456\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 目录被删除后轮转时无法打开新文件
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("abc\n")); err == nil {
+		t.Fatal("打开新文件失败时 Write 应返回错误")
+	}
+
+	// 目录恢复后下次写入重新打开文件
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("defgh\n")); err != nil {
+		t.Fatalf("目录恢复后 Write = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "defgh\n" {
+		t.Errorf("当前文件 = %q, want %q", data, "defgh\n")
+	}
+
+	f.Close()
+	if _, err := f.Write([]byte("x\n")); err != os.ErrClosed {
+		t.Errorf("Close 之后 Write = %v, want %v", err, os.ErrClosed)
+	}
+}
@@ -0,0 +1,185 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RuleSet 目标地址规则集合，用于黑名单匹配
+//
+// 每条规则由主机和可选的端口组成：
+//
+//	example.com          精确匹配域名
+//	*.example.com        匹配所有子域名（不含 example.com 本身）
+//	10.0.0.0/8           匹配网段，也可以是单个IP
+//	[2001:db8::/32]:443  IPv6主机带端口时需要方括号
+//	*:25                 任意主机的25端口
+//	example.com:8000-9000 端口范围
+type RuleSet struct {
+	rules []rule
+}
+
+// rule 单条规则
+type rule struct {
+	raw     string     // 原始规则文本
+	any     bool       // 匹配任意主机
+	host    string     // 精确匹配的域名
+	suffix  string     // 通配域名后缀，形如 ".example.com"
+	network *net.IPNet // 网段或单个IP
+	portMin uint16     // 端口范围下限
+	portMax uint16     // 端口范围上限
+}
+
+// ParseRules 解析规则列表，空行和以#开头的行会被忽略
+func ParseRules(entries []string) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		r, err := parseRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("无效的规则 %q: %v", entry, err)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+// parseRule 解析单条规则
+func parseRule(entry string) (rule, error) {
+	r := rule{raw: entry, portMin: 0, portMax: 65535}
+
+	// 拆分主机和端口
+	host, ports := entry, ""
+	switch {
+	case strings.HasPrefix(entry, "["):
+		end := strings.Index(entry, "]")
+		if end < 0 {
+			return r, fmt.Errorf("缺少 ]")
+		}
+		host, ports = entry[1:end], entry[end+1:]
+		if ports != "" {
+			if !strings.HasPrefix(ports, ":") {
+				return r, fmt.Errorf("] 之后应为端口")
+			}
+			ports = ports[1:]
+		}
+	case strings.Count(entry, ":") == 1:
+		host, ports, _ = strings.Cut(entry, ":")
+	}
+
+	if ports != "" && ports != "*" {
+		var err error
+		r.portMin, r.portMax, err = parsePortRange(ports)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	switch {
+	case host == "" || host == "*":
+		r.any = true
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return r, err
+		}
+		r.network = network
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(host, "*."):
+		r.suffix = host[1:]
+	case strings.Contains(host, "*"):
+		return r, fmt.Errorf("通配符只能出现在域名开头")
+	default:
+		r.host = host
+	}
+	return r, nil
+}
+
+// parsePortRange 解析 "80" 或 "8000-9000" 格式的端口
+func parsePortRange(ports string) (uint16, uint16, error) {
+	low, high, isRange := strings.Cut(ports, "-")
+	lo, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("无效的端口: %s", low)
+	}
+	if !isRange {
+		return uint16(lo), uint16(lo), nil
+	}
+	hi, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("无效的端口: %s", high)
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("端口范围下限大于上限: %s", ports)
+	}
+	return uint16(lo), uint16(hi), nil
+}
+
+// Len 返回规则数量
+func (rs *RuleSet) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.rules)
+}
+
+// hasIPRules 是否包含按IP匹配的规则，没有时无需解析域名
+func (rs *RuleSet) hasIPRules() bool {
+	if rs == nil {
+		return false
+	}
+	for _, r := range rs.rules {
+		if r.network != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Match 检查目标是否命中规则，返回命中的规则文本
+// host 为请求中的域名或IP，ips 为域名解析后的地址（可为空）
+func (rs *RuleSet) Match(host string, port uint16, ips []net.IP) (string, bool) {
+	if rs == nil {
+		return "", false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append([]net.IP{ip}, ips...)
+		host = ""
+	}
+
+	for _, r := range rs.rules {
+		if port < r.portMin || port > r.portMax {
+			continue
+		}
+		switch {
+		case r.any:
+			return r.raw, true
+		case r.network != nil:
+			for _, ip := range ips {
+				if r.network.Contains(ip) {
+					return r.raw, true
+				}
+			}
+		case r.suffix != "":
+			if host != "" && strings.HasSuffix(host, r.suffix) {
+				return r.raw, true
+			}
+		case host != "" && host == r.host:
+			return r.raw, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestRuleSetMatch(t *testing.T) {
+	rules, err := ParseRules([]string{
+		"# 注释",
+		"example.com",
+		"*.example.org",
+		"10.0.0.0/8",
+		"[2001:db8::/32]:443",
+		"*:25",
+		"example.net:8000-9000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		port uint16
+		ips  []net.IP
+		want string
+	}{
+		{"example.com", 80, nil, "example.com"},
+		{"EXAMPLE.com.", 80, nil, "example.com"},
+		{"www.example.com", 80, nil, ""},
+		{"a.b.example.org", 80, nil, "*.example.org"},
+		{"example.org", 80, nil, ""},
+		{"10.1.2.3", 80, nil, "10.0.0.0/8"},
+		{"11.1.2.3", 80, nil, ""},
+		{"internal.test", 80, []net.IP{net.ParseIP("10.9.9.9")}, "10.0.0.0/8"},
+		{"internal.test", 80, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("10.9.9.9")}, "10.0.0.0/8"},
+		{"2001:db8::1", 443, nil, "[2001:db8::/32]:443"},
+		{"2001:db8::1", 80, nil, ""},
+		{"anything.test", 25, nil, "*:25"},
+		{"example.net", 8500, nil, "example.net:8000-9000"},
+		{"example.net", 9001, nil, ""},
+	}
+	for _, tt := range tests {
+		rule, matched := rules.Match(tt.host, tt.port, tt.ips)
+		if rule != tt.want || matched != (tt.want != "") {
+			t.Errorf("Match(%q, %d, %v) = %q, %v, want %q", tt.host, tt.port, tt.ips, rule, matched, tt.want)
+		}
+	}
+
+	if _, matched := (*RuleSet)(nil).Match("example.com", 80, nil); matched {
+		t.Error("nil 规则集不应命中")
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, entry := range []string{"[::1", "[::1]22", "a*.example.com", "example.com:x", "example.com:9-1", "10.0.0.0/33"} {
+		if _, err := ParseRules([]string{entry}); err == nil {
+			t.Errorf("ParseRules(%q) 没有返回错误", entry)
+		}
+	}
+}
+
+func TestBlacklistResolve(t *testing.T) {
+	s := startServer(t, server.Socks5Config{
+		Host:             "127.0.0.1",
+		AuthList:         []int{0},
+		BlackList:        []string{"127.0.0.0/8"},
+		BlackListResolve: true,
+	})
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port}
+
+	// 域名解析到黑名单中的地址
+	conn, err := client.TcpProxy("localhost", 9)
+	if err == nil {
+		conn.Close()
+	}
+	if !errors.Is(err, ErrConnectionNotAllowed) {
+		t.Errorf("localhost: err = %v, want %v", err, ErrConnectionNotAllowed)
+	}
+
+	// 无法解析时不能确认目标地址，不交给拨号时再次解析
+	conn, err = client.TcpProxy("blacklist.invalid", 9)
+	if err == nil {
+		conn.Close()
+		t.Error("blacklist.invalid: 无法解析的域名连接成功")
+	}
+}
+
+func TestDialTargetUsesCheckedIPs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	// 域名本身无法解析，只有使用检查过的地址才能连接成功
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	target := &Addr{Type: Domain, Name: "rebind.invalid", Port: port}
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+
+	s := &Server{}
+	conn, err := s.dialTarget(target, ips, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("RemoteAddr = %s, want %s", got, ln.Addr())
+	}
+	data, _ := io.ReadAll(conn)
+	if string(data) != "ok" {
+		t.Errorf("read %q, want %q", data, "ok")
+	}
+}
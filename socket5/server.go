@@ -2,165 +2,726 @@ package socks5
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"go-socket5/server"
-	"log"
+	"log/slog"
 	"net"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // 日志前缀常量
+//
+// Deprecated: 日志改用 log/slog 输出，组件见 LogKeyComponent 属性，审计事件见 LogKeyAudit 属性
 const (
 	LogPrefixServer = "[SOCKS5-SERVER]"
 	LogPrefixClient = "[SOCKS5-CLIENT]"
 	LogPrefixUtils  = "[SOCKS5-UTILS]"
+	LogPrefixAudit  = "[SOCKS5-AUDIT]"
 )
 
 // 高并发配置常量
 const (
-	MaxConcurrentConnections = 10000 // 最大并发连接数
-	ConnectionTimeout        = 30 * time.Second
+	MaxConcurrentConnections = 10000            // 最大并发连接数
+	MaxRejectingConnections  = 256              // 超过最大并发连接数后仍完成握手、应答拒绝的连接数，再超过时直接关闭
+	ConnectionTimeout        = 30 * time.Second // 默认握手超时
+	DefaultDialTimeout       = 10 * time.Second // 默认连接目标超时
 	ReadTimeout              = 10 * time.Second
 	WriteTimeout             = 10 * time.Second
+	MaxUDPPacketSize         = 65535 // UDP数据报最大长度
 )
 
 // Server SOCKS5服务器结构体
 type Server struct {
-	listen  net.Listener      // TCP监听器
-	Config  Config            // 服务器配置
-	UserMap map[string]string // 用户认证映射表
+	listen net.Listener // TCP监听器
+	Config Config       // 服务器配置
+	Users  UserStore    // 用户存储，运行期间通过 SetUsers 替换
+	Logger *slog.Logger // 日志记录器，为nil时使用 slog.Default()
 
 	// 高并发优化字段
-	connCount   int32        // 当前连接数
-	connMutex   sync.RWMutex // 连接数锁
-	ctx         context.Context
-	cancel      context.CancelFunc
-	rateLimiter *RateLimiter // 限流器
+	connCount int32        // 当前连接数
+	connMutex sync.RWMutex // 连接数锁
+	rejecting atomic.Int32 // 超过最大并发连接数、正在握手以便应答拒绝的连接数
+	ctx       context.Context
+	cancel    context.CancelFunc
+	limiter   connLimiter // 新连接速率限制
+
+	rules     atomic.Pointer[RuleSet]   // 黑名单规则
+	resolve   atomic.Bool               // 是否用域名解析后的IP匹配黑名单
+	users     atomic.Pointer[UserStore] // 当前生效的用户存储
+	authList  atomic.Pointer[[]uint8]   // 当前支持的认证方法
+	bandwidth shaper                    // 带宽整形
+	quotas    quotaTracker              // 用户配额
+
+	concurrency concurrencyLimiter // 按用户、IP和网段的并发会话上限
+	authGuard   authGuard          // 认证暴力破解防护
+	accessLog   accessLogger       // 会话访问日志
+
+	timeouts atomic.Pointer[sessionTimeouts] // 新会话使用的超时，启动和重启时按 Config 设置
+
+	// 生命周期管理
+	mu       sync.Mutex            // 保护监听器和会话表
+	sessions map[*session]struct{} // 进行中的会话，包括握手阶段
+	closing  bool                  // 正在关闭，不再接受新会话
+	idle     chan struct{}         // 关闭期间所有会话结束时关闭
+	retiring map[*session]struct{} // 重启前的会话，重启后等待它们结束
+	retired  chan struct{}         // retiring 中的会话全部结束时关闭
+	draining atomic.Bool           // 排空模式，健康检查失败但继续服务
 }
 
-// RateLimiter 限流器
-type RateLimiter struct {
-	tokens     chan struct{}
-	rate       time.Duration
-	burst      int
-	lastRefill time.Time
-	mutex      sync.Mutex
+// User 用户结构体
+type User struct {
+	Name     []byte // 用户名
+	Password []byte // 密码
 }
 
-// NewRateLimiter 创建新的限流器
-func NewRateLimiter(rate time.Duration, burst int) *RateLimiter {
-	rl := &RateLimiter{
-		tokens: make(chan struct{}, burst),
-		rate:   rate,
-		burst:  burst,
-	}
+// Config 服务器配置结构体
+type Config struct {
+	Host             string   // 监听地址，运行期间通过 SetListenAddr 修改
+	Port             uint16   // 监听端口，运行期间通过 SetListenAddr 修改
+	BlackList        []string // 黑名单列表，规则格式见 RuleSet
+	ResolveBlackList bool     // 是否同时用域名解析后的IP匹配黑名单，运行期间通过 SetResolveBlackList 修改
+	AuthList         []uint8  // 支持的认证方法列表，运行期间通过 SetAuthList 修改
+
+	// 超时设置，握手和拨号为0时使用默认值，空闲和最长存活时间为0时不限制
+	// 会话开始时取得快照，启动或重启后修改的超时只对新会话生效
+	HandshakeTimeout   time.Duration // 从建立连接到收到请求的最长时间
+	DialTimeout        time.Duration // 连接目标的超时
+	IdleTimeout        time.Duration // 转发阶段双向都没有数据的最长时间
+	MaxSessionLifetime time.Duration // 会话最长存活时间
+
+	Bandwidth server.BandwidthConfig // 带宽限制，运行期间通过 SetBandwidth 修改
+	Quotas    server.QuotaConfig     // 用户配额，运行期间通过 SetQuotas 修改
+
+	RateLimits  server.RateLimitConfig   // 新连接速率限制，运行期间通过 SetRateLimits 修改
+	Concurrency server.ConcurrencyConfig // 并发会话上限，运行期间通过 SetConcurrency 修改
+	BruteForce  server.BruteForceConfig  // 认证暴力破解防护，运行期间通过 SetBruteForce 修改
+
+	AccessLog server.AccessLogConfig // 会话访问日志，运行期间通过 SetAccessLog 修改
+}
+
+// sessionTimeouts 会话使用的超时，已填入默认值
+type sessionTimeouts struct {
+	handshake time.Duration // 从建立连接到收到请求的最长时间
+	dial      time.Duration // 连接目标的超时
+	idle      time.Duration // 转发阶段的空闲超时，0 表示不限制
+	lifetime  time.Duration // 会话最长存活时间，0 表示不限制
+}
 
-	// 初始化令牌
-	for i := 0; i < burst; i++ {
-		rl.tokens <- struct{}{}
+// sessionTimeouts 返回按配置填入默认值后的超时
+func (c *Config) sessionTimeouts() sessionTimeouts {
+	t := sessionTimeouts{
+		handshake: c.HandshakeTimeout,
+		dial:      c.DialTimeout,
+		idle:      c.IdleTimeout,
+		lifetime:  c.MaxSessionLifetime,
+	}
+	if t.handshake <= 0 {
+		t.handshake = ConnectionTimeout
+	}
+	if t.dial <= 0 {
+		t.dial = DefaultDialTimeout
 	}
+	return t
+}
 
-	// 启动令牌补充
-	go rl.refillTokens()
-	return rl
+// Start 启动SOCKS5服务器，服务器关闭前不返回
+func (s *Server) Start() error {
+	listener, ctx, err := s.listenAndInit()
+	if err != nil || listener == nil {
+		return err
+	}
+	return s.serve(ctx, listener)
 }
 
-// refillTokens 补充令牌
-func (rl *RateLimiter) refillTokens() {
-	ticker := time.NewTicker(rl.rate)
-	defer ticker.Stop()
+// listenAndInit 按 Config 初始化各项设置并开始监听
+// 启动完成前已经调用了 Shutdown 时返回的监听器为 nil
+func (s *Server) listenAndInit() (net.Listener, context.Context, error) {
+	// 初始化上下文
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.ctx, s.cancel = ctx, cancel
+	s.closing = false
+	// 重启时保留重启前仍在进行的会话
+	if s.sessions == nil {
+		s.sessions = make(map[*session]struct{})
+	}
+	// ApplyConfig 会同步修改配置，启动时使用同一时刻的快照
+	cfg, users := s.Config, s.Users
+	s.mu.Unlock()
+	s.draining.Store(false)
+	timeouts := cfg.sessionTimeouts()
+	s.timeouts.Store(&timeouts)
+
+	logger := s.logger()
+	s.quotas.setLogger(logger)
+	s.authGuard.setLogger(logger)
+
+	if users != nil {
+		s.SetUsers(users)
+	}
 
-	for range ticker.C {
-		select {
-		case rl.tokens <- struct{}{}:
-		default:
-		}
+	if err := s.SetAuthList(cfg.AuthList); err != nil {
+		logger.Error("认证方法配置错误", "error", err)
+		return nil, nil, err
 	}
-}
 
-// Allow 检查是否允许连接
-func (rl *RateLimiter) Allow() bool {
-	select {
-	case <-rl.tokens:
-		return true
-	default:
-		return false
+	// 编译黑名单规则
+	if err := s.SetBlackList(cfg.BlackList); err != nil {
+		logger.Error("黑名单配置错误", "error", err)
+		return nil, nil, err
 	}
-}
+	s.SetResolveBlackList(cfg.ResolveBlackList)
 
-// User 用户结构体
-type User struct {
-	Name     []byte // 用户名
-	Password []byte // 密码
-}
+	if err := s.SetBandwidth(cfg.Bandwidth); err != nil {
+		logger.Error("带宽限制配置错误", "error", err)
+		return nil, nil, err
+	}
 
-// Config 服务器配置结构体
-type Config struct {
-	Host      string   // 监听地址
-	Port      uint16   // 监听端口
-	BlackList []string // 黑名单列表
-	AuthList  []uint8  // 支持的认证方法列表
-}
+	if err := s.SetQuotas(cfg.Quotas); err != nil {
+		logger.Error("配额配置错误", "error", err)
+		return nil, nil, err
+	}
+
+	if err := s.SetRateLimits(cfg.RateLimits); err != nil {
+		logger.Error("速率限制配置错误", "error", err)
+		return nil, nil, err
+	}
 
-// Start 启动SOCKS5服务器
-func (s *Server) Start() (err error) {
-	// 初始化上下文和限流器
-	s.ctx, s.cancel = context.WithCancel(context.Background())
-	s.rateLimiter = NewRateLimiter(100*time.Millisecond, 1000) // 每秒1000个连接
+	if err := s.SetConcurrency(cfg.Concurrency); err != nil {
+		logger.Error("并发上限配置错误", "error", err)
+		return nil, nil, err
+	}
+
+	if err := s.SetBruteForce(cfg.BruteForce); err != nil {
+		logger.Error("暴力破解防护配置错误", "error", err)
+		return nil, nil, err
+	}
 
-	log.Printf("%s 启动服务器 %s:%d", LogPrefixServer, s.Config.Host, s.Config.Port)
-	s.listen, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.Config.Host, s.Config.Port))
+	if err := s.SetAccessLog(cfg.AccessLog); err != nil {
+		logger.Error("访问日志配置错误", "error", err)
+		return nil, nil, err
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	logger.Info("启动服务器", "addr", addr)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Printf("%s 监听失败: %v", LogPrefixServer, err)
-		return err
+		logger.Error("监听失败", "error", err)
+		return nil, nil, err
 	}
+	s.mu.Lock()
+	if s.closing {
+		// 启动完成前已经调用了 Shutdown
+		s.mu.Unlock()
+		listener.Close()
+		return nil, nil, nil
+	}
+	s.listen = listener
+	s.mu.Unlock()
 
 	// 设置TCP keep-alive
-	if tcpListener, ok := s.listen.(*net.TCPListener); ok {
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
 		tcpListener.SetDeadline(time.Time{}) // 禁用超时
 	}
 
-	log.Printf("%s 服务器启动成功，等待连接...", LogPrefixServer)
+	logger.Info("服务器启动成功，等待连接")
 
 	// 启动连接监控
-	go s.monitorConnections()
+	go s.monitorConnections(ctx)
+	go s.quotas.run(ctx)
+	go s.limiter.run(ctx)
+	go s.authGuard.run(ctx)
+	return listener, ctx, nil
+}
 
+// serve 在监听器上接受连接，服务器关闭后返回
+func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	logger := s.logger()
 	for {
-		accept, err := s.listen.Accept()
+		accept, err := listener.Accept()
 		if err != nil {
-			if s.ctx.Err() != nil {
+			if ctx.Err() != nil {
 				// 服务器正在关闭
 				return nil
 			}
-			log.Printf("%s 接受连接失败: %v", LogPrefixServer, err)
+			if next := s.listener(); next != nil && next != listener {
+				// 监听地址已切换，改为在新的监听器上接受连接
+				listener = next
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// 切换监听地址失败且无法恢复原地址
+				logger.Error("监听器已关闭", "error", err)
+				return err
+			}
+			logger.Warn("接受连接失败", "error", err)
 			continue
 		}
 
-		// 限流检查
-		if !s.rateLimiter.Allow() {
-			log.Printf("%s 连接被限流拒绝: %v", LogPrefixServer, accept.RemoteAddr())
+		// 按来源IP和子网限流
+		if scope, ok := s.limiter.allowAddr(accept.RemoteAddr()); !ok {
+			logger.Warn("连接被限流拒绝", "scope", scope, "client", accept.RemoteAddr().String())
+			server.IncrementRejectedConnections("rate_limit_" + scope)
 			accept.Close()
 			continue
 		}
 
-		// 并发连接数检查
-		if !s.incrementConnCount() {
-			log.Printf("%s 达到最大并发连接数限制: %v", LogPrefixServer, accept.RemoteAddr())
-			accept.Close()
-			continue
+		// 被封禁的来源直接关闭
+		if addr, ok := accept.RemoteAddr().(*net.TCPAddr); ok {
+			if remaining, banned := s.authGuard.bannedIP(addr.IP); banned {
+				logger.Warn("来源已被封禁", "client", addr.String(), "remaining", remaining.Round(time.Second))
+				server.IncrementRejectedConnections("banned_ip")
+				accept.Close()
+				continue
+			}
+		}
+
+		// 并发连接数检查，超过上限的连接选择认证方法后应答 0x02，不校验密码
+		overLimit := !s.incrementConnCount()
+		if overLimit {
+			logger.Warn("达到最大并发连接数限制", "client", accept.RemoteAddr().String())
+			server.IncrementRejectedConnections("max_connections")
+			if s.rejecting.Add(1) > MaxRejectingConnections {
+				// 等待应答拒绝的连接也过多时直接关闭，避免握手占用过多资源
+				s.rejecting.Add(-1)
+				accept.Close()
+				continue
+			}
+		}
+
+		go s.handleConnection(accept, overLimit)
+	}
+}
+
+// Shutdown 优雅关闭服务器：停止接受新连接，等待进行中的会话结束
+// ctx 到期后强制关闭剩余会话并返回 ctx 的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	// 所有会话结束后保存最终的配额用量，关闭访问日志
+	defer s.quotas.save()
+	defer s.accessLog.close()
+
+	s.mu.Lock()
+	s.closing = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.listen != nil {
+		s.listen.Close()
+	}
+	remaining := len(s.sessions)
+	idle := s.idle
+	if remaining > 0 && idle == nil {
+		idle = make(chan struct{})
+		s.idle = idle
+	}
+	s.mu.Unlock()
+
+	if remaining == 0 {
+		s.logger().Info("服务器已关闭")
+		return nil
+	}
+	s.logger().Info("停止接受新连接，等待会话结束", "sessions", remaining)
+
+	select {
+	case <-idle:
+		s.logger().Info("所有会话已结束，服务器已关闭")
+		return nil
+	case <-ctx.Done():
+	}
+
+	// 超时后强制关闭剩余会话
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+	s.logger().Warn("等待超时，强制关闭会话", "sessions", len(sessions))
+	for _, sess := range sessions {
+		sess.close(closeShutdown)
+	}
+	<-idle
+	return ctx.Err()
+}
+
+// SetDraining 开启或关闭排空模式
+// 排空模式下健康检查返回失败，负载均衡器停止分配新流量，服务器仍继续处理连接
+func (s *Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
+	s.logger().Info("排空模式", "draining", draining)
+}
+
+// Draining 是否处于排空模式
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// listener 返回当前的监听器
+func (s *Server) listener() net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listen
+}
+
+// SetListenAddr 修改监听地址，可在运行期间调用
+// 先在新地址上监听再关闭原监听器，已建立的会话不受影响；只有端口相同时才先关闭原监听器
+// 新地址监听失败时继续使用原地址
+func (s *Server) SetListenAddr(host string, port uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if host == s.Config.Host && port == s.Config.Port {
+		return nil
+	}
+	if s.listen == nil || s.closing {
+		// 尚未启动或已关闭，下次启动时使用新地址
+		s.Config.Host, s.Config.Port = host, port
+		return nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil && port == s.Config.Port && port != 0 {
+		// 同一端口只改监听地址时可能与原监听器冲突
+		old := s.listen.Addr().String()
+		s.listen.Close()
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			restored, restoreErr := net.Listen("tcp", old)
+			if restoreErr != nil {
+				s.logger().Error("恢复原监听地址失败", "addr", old, "error", restoreErr)
+				return fmt.Errorf("监听 %s 失败: %v，恢复原地址失败: %v", addr, err, restoreErr)
+			}
+			s.listen = restored
+			return fmt.Errorf("监听 %s 失败: %v", addr, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("监听 %s 失败: %v", addr, err)
+	}
+
+	old := s.listen
+	s.listen = listener
+	s.Config.Host, s.Config.Port = host, port
+	old.Close()
+	s.logger().Info("监听地址已修改", "addr", listener.Addr().String(), "old", old.Addr().String())
+	return nil
+}
+
+// addSession 登记进行中的会话，服务器正在关闭时返回false
+func (s *Server) addSession(sess *session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.sessions[sess] = struct{}{}
+	return true
+}
+
+// removeSession 移除会话，关闭期间最后一个会话结束时通知 Shutdown
+func (s *Server) removeSession(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess)
+	if _, ok := s.retiring[sess]; ok {
+		delete(s.retiring, sess)
+		if len(s.retiring) == 0 {
+			close(s.retired)
+			s.retiring, s.retired = nil, nil
 		}
+	}
+	if len(s.sessions) == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// SetBlackList 替换黑名单规则，可在运行期间调用
+func (s *Server) SetBlackList(entries []string) error {
+	rules, err := ParseRules(entries)
+	if err != nil {
+		return err
+	}
+	s.rules.Store(rules)
+	s.logger().Info("已加载黑名单规则", "rules", rules.Len())
+	return nil
+}
+
+// SetResolveBlackList 设置是否用域名解析后的IP匹配黑名单，可在运行期间调用
+func (s *Server) SetResolveBlackList(resolve bool) {
+	s.resolve.Store(resolve)
+}
+
+// SetAuthList 替换支持的认证方法，可在运行期间调用，只对新连接生效
+func (s *Server) SetAuthList(methods []uint8) error {
+	for _, method := range methods {
+		if method != NoAuthenticationRequired && method != AccountPasswordAuthentication {
+			return fmt.Errorf("不支持的认证方法: %d", method)
+		}
+	}
+	methods = append([]uint8(nil), methods...)
+	s.authList.Store(&methods)
+	s.logger().Info("认证方法", "methods", fmt.Sprint(methods))
+	return nil
+}
+
+// AuthList 返回当前支持的认证方法
+func (s *Server) AuthList() []uint8 {
+	if methods := s.authList.Load(); methods != nil {
+		return *methods
+	}
+	return s.Config.AuthList
+}
+
+// SetUsers 替换用户存储，可在运行期间调用，已建立的会话不受影响
+func (s *Server) SetUsers(store UserStore) {
+	s.users.Store(&store)
+}
+
+// sessionTimeouts 返回新会话使用的超时，尚未启动时按 Config 计算
+func (s *Server) sessionTimeouts() sessionTimeouts {
+	if timeouts := s.timeouts.Load(); timeouts != nil {
+		return *timeouts
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Config.sessionTimeouts()
+}
+
+// SetBandwidth 替换带宽限制，可在运行期间调用
+// 新的限制对已建立的会话立即生效，使用 splice 转发的会话除外
+func (s *Server) SetBandwidth(cfg server.BandwidthConfig) error {
+	if err := s.bandwidth.set(cfg); err != nil {
+		return err
+	}
+	s.logger().Info("带宽限制", "global", cfg.Global, "perUser", cfg.PerUser,
+		"perConnection", cfg.PerConnection, "users", len(cfg.Users))
+	return nil
+}
+
+// Bandwidth 返回当前的带宽限制
+func (s *Server) Bandwidth() server.BandwidthConfig {
+	return s.bandwidth.get()
+}
+
+// SetQuotas 替换用户配额配置，可在运行期间调用
+// 状态文件路径变化时从新文件加载用量
+func (s *Server) SetQuotas(cfg server.QuotaConfig) error {
+	commit, err := s.prepareQuotas(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// prepareQuotas 检查配额配置并加载状态文件，返回的 commit 使配置生效
+func (s *Server) prepareQuotas(cfg server.QuotaConfig) (func(), error) {
+	commit, err := s.quotas.prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		commit()
+		s.logger().Info("用户配额", "default", cfg.Default, "users", len(cfg.Users), "cutOff", cfg.CutOff)
+	}, nil
+}
+
+// Quotas 返回当前的配额配置
+func (s *Server) Quotas() server.QuotaConfig {
+	return s.quotas.get()
+}
+
+// QuotaStatus 返回所有用户的配额使用情况
+func (s *Server) QuotaStatus() []server.QuotaStatus {
+	var users []string
+	if store := s.userStore(); store != nil {
+		users = store.Users()
+	}
+	return s.quotas.status(users)
+}
 
-		go s.handleConnection(accept)
+// ResetQuota 清零用户的配额用量，用户没有用量记录时返回false
+func (s *Server) ResetQuota(user string) bool {
+	if !s.quotas.reset(user) {
+		return false
 	}
+	s.quotas.save()
+	s.logger().Info("已清零用户的配额用量", "user", user)
+	return true
+}
+
+// SetRateLimits 替换新连接速率限制，可在运行期间调用
+func (s *Server) SetRateLimits(cfg server.RateLimitConfig) error {
+	if err := s.limiter.set(cfg); err != nil {
+		return err
+	}
+	s.logger().Info("速率限制", "perIP", cfg.PerIP, "perSubnet", cfg.PerSubnet, "perUser", cfg.PerUser)
+	return nil
+}
+
+// RateLimits 返回当前的新连接速率限制
+func (s *Server) RateLimits() server.RateLimitConfig {
+	return s.limiter.get()
+}
+
+// SetConcurrency 替换并发会话上限，可在运行期间调用
+// 已建立的会话继续占用名额，超出新上限时不会被断开
+func (s *Server) SetConcurrency(cfg server.ConcurrencyConfig) error {
+	if err := s.concurrency.set(cfg); err != nil {
+		return err
+	}
+	s.logger().Info("并发会话上限", "perUser", cfg.PerUser, "perIP", cfg.PerIP,
+		"users", len(cfg.Users), "networks", len(cfg.Networks))
+	return nil
+}
+
+// Concurrency 返回当前的并发会话上限
+func (s *Server) Concurrency() server.ConcurrencyConfig {
+	return s.concurrency.get()
+}
+
+// SetBruteForce 替换认证暴力破解防护配置，可在运行期间调用，已有的封禁保留
+func (s *Server) SetBruteForce(cfg server.BruteForceConfig) error {
+	if err := s.authGuard.set(cfg); err != nil {
+		return err
+	}
+	if cfg.MaxFailures > 0 {
+		cfg = s.authGuard.get()
+		s.logger().Info("暴力破解防护", "window", cfg.Window, "maxFailures", cfg.MaxFailures,
+			"banTime", cfg.BanTime, "maxBanTime", cfg.MaxBanTime, "allowlist", len(cfg.Allowlist))
+	}
+	return nil
+}
+
+// BruteForce 返回当前的认证暴力破解防护配置
+func (s *Server) BruteForce() server.BruteForceConfig {
+	return s.authGuard.get()
+}
+
+// SetAccessLog 替换访问日志配置，可在运行期间调用，新的输出打开成功后才关闭旧的输出
+func (s *Server) SetAccessLog(cfg server.AccessLogConfig) error {
+	commit, _, err := s.prepareAccessLog(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// prepareAccessLog 检查访问日志配置并打开新的输出，返回的 commit 使配置生效，discard 放弃新的输出
+func (s *Server) prepareAccessLog(cfg server.AccessLogConfig) (commit, discard func(), err error) {
+	swap, discard, err := s.accessLog.prepare(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func() {
+		swap()
+		if cfg.Path != "" {
+			s.logger().Info("访问日志", accessLogAttrs(cfg)...)
+		}
+	}, discard, nil
+}
+
+// AccessLog 返回当前的访问日志配置
+func (s *Server) AccessLog() server.AccessLogConfig {
+	return s.accessLog.get()
+}
+
+// Bans 返回生效中的封禁
+func (s *Server) Bans() []server.BanInfo {
+	return s.authGuard.list()
+}
+
+// Unban 解除来源IP或用户名的封禁，两者都为空时解除全部，返回解除的封禁数
+func (s *Server) Unban(ip, user string) int {
+	return s.authGuard.unban(ip, user)
+}
+
+// logger 返回服务器的日志记录器
+func (s *Server) logger() *slog.Logger {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With(LogKeyComponent, "server")
+}
+
+// userStore 返回当前生效的用户存储
+func (s *Server) userStore() UserStore {
+	if store := s.users.Load(); store != nil {
+		return *store
+	}
+	return s.Users
+}
+
+// checkTarget 检查目标是否命中黑名单，命中时记录审计日志并返回 ErrConnectionNotAllowed。
+// 开启 blacklist_resolve 时返回检查过的解析结果，调用方必须直接使用这些地址，
+// 否则再次解析可能得到不同的结果（DNS rebinding）从而绕过IP规则
+func (s *Server) checkTarget(sess *session, target *Addr) ([]net.IP, error) {
+	rules := s.rules.Load()
+	if rules.Len() == 0 {
+		return nil, nil
+	}
+
+	// 按需解析域名，解析失败时无法确认目标地址，直接拒绝
+	var ips []net.IP
+	if target.Type == Domain && s.resolve.Load() && rules.hasIPRules() {
+		ctx, cancel := context.WithTimeout(context.Background(), sess.timeouts.dial)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target.Name)
+		cancel()
+		if err != nil {
+			sess.log.Warn("黑名单检查解析域名失败", "error", err)
+			sess.fail("dial_error")
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if rule, matched := rules.Match(target.Host(), target.Port, ips); matched {
+		auditLog(sess.log, "命中黑名单，拒绝请求", "command", sess.command, "client", sess.conn.RemoteAddr().String(),
+			"user", sess.user, "target", target.String(), "rule", rule)
+		sess.fail("blacklist")
+		return nil, ErrConnectionNotAllowed
+	}
+	return ips, nil
+}
+
+// dialTarget 在 timeout 内连接目标，ips 非空时依次尝试这些已检查过的地址而不再解析域名
+func (s *Server) dialTarget(target *Addr, ips []net.IP, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	if len(ips) == 0 {
+		return dialer.Dial("tcp", target.String())
+	}
+
+	// 所有地址共享一个超时，与按域名拨号时的行为一致
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var firstErr error
+	for _, ip := range ips {
+		addr := (&net.TCPAddr{IP: ip, Port: int(target.Port)}).String()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
 }
 
 // monitorConnections 监控连接数
-func (s *Server) monitorConnections() {
+func (s *Server) monitorConnections(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -168,10 +729,10 @@ func (s *Server) monitorConnections() {
 		select {
 		case <-ticker.C:
 			count := s.getConnCount()
-			log.Printf("%s 当前连接数: %d", LogPrefixServer, count)
+			s.logger().Info("当前连接数", "connections", count)
 			// 更新HTTP服务器统计
 			server.UpdateConnectionCount(int(count))
-		case <-s.ctx.Done():
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -206,411 +767,522 @@ func (s *Server) getConnCount() int32 {
 	return s.connCount
 }
 
-// handleConnection 处理连接
-func (s *Server) handleConnection(conn net.Conn) {
+// handleConnection 处理连接，overLimit 为 true 时连接超过了最大并发连接数，选择认证方法后应答拒绝
+func (s *Server) handleConnection(rawConn net.Conn, overLimit bool) {
+	// 握手阶段按长度读取报文，客户端分片或合并发送的数据都保留在缓冲区中
+	conn := newBufferedConn(rawConn)
 	defer func() {
-		s.decrementConnCount()
+		if overLimit {
+			s.rejecting.Add(-1)
+		} else {
+			s.decrementConnCount()
+		}
 		// 更新HTTP服务器统计
 		server.UpdateConnectionCount(int(s.getConnCount()))
-		if conn != nil {
-			conn.Close()
-		}
+		conn.Close()
 	}()
 
-	// 设置连接超时
-	conn.SetDeadline(time.Now().Add(ConnectionTimeout))
-
-	log.Printf("%s 新连接: %v", LogPrefixServer, conn.RemoteAddr())
+	sess := newSession(conn, s.logger(), s.sessionTimeouts())
+	// 握手阶段（认证和读取请求）的超时，进入转发阶段后清除
+	conn.SetDeadline(time.Now().Add(sess.timeouts.handshake))
+	if !s.addSession(sess) {
+		return
+	}
+	defer s.removeSession(sess)
+	defer s.logAccess(sess)
+	sess.log.Info("新连接", "client", conn.RemoteAddr().String())
 
-	// 认证
-	err := s.auth(conn)
+	// 协商认证方法
+	method, err := s.selectMethod(sess)
 	if err != nil {
-		log.Printf("%s 认证失败: %v", LogPrefixServer, err)
+		sess.log.Info("认证失败", "error", err)
+		sess.fail("auth_failed")
 		return
 	}
 
-	log.Printf("%s 认证成功", LogPrefixServer)
+	// 超过最大并发连接数，选择认证方法后直接应答拒绝，不校验密码，拒绝数已在接受连接时统计
+	if overLimit {
+		sess.log.Warn("超过最大并发连接数，拒绝连接")
+		sess.fail("max_connections")
+		s.sendReply(sess, ReplyConnectionNotAllowed, nil)
+		return
+	}
+
+	// 认证
+	if err := s.auth(sess, method); err != nil {
+		sess.log.Info("认证失败", "error", err)
+		sess.fail("auth_failed")
+		return
+	}
 
 	// 增加总连接数统计
 	server.IncrementTotalConnections()
 
 	// 处理SOCKS5请求
-	s.handleSocks5Request(conn)
+	s.handleSocks5Request(sess)
 }
 
 // handleSocks5Request 处理SOCKS5请求
-func (s *Server) handleSocks5Request(conn net.Conn) {
-	// 设置读取超时
-	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-
-	bytes := make([]byte, 1024)
-	read, err := conn.Read(bytes)
-	if err != nil {
-		log.Printf("%s 读取SOCKS5请求失败: %v", LogPrefixServer, err)
+func (s *Server) handleSocks5Request(sess *session) {
+	conn := sess.conn
+
+	var request Request
+	if _, err := request.ReadFrom(conn.reader); err != nil {
+		sess.log.Info("读取SOCKS5请求失败", "error", err)
+		sess.fail("handshake_error")
+		// 地址类型未知时无法确定报文长度，应答后关闭连接
+		if errors.Is(err, ErrAddrTypeNotSupported) {
+			s.sendReply(sess, ReplyAddressNotSupported, nil)
+		}
 		return
 	}
-	bytes = bytes[:read]
-	log.Printf("%s 收到SOCKS5请求: %x", LogPrefixServer, bytes)
-
-	if len(bytes) < 5 {
-		log.Printf("%s 请求长度不足", LogPrefixServer)
+	sess.command = commandName(request.Command)
+	sess.target = request.Addr.String()
+	sess.log.Info("收到请求", "command", sess.command, "target", sess.target)
+
+	// 按认证用户限流
+	if !s.limiter.allowUser(sess.user) {
+		sess.log.Warn("连接被限流拒绝", "scope", "user", "user", sess.user)
+		server.IncrementRejectedConnections("rate_limit_user")
+		sess.fail("rate_limit_user")
+		s.sendReply(sess, ReplyConnectionNotAllowed, nil)
 		return
 	}
 
-	cmd := bytes[1]
-	addrType := bytes[3]
-
-	// 根据地址类型确定地址字段的起始位置
-	var addrData []byte
-	switch addrType {
-	case IPv4:
-		// IPv4: 4字节IP + 2字节端口
-		if len(bytes) < 10 {
-			log.Printf("%s IPv4地址数据长度不足", LogPrefixServer)
-			return
-		}
-		addrData = bytes[4:10]
-	case Domain:
-		// 域名: 1字节长度 + 域名 + 2字节端口
-		if len(bytes) < 5 {
-			log.Printf("%s 域名地址数据长度不足", LogPrefixServer)
-			return
-		}
-		domainLen := int(bytes[4])
-		if len(bytes) < 5+domainLen+2 {
-			log.Printf("%s 域名地址数据长度不足", LogPrefixServer)
-			return
-		}
-		addrData = bytes[4 : 5+domainLen+2]
-	case IPv6:
-		// IPv6: 16字节IP + 2字节端口
-		if len(bytes) < 22 {
-			log.Printf("%s IPv6地址数据长度不足", LogPrefixServer)
-			return
-		}
-		addrData = bytes[4:22]
-	default:
-		log.Printf("%s 不支持的地址类型: %d", LogPrefixServer, addrType)
+	// 按用户、来源IP和网段限制并发会话数
+	release, scope, ok := s.concurrency.acquire(sess.user, sess.clientIP())
+	if !ok {
+		sess.log.Warn("超过并发会话上限", "scope", scope, "user", sess.user)
+		server.IncrementRejectedConnections("concurrency_" + scope)
+		sess.fail("concurrency_" + scope)
+		s.sendReply(sess, ReplyConnectionNotAllowed, nil)
 		return
 	}
-
-	array, err := addressResolutionFormByteArray(addrData, addrType)
-	if err != nil {
-		log.Printf("%s 地址解析失败: %v", LogPrefixServer, err)
+	defer release()
+
+	// 配额用完的用户拒绝新请求
+	if reason, ok := s.quotas.begin(sess); !ok {
+		auditLog(sess.log, "配额已用完，拒绝请求", "command", sess.command, "client", conn.RemoteAddr().String(),
+			"user", sess.user, "target", sess.target, "reason", reason)
+		server.IncrementRejectedConnections("quota")
+		sess.fail("quota")
+		s.sendReply(sess, ReplyConnectionNotAllowed, nil)
 		return
 	}
-	log.Printf("%s CMD: %d, 目标: %s", LogPrefixServer, cmd, array)
+	defer s.quotas.end(sess)
+
+	// 登记会话，结束时移除
+	sess.register()
+	defer sess.unregister()
 
-	switch cmd {
+	// 空闲和最长存活时间监控
+	defer sess.watch(sess.timeouts.idle, sess.timeouts.lifetime)()
+
+	switch request.Command {
 	case Connect:
-		s.handleConnect(conn, array)
+		s.handleConnect(sess, &request.Addr)
 	case Bind:
-		s.handleBind(conn, array)
+		s.handleBind(sess, &request.Addr)
 	case UDP:
-		s.handleUDP(conn, array)
+		s.handleUDP(sess, &request.Addr)
 	default:
-		log.Printf("%s 不支持的命令: %d", LogPrefixServer, cmd)
+		sess.log.Warn("不支持的命令", "command", request.Command)
+		sess.fail("command_not_supported")
+		s.sendReply(sess, ReplyCommandNotSupported, nil)
 	}
 }
 
+// sendReply 发送应答并记录应答码，bind为nil时绑定地址填 0.0.0.0:0
+func (s *Server) sendReply(sess *session, code byte, bind *Addr) error {
+	sess.reply = int(code)
+	reply := Reply{Code: code}
+	if bind != nil {
+		reply.Addr = *bind
+	}
+	data, err := reply.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = sess.conn.Write(data)
+	return err
+}
+
 // handleConnect 处理CONNECT命令
-func (s *Server) handleConnect(conn net.Conn, targetAddr string) {
-	log.Printf("%s 处理CONNECT请求，目标: %s", LogPrefixServer, targetAddr)
+func (s *Server) handleConnect(sess *session, target *Addr) {
+	conn := sess.conn
 
-	// 使用带超时的连接
-	dialer := &net.Dialer{
-		Timeout: 10 * time.Second,
+	ips, err := s.checkTarget(sess, target)
+	if err != nil {
+		s.sendReply(sess, replyCodeFromError(err), nil)
+		return
 	}
-	dial, err := dialer.Dial("tcp", targetAddr)
+
+	dialStart := time.Now()
+	dial, err := s.dialTarget(target, ips, sess.timeouts.dial)
+	server.ObserveDial(time.Since(dialStart), err)
 	if err != nil {
-		log.Printf("%s 连接目标失败: %v", LogPrefixServer, err)
-		// 发送连接失败响应
-		conn.Write([]byte{Version, 0x01, Zero, IPv4, 0, 0, 0, 0, 0, 0})
+		// 根据拨号错误发送对应的失败响应
+		code := replyCodeFromError(err)
+		sess.log.Warn("连接目标失败", "error", err, "reply", code)
+		sess.fail("dial_error")
+		s.sendReply(sess, code, nil)
 		return
 	}
 	defer dial.Close()
+	if !sess.track(dial) {
+		return
+	}
 
-	log.Printf("%s 连接目标成功", LogPrefixServer)
-
-	// 发送连接成功响应
-	addr := dial.LocalAddr().String()
-	split := strings.Split(addr, ":")
-	port := split[len(split)-1]
-	parseUint, _ := strconv.ParseUint(port, 10, 16)
-	Type, host, _ := addressResolution(strings.Join(split[:len(split)-1], ":"))
-	p := make([]byte, 2)
-	binary.BigEndian.PutUint16(p, uint16(parseUint))
-	data := []byte{Version, Zero, Zero, Type}
-	data = append(data, host...)
-	data = append(data, p...)
-
-	// 设置写入超时
-	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-	conn.Write(data)
+	sess.log.Debug("连接目标成功", "local", dial.LocalAddr().String(), "remote", dial.RemoteAddr().String())
+	if addr, ok := dial.RemoteAddr().(*net.TCPAddr); ok {
+		sess.resolved = addr.IP.String()
+	}
 
-	log.Printf("%s CONNECT响应已发送，开始转发数据", LogPrefixServer)
+	// 发送连接成功响应，设置写入超时
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err := s.sendReply(sess, ReplySucceeded, AddrFromNetAddr(dial.LocalAddr())); err != nil {
+		sess.log.Info("发送CONNECT响应失败", "error", err)
+		return
+	}
 
 	// 开始数据转发
-	s.forwardData(conn, dial)
+	s.relay(sess, conn, dial)
 }
 
 // handleBind 处理BIND命令
-func (s *Server) handleBind(conn net.Conn, targetAddr string) {
-	log.Printf("%s 处理BIND请求", LogPrefixServer)
+func (s *Server) handleBind(sess *session, target *Addr) {
+	conn := sess.conn
 
-	// BIND命令处理 - 绑定本地端口等待连接
-	listener, err := net.Listen("tcp", ":0")
+	if _, err := s.checkTarget(sess, target); err != nil {
+		s.sendReply(sess, replyCodeFromError(err), nil)
+		return
+	}
+
+	// BIND命令处理 - 在控制连接所在的本地地址上绑定端口等待连接
+	localIP := net.IPv4zero
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
 	if err != nil {
-		log.Printf("%s 创建监听器失败: %v", LogPrefixServer, err)
+		sess.log.Error("创建监听器失败", "error", err)
 		// 发送失败响应
-		conn.Write([]byte{Version, 0x01, Zero, IPv4, 0, 0, 0, 0, 0, 0})
+		s.sendReply(sess, ReplyGeneralFailure, nil)
 		return
 	}
 	defer listener.Close()
-
-	// 获取绑定的地址和端口
-	addr := listener.Addr().String()
-	split := strings.Split(addr, ":")
-	port := split[len(split)-1]
-	parseUint, _ := strconv.ParseUint(port, 10, 16)
-	Type, host, _ := addressResolution(strings.Join(split[:len(split)-1], ":"))
-	p := make([]byte, 2)
-	binary.BigEndian.PutUint16(p, uint16(parseUint))
+	if !sess.track(listener) {
+		return
+	}
 
 	// 发送绑定成功响应
-	data := []byte{Version, Zero, Zero, Type}
-	data = append(data, host...)
-	data = append(data, p...)
-	conn.Write(data)
-	log.Printf("%s BIND响应已发送", LogPrefixServer)
+	if err := s.sendReply(sess, ReplySucceeded, AddrFromNetAddr(listener.Addr())); err != nil {
+		sess.log.Info("发送BIND响应失败", "error", err)
+		return
+	}
+	sess.log.Debug("BIND响应已发送", "bind", listener.Addr().String())
 
 	// 等待连接
 	accept, err := listener.Accept()
 	if err != nil {
-		log.Printf("%s 等待连接失败: %v", LogPrefixServer, err)
+		sess.log.Info("等待连接失败", "error", err)
 		return
 	}
 	defer accept.Close()
+	if !sess.track(accept) {
+		return
+	}
+	if addr, ok := accept.RemoteAddr().(*net.TCPAddr); ok {
+		sess.resolved = addr.IP.String()
+	}
 
-	// 发送连接建立响应
-	conn.Write(data)
-	log.Printf("%s BIND连接建立，开始转发数据", LogPrefixServer)
-	s.forwardData(conn, accept)
+	// 实际连入方同样需要通过黑名单检查
+	if _, err := s.checkTarget(sess, AddrFromNetAddr(accept.RemoteAddr())); err != nil {
+		s.sendReply(sess, replyCodeFromError(err), nil)
+		return
+	}
+
+	// 发送连接建立响应，携带连入方的地址
+	if err := s.sendReply(sess, ReplySucceeded, AddrFromNetAddr(accept.RemoteAddr())); err != nil {
+		sess.log.Info("发送BIND连接响应失败", "error", err)
+		return
+	}
+	sess.log.Debug("BIND连接建立", "peer", accept.RemoteAddr().String())
+	s.relay(sess, conn, accept)
 }
 
 // handleUDP 处理UDP命令
-func (s *Server) handleUDP(conn net.Conn, targetAddr string) {
-	log.Printf("%s 处理UDP请求", LogPrefixServer)
+func (s *Server) handleUDP(sess *session, request *Addr) {
+	conn := sess.conn
 
-	// UDP命令处理 - 建立UDP代理
-	udpAddr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		log.Printf("%s 解析UDP地址失败: %v", LogPrefixServer, err)
-		conn.Write([]byte{Version, 0x01, Zero, IPv4, 0, 0, 0, 0, 0, 0})
-		return
+	// UDP命令处理 - 在控制连接所在的本地地址上建立UDP中继
+	localIP := net.IPv4zero
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
 	}
-
-	udpListener, err := net.ListenUDP("udp", udpAddr)
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
 	if err != nil {
-		log.Printf("%s 创建UDP监听器失败: %v", LogPrefixServer, err)
-		conn.Write([]byte{Version, 0x01, Zero, IPv4, 0, 0, 0, 0, 0, 0})
+		sess.log.Error("创建UDP监听器失败", "error", err)
+		s.sendReply(sess, ReplyGeneralFailure, nil)
 		return
 	}
 	defer udpListener.Close()
+	if !sess.track(udpListener) {
+		return
+	}
 
 	// 发送UDP绑定成功响应
-	addr := udpListener.LocalAddr().String()
-	split := strings.Split(addr, ":")
-	port := split[len(split)-1]
-	parseUint, _ := strconv.ParseUint(port, 10, 16)
-
-	// 使用IPv4地址类型，因为这是最常用的
-	Type := byte(IPv4)
-	host := net.ParseIP("0.0.0.0").To4()
-	p := make([]byte, 2)
-	binary.BigEndian.PutUint16(p, uint16(parseUint))
-	data := []byte{Version, Zero, Zero, Type}
-	data = append(data, host...)
-	data = append(data, p...)
-	conn.Write(data)
+	if err := s.sendReply(sess, ReplySucceeded, AddrFromNetAddr(udpListener.LocalAddr())); err != nil {
+		sess.log.Info("发送UDP响应失败", "error", err)
+		return
+	}
+
+	// UDP关联的生命周期与控制连接一致，取消握手阶段设置的超时
+	// 空闲超时由会话监控负责，数据报转发会刷新活动时间
+	conn.SetDeadline(time.Time{})
 
-	log.Printf("%s UDP代理已建立，开始处理UDP数据", LogPrefixServer)
-	s.handleUDPProxy(conn, udpListener)
+	sess.log.Debug("UDP代理已建立", "bind", udpListener.LocalAddr().String())
+	s.handleUDPProxy(sess, udpListener, request)
 }
 
-// forwardData 转发数据
-func (s *Server) forwardData(conn1, conn2 net.Conn) {
-	// 创建双向数据转发
-	done := make(chan bool, 2)
+// handleUDPProxy 处理UDP代理数据转发
+// 客户端数据报去掉SOCKS5 UDP头后转发给目标，目标的响应加上UDP头后回送客户端，
+// 控制连接关闭时结束整个UDP关联
+func (s *Server) handleUDPProxy(sess *session, udpListener *net.UDPConn, request *Addr) {
+	tcpConn := sess.conn
+	defer tcpConn.Close()
+	defer udpListener.Close()
+
+	// 只接受来自控制连接对端IP的客户端数据报
+	var clientIP net.IP
+	if tcpAddr, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+	// 请求中携带了非零端口时，客户端数据报的源端口也必须与之一致
+	clientPort := int(request.Port)
+
+	// UDP只有一个读取循环，超过带宽限制时等待令牌，期间到达的数据报由内核缓冲或丢弃
+	shape := s.bandwidth.open(sess.user, sess.done)
+	defer shape.close()
 
-	// 从conn1转发到conn2
+	// 控制连接关闭后关闭UDP监听器，从而结束下面的读取循环
 	go func() {
-		defer func() { done <- true }()
-		buffer := make([]byte, 4096)
+		buffer := make([]byte, 1024)
 		for {
-			n, err := conn1.Read(buffer)
-			if err != nil {
+			if _, err := tcpConn.Read(buffer); err != nil {
+				sess.log.Debug("UDP代理控制连接关闭", "error", err)
+				udpListener.Close()
 				return
 			}
-			if n > 0 {
-				_, err = conn2.Write(buffer[:n])
-				if err != nil {
-					return
-				}
-			}
 		}
 	}()
 
-	// 从conn2转发到conn1
-	go func() {
-		defer func() { done <- true }()
-		buffer := make([]byte, 4096)
-		for {
-			n, err := conn2.Read(buffer)
+	// udpTarget 缓存目标地址的解析结果和黑名单检查结果
+	type udpTarget struct {
+		addr    *net.UDPAddr
+		blocked bool
+	}
+
+	var clientAddr *net.UDPAddr
+	resolved := make(map[string]udpTarget)
+	// 客户端发送过数据的目标地址，只回送来自这些地址的数据报，
+	// 避免知道中继端口的第三方（包括黑名单中的地址）向客户端注入数据
+	peers := make(map[string]bool)
+	buffer := make([]byte, MaxUDPPacketSize)
+	for {
+		n, from, err := udpListener.ReadFromUDP(buffer)
+		if err != nil {
+			sess.log.Info("UDP代理结束", "error", err)
+			return
+		}
+
+		isClient := clientAddr != nil && from.IP.Equal(clientAddr.IP) && from.Port == clientAddr.Port
+		if clientAddr == nil && from.IP.Equal(clientIP) && (clientPort == 0 || from.Port == clientPort) {
+			clientAddr = from
+			isClient = true
+			sess.log.Debug("UDP客户端地址", "udpClient", clientAddr.String())
+		}
+
+		if isClient {
+			header, payload, err := ParseUDPDatagram(buffer[:n])
 			if err != nil {
-				return
+				sess.log.Debug("丢弃无效的UDP数据报", "error", err)
+				continue
 			}
-			if n > 0 {
-				_, err = conn1.Write(buffer[:n])
+			target := header.Addr.String()
+			cached, ok := resolved[target]
+			if !ok {
+				// 每个目标只检查一次黑名单，被拒绝的目标后续数据报直接丢弃
+				ips, err := s.checkTarget(sess, &header.Addr)
+				if errors.Is(err, ErrConnectionNotAllowed) {
+					resolved[target] = udpTarget{blocked: true}
+					continue
+				}
 				if err != nil {
-					return
+					continue
 				}
+				// 使用黑名单检查过的地址，避免再次解析得到不同的结果
+				var targetAddr *net.UDPAddr
+				if len(ips) > 0 {
+					targetAddr = &net.UDPAddr{IP: ips[0], Port: int(header.Addr.Port)}
+				} else if targetAddr, err = net.ResolveUDPAddr("udp", target); err != nil {
+					sess.log.Info("解析UDP目标失败", "error", err)
+					continue
+				}
+				cached = udpTarget{addr: targetAddr}
+				resolved[target] = cached
+			}
+			if cached.blocked {
+				continue
+			}
+			peers[cached.addr.String()] = true
+			if !shape.wait(len(payload), true) {
+				return
+			}
+			if _, err := udpListener.WriteToUDP(payload, cached.addr); err != nil {
+				sess.log.Debug("转发UDP数据到目标失败", "error", err)
+				continue
 			}
+			sess.addBytes(int64(len(payload)), 0)
+			server.AddUDPDatagrams(1, 0)
+			continue
 		}
-	}()
-
-	// 等待任一方向完成
-	<-done
-}
 
-// handleUDPProxy 处理UDP代理数据转发
-func (s *Server) handleUDPProxy(tcpConn net.Conn, udpListener *net.UDPConn) {
-	defer tcpConn.Close()
-	defer udpListener.Close()
-	log.Printf("%s 开始UDP代理数据转发", LogPrefixServer)
-
-	// 简单的UDP代理实现
-	// 保持TCP控制连接活跃，UDP数据通过UDP监听器处理
-	buffer := make([]byte, 1024)
-	for {
-		_, err := tcpConn.Read(buffer)
+		// 来自目标的响应，客户端地址未知时无法回送
+		if clientAddr == nil {
+			continue
+		}
+		if !peers[from.String()] {
+			sess.log.Debug("丢弃来自未知来源的UDP数据报", "from", from.String())
+			continue
+		}
+		header := UDPHeader{Addr: *AddrFromNetAddr(from)}
+		datagram, err := header.MarshalBinary()
 		if err != nil {
-			log.Printf("%s UDP代理连接关闭: %v", LogPrefixServer, err)
-			break
+			continue
+		}
+		datagram = append(datagram, buffer[:n]...)
+		if !shape.wait(n, false) {
+			return
 		}
-		// 保持TCP连接活跃，实际UDP数据通过UDP监听器处理
+		if _, err := udpListener.WriteToUDP(datagram, clientAddr); err != nil {
+			sess.log.Debug("回送UDP数据到客户端失败", "error", err)
+			continue
+		}
+		sess.addBytes(0, int64(n))
+		server.AddUDPDatagrams(0, 1)
 	}
 }
 
-// auth 处理客户端认证
-func (s *Server) auth(conn net.Conn) error {
-	bytes := make([]byte, 16)
-	read, err := conn.Read(bytes)
-	if err != nil {
-		log.Printf("%s 认证阶段读取失败: %v", LogPrefixServer, err)
-		return err
-	}
-	bytes = bytes[:read]
-	log.Printf("%s 收到认证请求: %x", LogPrefixServer, bytes)
-
-	if len(bytes) < 3 {
-		return errors.New("认证请求长度不足")
-	}
-
-	version := bytes[0]
-	if version != Version {
-		return fmt.Errorf("协议版本不匹配: 期望 %d, 实际 %d", Version, version)
+// selectMethod 读取客户端支持的认证方法并应答选择的方法
+func (s *Server) selectMethod(sess *session) (uint8, error) {
+	conn := sess.conn
+	var greeting Greeting
+	if _, err := greeting.ReadFrom(conn.reader); err != nil {
+		sess.log.Info("认证阶段读取失败", "error", err)
+		sess.fail("handshake_error")
+		return 0, err
 	}
-
-	methodCount := int(bytes[1])
-	if len(bytes) < 2+methodCount {
-		return errors.New("认证方法数量不匹配")
-	}
-
-	methods := bytes[2 : 2+methodCount]
-	log.Printf("%s 客户端支持的认证方法: %v", LogPrefixServer, methods)
+	methods := greeting.Methods
+	sess.log.Debug("客户端支持的认证方法", "methods", fmt.Sprint(methods))
 
 	// 选择认证方法
 	var selectedMethod uint8
+	found := false
 	for _, method := range methods {
-		for _, supportedMethod := range s.Config.AuthList {
+		for _, supportedMethod := range s.AuthList() {
 			if method == supportedMethod {
 				selectedMethod = method
+				found = true
 				break
 			}
 		}
-		if selectedMethod != 0 {
+		if found {
 			break
 		}
 	}
 
-	if selectedMethod == 0 {
-		log.Printf("%s 没有找到支持的认证方法", LogPrefixServer)
-		conn.Write([]byte{Version, 0xFF}) // 0xFF表示没有可接受的认证方法
-		return errors.New("没有支持的认证方法")
+	if !found {
+		sess.log.Info("没有找到支持的认证方法", "methods", fmt.Sprint(methods))
+		sess.fail("no_acceptable_method")
+		selection := MethodSelection{Method: NoAcceptableMethods}
+		data, _ := selection.MarshalBinary()
+		conn.Write(data)
+		return 0, errors.New("没有支持的认证方法")
 	}
 
 	// 发送认证方法选择响应
-	conn.Write([]byte{Version, selectedMethod})
-	log.Printf("%s 选择认证方法: %d", LogPrefixServer, selectedMethod)
+	selection := MethodSelection{Method: selectedMethod}
+	data, _ := selection.MarshalBinary()
+	conn.Write(data)
+	sess.log.Debug("选择认证方法", "method", selectedMethod)
+	return selectedMethod, nil
+}
 
-	// 处理具体的认证方法
-	switch selectedMethod {
+// auth 按选择的方法认证客户端
+func (s *Server) auth(sess *session, method uint8) error {
+	switch method {
 	case NoAuthenticationRequired:
-		log.Printf("%s 无需认证", LogPrefixServer)
+		server.RecordAuth("none", true)
 		return nil
 	case AccountPasswordAuthentication:
-		return s.handlePasswordAuth(conn)
+		return s.handlePasswordAuth(sess)
 	default:
-		return fmt.Errorf("不支持的认证方法: %d", selectedMethod)
+		return fmt.Errorf("不支持的认证方法: %d", method)
 	}
 }
 
-// handlePasswordAuth 处理用户名密码认证
-func (s *Server) handlePasswordAuth(conn net.Conn) error {
-	bytes := make([]byte, 1024)
-	read, err := conn.Read(bytes)
-	if err != nil {
-		log.Printf("%s 读取认证数据失败: %v", LogPrefixServer, err)
+// handlePasswordAuth 处理用户名密码认证（RFC 1929）
+func (s *Server) handlePasswordAuth(sess *session) error {
+	conn := sess.conn
+	var request UserPassRequest
+	if _, err := request.ReadFrom(conn.reader); err != nil {
+		sess.log.Info("读取认证数据失败", "error", err)
+		sess.fail("handshake_error")
 		return err
 	}
-	bytes = bytes[:read]
-	log.Printf("%s 收到认证数据: %x", LogPrefixServer, bytes)
-
-	if len(bytes) < 3 {
-		return errors.New("认证数据长度不足")
-	}
-
-	version := bytes[0]
-	if version != 0x01 {
-		return fmt.Errorf("认证子协议版本不匹配: 期望 1, 实际 %d", version)
-	}
-
-	usernameLen := int(bytes[1])
-	if len(bytes) < 2+usernameLen+1 {
-		return errors.New("用户名长度不匹配")
-	}
-
-	username := string(bytes[2 : 2+usernameLen])
-	passwordLen := int(bytes[2+usernameLen])
-
-	if len(bytes) < 2+usernameLen+1+passwordLen {
-		return errors.New("密码长度不匹配")
+	username, password := request.Username, request.Password
+	clientIP := sess.clientIP()
+
+	// 被封禁的用户名直接返回失败，不校验密码
+	if remaining, banned := s.authGuard.bannedUser(clientIP, username); banned {
+		sess.log.Warn("用户名已被封禁", "user", username, "remaining", remaining.Round(time.Second))
+		server.IncrementRejectedConnections("banned_user")
+		sess.fail("banned_user")
+		server.RecordAuth("password", false)
+		reply := UserPassReply{Status: UserPassFailure}
+		data, _ := reply.MarshalBinary()
+		conn.Write(data)
+		return errors.New("用户名已被封禁")
 	}
 
-	password := string(bytes[3+usernameLen : 3+usernameLen+passwordLen])
-
-	log.Printf("%s 认证信息 - 用户名: %s, 密码: %s", LogPrefixServer, username, password)
-
 	// 验证用户名密码
-	expectedPassword, exists := s.UserMap[username]
-	if !exists || expectedPassword != password {
-		log.Printf("%s 认证失败 - 用户名: %s", LogPrefixServer, username)
-		conn.Write([]byte{0x01, 0x01}) // 认证失败
+	store := s.userStore()
+	if store == nil || !store.Authenticate(username, password) {
+		sess.log.Warn("用户名或密码错误", "user", username, "client", conn.RemoteAddr().String())
+		server.IncrementRejectedConnections("auth_failed")
+		server.RecordAuth("password", false)
+		// 失败次数越多应答越慢，会话被终止时不再等待
+		if delay := s.authGuard.failure(clientIP, username); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-sess.done:
+			}
+			timer.Stop()
+		}
+		reply := UserPassReply{Status: UserPassFailure}
+		data, _ := reply.MarshalBinary()
+		conn.Write(data)
 		return errors.New("用户名或密码错误")
 	}
+	s.authGuard.success(clientIP, username)
+	server.RecordAuth("password", true)
 
-	log.Printf("%s 认证成功 - 用户名: %s", LogPrefixServer, username)
-	conn.Write([]byte{0x01, 0x00}) // 认证成功
+	sess.log.Info("认证成功", "user", username)
+	sess.user = username
+	reply := UserPassReply{Status: UserPassSuccess}
+	data, _ := reply.MarshalBinary()
+	conn.Write(data)
 	return nil
 }
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+// startServer 在空闲端口启动服务器，测试结束时关闭
+func startServer(t *testing.T, cfg server.Socks5Config) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", cfg.Host+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg.Port = port
+	users, err := NewUserStoreFromConfig(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: ConfigFromSocks5(cfg), Users: users}
+	go s.Start()
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	ready := false
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if !ready {
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				ready = true
+			}
+		}
+		// 等探测连接的会话结束后再返回，避免影响连接计数
+		if ready && s.getConnCount() == 0 {
+			t.Cleanup(func() { s.Shutdown(context.Background()) })
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("服务器未启动")
+		}
+	}
+}
+
+// startTarget 启动一个TCP目标，每个连接交给 handle 处理
+func startTarget(t *testing.T, handle func(net.Conn)) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}})
+	addr := net.JoinHostPort(s.Config.Host, strconv.Itoa(int(s.Config.Port)))
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port}
+
+	conn, err := client.TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	// 关闭期间不再接受新连接，已有会话继续转发
+	for deadline := time.Now().Add(time.Second); ; {
+		c, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("关闭后仍在接受新连接")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.Draining() {
+		t.Error("关闭期间 Draining = false")
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("关闭期间转发失败: %q, %v", buf, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("会话结束前 Shutdown 已返回: %v", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown = %v, want nil", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("会话结束后 Shutdown 没有返回")
+	}
+}
+
+func TestShutdownTimeoutClosesSessions(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", AuthList: []int{0}})
+	client := &Client{Host: "127.0.0.1", Port: s.Config.Port}
+
+	conn, err := client.TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// 超时后剩余会话被强制关闭
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("会话没有被关闭: %v", err)
+	}
+}
+
+func TestConfigSessionTimeouts(t *testing.T) {
+	got := (&Config{}).sessionTimeouts()
+	if want := (sessionTimeouts{handshake: ConnectionTimeout, dial: DefaultDialTimeout}); got != want {
+		t.Errorf("默认超时 = %+v, want %+v", got, want)
+	}
+	cfg := Config{HandshakeTimeout: time.Second, DialTimeout: 2 * time.Second, IdleTimeout: 3 * time.Second, MaxSessionLifetime: time.Hour}
+	got = cfg.sessionTimeouts()
+	if want := (sessionTimeouts{handshake: time.Second, dial: 2 * time.Second, idle: 3 * time.Second, lifetime: time.Hour}); got != want {
+		t.Errorf("超时 = %+v, want %+v", got, want)
+	}
+}
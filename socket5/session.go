@@ -0,0 +1,240 @@
+package socks5
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go-socket5/server"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session 一次客户端连接对应的SOCKS5会话
+type session struct {
+	id      string        // 会话ID
+	conn    *bufferedConn // 客户端连接
+	user    string        // 认证用户名，无认证时为空
+	command string        // 请求命令
+	target  string        // 请求的目标地址
+	start   time.Time     // 会话开始时间
+	log     *slog.Logger  // 带有会话ID的日志记录器
+
+	timeouts sessionTimeouts // 会话开始时的超时快照，之后修改的超时不影响本会话
+
+	info  *server.ConnectionInfo // 登记到管理接口的连接信息，请求解析后才有值
+	quota *quotaTracker          // 配额统计，不受配额限制的会话为nil
+
+	reply    int    // 最后发送的应答码，未发送应答时为 -1
+	resolved string // 实际连接的目标IP（CONNECT）或连入方IP（BIND）
+	failure  string // 握手或请求阶段失败的原因，只记录第一次
+
+	lastActive atomic.Int64 // 最近一次转发数据的时间（UnixNano）
+
+	mu          sync.Mutex
+	closers     []io.Closer // 会话关联的上游连接和监听器
+	closed      bool
+	closeReason string        // 会话被主动终止的原因
+	done        chan struct{} // 会话被终止时关闭
+}
+
+// 会话被主动终止的原因
+const (
+	closeKilled      = "killed"       // 管理接口终止
+	closeShutdown    = "shutdown"     // 服务器关闭
+	closeIdleTimeout = "idle_timeout" // 空闲超时
+	closeMaxLifetime = "max_lifetime" // 超过最长存活时间
+	closeQuota       = "quota"        // 配额用完
+)
+
+// newSession 为新连接创建会话，会话内的日志都带有会话ID
+func newSession(conn *bufferedConn, logger *slog.Logger, timeouts sessionTimeouts) *session {
+	id := newSessionID()
+	return &session{
+		id:       id,
+		conn:     conn,
+		start:    time.Now(),
+		log:      logger.With(LogKeySession, id),
+		timeouts: timeouts,
+		reply:    -1,
+		done:     make(chan struct{}),
+	}
+}
+
+// newSessionID 生成随机会话ID
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// clientIP 返回客户端IP
+func (sess *session) clientIP() net.IP {
+	if addr, ok := sess.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// register 请求解析后将会话登记到管理接口
+func (sess *session) register() {
+	clientAddr := sess.conn.RemoteAddr().String()
+	clientIP, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		clientIP = clientAddr
+	}
+	sess.info = &server.ConnectionInfo{
+		ID:         sess.id,
+		ClientIP:   clientIP,
+		ClientAddr: clientAddr,
+		User:       sess.user,
+		Command:    sess.command,
+		Target:     sess.target,
+		StartTime:  sess.start,
+	}
+	server.AddConnection(sess.info, func() { sess.close(closeKilled) })
+}
+
+// unregister 会话结束时从管理接口移除
+func (sess *session) unregister() {
+	if sess.info != nil {
+		server.RemoveConnection(sess.id)
+	}
+}
+
+// track 关联上游连接或监听器，会话被终止时一并关闭
+// 会话已经被终止时立即关闭 c 并返回false
+func (sess *session) track(c io.Closer) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		c.Close()
+		return false
+	}
+	sess.closers = append(sess.closers, c)
+	return true
+}
+
+// close 终止会话，关闭客户端连接和所有关联的连接，可重复调用，只记录第一次的原因
+// 本次调用终止了会话时返回true
+func (sess *session) close(reason string) bool {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return false
+	}
+	sess.closed = true
+	sess.closeReason = reason
+	close(sess.done)
+	closers := sess.closers
+	sess.closers = nil
+	sess.mu.Unlock()
+
+	sess.log.Info("终止会话", "reason", reason)
+	sess.conn.Close()
+	for _, c := range closers {
+		c.Close()
+	}
+	return true
+}
+
+// fail 记录会话失败的原因，只记录第一次
+func (sess *session) fail(reason string) {
+	if sess.failure == "" {
+		sess.failure = reason
+	}
+}
+
+// endReason 返回会话结束的原因：主动终止的原因优先，其次是失败原因，都没有时为 closed
+func (sess *session) endReason() string {
+	sess.mu.Lock()
+	reason := sess.closeReason
+	sess.mu.Unlock()
+	switch {
+	case reason != "":
+		return reason
+	case sess.failure != "":
+		return sess.failure
+	default:
+		return "closed"
+	}
+}
+
+// watch 启动空闲超时和最长存活时间监控，返回停止监控的函数
+// 两者都为0时不启动监控
+func (sess *session) watch(idle, lifetime time.Duration) (stop func()) {
+	if idle <= 0 && lifetime <= 0 {
+		return func() {}
+	}
+	sess.lastActive.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	go func() {
+		var expire <-chan time.Time
+		if lifetime > 0 {
+			timer := time.NewTimer(lifetime)
+			defer timer.Stop()
+			expire = timer.C
+		}
+		var tick <-chan time.Time
+		if idle > 0 {
+			// 检查间隔取空闲超时的1/4，超时误差不超过25%
+			interval := idle / 4
+			if interval < time.Millisecond {
+				interval = time.Millisecond
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-expire:
+				sess.close(closeMaxLifetime)
+				return
+			case now := <-tick:
+				if now.Sub(time.Unix(0, sess.lastActive.Load())) >= idle {
+					sess.close(closeIdleTimeout)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// addBytes 累加转发字节数，up 为客户端发往目标，down 为目标返回客户端
+// 同时刷新空闲超时的活动时间，配额用完且配置了 cut_off 时终止会话
+func (sess *session) addBytes(up, down int64) {
+	sess.lastActive.Store(time.Now().UnixNano())
+	if sess.info != nil {
+		sess.info.AddBytes(up, down)
+	}
+	if sess.quota != nil && sess.quota.addBytes(sess.user, up+down) {
+		if sess.close(closeQuota) {
+			auditLog(sess.log, "配额已用完，断开会话", "user", sess.user)
+		}
+	}
+}
+
+// commandName 返回命令名称
+func commandName(cmd byte) string {
+	switch cmd {
+	case Connect:
+		return "CONNECT"
+	case Bind:
+		return "BIND"
+	case UDP:
+		return "UDP"
+	default:
+		return fmt.Sprintf("0x%02x", cmd)
+	}
+}
@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socket5/server"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	s := startServer(t, server.Socks5Config{Host: "127.0.0.1", User: "registry-user", Password: "pw", AuthList: []int{2}})
+	client := &Client{
+		Host:     "127.0.0.1",
+		Port:     s.Config.Port,
+		UserName: "registry-user",
+		Password: "pw",
+	}
+
+	before := server.GetActiveConnections()
+	conn, err := client.TcpProxy("127.0.0.1", uint16(target.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if n := server.GetActiveConnections(); n != before+1 {
+		t.Fatalf("登记的会话数 = %d, want %d", n, before+1)
+	}
+
+	// 按用户和目标从管理接口终止会话
+	filter := server.ConnectionFilter{User: "registry-user", ClientIP: "127.0.0.1", Target: "127.0.0.1"}
+	if n := server.CloseConnections(filter); n != 1 {
+		t.Fatalf("CloseConnections = %d, want 1", n)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("会话没有被终止: %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); server.GetActiveConnections() != before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("会话结束后没有移除: %d, want %d", server.GetActiveConnections(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,369 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go-socket5/server"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UserStore 用户存储接口，用于用户名密码认证
+// 实现必须是并发安全的，允许在服务器运行期间更新用户
+type UserStore interface {
+	// Authenticate 校验用户名和密码
+	Authenticate(username, password string) bool
+	// Users 返回所有用户名
+	Users() []string
+}
+
+// sortedUsers 返回排序后的用户名列表
+func sortedUsers(users map[string]string) []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MemoryUserStore 内存用户存储
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]string // 用户名到密码的映射
+}
+
+// NewMemoryUserStore 创建内存用户存储，users 为用户名到密码的映射
+// 密码可以是明文，也可以是 HashPassword 生成的哈希；不支持格式的哈希始终认证失败，加载配置和用户文件时会被拒绝
+func NewMemoryUserStore(users map[string]string) *MemoryUserStore {
+	m := &MemoryUserStore{}
+	m.Replace(users)
+	return m
+}
+
+// passwordLookup 可以按用户名查询密码的用户存储，MultiUserStore 据此只在包含该用户的存储中校验一次
+type passwordLookup interface {
+	// lookup 返回用户保存的密码或哈希
+	lookup(username string) (string, bool)
+}
+
+// lookup 返回用户保存的密码或哈希
+func (m *MemoryUserStore) lookup(username string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.users[username]
+	return stored, ok
+}
+
+// Authenticate 校验用户名和密码
+func (m *MemoryUserStore) Authenticate(username, password string) bool {
+	stored, ok := m.lookup(username)
+	if !ok {
+		// 用户不存在时同样校验一次哈希，避免通过响应时间判断用户名是否存在
+		verifyPassword(dummyPasswordHash(), password)
+		return false
+	}
+	return verifyPassword(stored, password)
+}
+
+// Users 返回所有用户名
+func (m *MemoryUserStore) Users() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return sortedUsers(m.users)
+}
+
+// Set 添加或更新用户
+func (m *MemoryUserStore) Set(username, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[username] = password
+}
+
+// Delete 删除用户
+func (m *MemoryUserStore) Delete(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, username)
+}
+
+// Replace 整体替换用户列表
+func (m *MemoryUserStore) Replace(users map[string]string) {
+	copied := make(map[string]string, len(users))
+	for name, password := range users {
+		copied[name] = password
+	}
+	m.mu.Lock()
+	m.users = copied
+	m.mu.Unlock()
+}
+
+// fileCheckInterval 文件用户存储检查修改时间的最小间隔
+const fileCheckInterval = time.Second
+
+// FileUserStore 基于文件的用户存储，文件修改后自动重新加载
+// 重新加载失败时保留上一次成功加载的用户
+type FileUserStore struct {
+	path   string
+	parse  func([]byte) (map[string]string, error)
+	store  *MemoryUserStore
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	modTime time.Time // 上次加载时文件的修改时间
+	checked time.Time // 上次检查文件的时间
+}
+
+// NewYAMLUserStore 创建YAML文件用户存储，文件格式与配置中的 users 列表一致：
+//
+//	users:
+//	  - username: alice
+//	    password: secret
+//
+// logger 用于记录加载和重新加载，为 nil 时使用 slog.Default()
+func NewYAMLUserStore(path string, logger *slog.Logger) (*FileUserStore, error) {
+	return newFileUserStore(path, parseYAMLUsers, logger)
+}
+
+// NewHtpasswdUserStore 创建htpasswd文件用户存储，每行格式为 "用户名:哈希"
+// 支持 apr1（htpasswd 默认）、{SHA}、bcrypt（htpasswd -B 生成）、MD5-crypt、argon2id 和 scrypt
+// 不支持明文、crypt 以及 $5$、$6$ 等格式，文件中存在时加载失败
+func NewHtpasswdUserStore(path string, logger *slog.Logger) (*FileUserStore, error) {
+	return newFileUserStore(path, parseHtpasswd, logger)
+}
+
+// newFileUserStore 创建文件用户存储并立即加载一次
+func newFileUserStore(path string, parse func([]byte) (map[string]string, error), logger *slog.Logger) (*FileUserStore, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	f := &FileUserStore{
+		path:   path,
+		parse:  parse,
+		store:  NewMemoryUserStore(nil),
+		logger: logger,
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload 重新读取用户文件
+func (f *FileUserStore) Reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("解析用户文件 %s 失败: %v", f.path, err)
+	}
+	f.store.Replace(users)
+
+	f.mu.Lock()
+	f.modTime = info.ModTime()
+	f.checked = time.Now()
+	f.mu.Unlock()
+	f.logger.Info("已加载用户文件", "path", f.path, "users", len(users))
+	return nil
+}
+
+// reloadIfModified 文件修改时间变化时重新加载
+func (f *FileUserStore) reloadIfModified() {
+	f.mu.Lock()
+	if time.Since(f.checked) < fileCheckInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.checked = time.Now()
+	modTime := f.modTime
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := f.Reload(); err != nil {
+		f.logger.Warn("重新加载用户文件失败，继续使用旧数据", "path", f.path, "error", err)
+	}
+}
+
+// lookup 返回用户保存的密码或哈希
+func (f *FileUserStore) lookup(username string) (string, bool) {
+	f.reloadIfModified()
+	return f.store.lookup(username)
+}
+
+// Authenticate 校验用户名和密码
+func (f *FileUserStore) Authenticate(username, password string) bool {
+	f.reloadIfModified()
+	return f.store.Authenticate(username, password)
+}
+
+// Users 返回所有用户名
+func (f *FileUserStore) Users() []string {
+	f.reloadIfModified()
+	return f.store.Users()
+}
+
+// parseYAMLUsers 解析YAML用户文件
+func parseYAMLUsers(data []byte) (map[string]string, error) {
+	var file struct {
+		Users []struct {
+			Username     string `yaml:"username"`
+			Password     string `yaml:"password"`
+			PasswordHash string `yaml:"password_hash"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(file.Users))
+	for _, u := range file.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("用户名不能为空")
+		}
+		password, err := passwordEntry(u.Password, u.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("用户 %s: %v", u.Username, err)
+		}
+		users[u.Username] = password
+	}
+	return users, nil
+}
+
+// passwordEntry 返回用户存储中保存的密码或哈希，同时设置时以 passwordHash 为准
+// passwordHash 必须是支持的哈希；password 为哈希格式时按哈希处理，同样必须是支持的格式
+func passwordEntry(password, passwordHash string) (string, error) {
+	if passwordHash != "" {
+		if !isHashed(passwordHash) {
+			return "", fmt.Errorf("password_hash 不是哈希格式")
+		}
+		if err := checkPasswordHash(passwordHash); err != nil {
+			return "", fmt.Errorf("password_hash: %v", err)
+		}
+		return passwordHash, nil
+	}
+	if isHashed(password) {
+		if err := checkPasswordHash(password); err != nil {
+			return "", fmt.Errorf("password 为哈希格式但无法校验: %v", err)
+		}
+	}
+	return password, nil
+}
+
+// parseHtpasswd 解析htpasswd文件，忽略空行和以#开头的行，密码必须是支持的哈希格式
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("第 %d 行格式错误", line)
+		}
+		if !isHashed(password) {
+			return nil, fmt.Errorf("第 %d 行: 用户 %s 的密码不是支持的哈希格式（不支持明文和crypt）", line, username)
+		}
+		if err := checkPasswordHash(password); err != nil {
+			return nil, fmt.Errorf("第 %d 行: 用户 %s: %v", line, username, err)
+		}
+		users[username] = password
+	}
+	return users, scanner.Err()
+}
+
+// MultiUserStore 组合多个用户存储，用户存在于多个存储中时以第一个为准
+type MultiUserStore []UserStore
+
+// Authenticate 按顺序查找用户，只用第一个包含该用户的存储校验一次密码
+// 用户不存在时只校验一次哈希，避免通过响应时间判断用户名是否存在；不支持按用户名查询的自定义存储按顺序调用其 Authenticate
+func (m MultiUserStore) Authenticate(username, password string) bool {
+	for _, store := range m {
+		lookup, ok := store.(passwordLookup)
+		if !ok {
+			if store.Authenticate(username, password) {
+				return true
+			}
+			continue
+		}
+		if stored, ok := lookup.lookup(username); ok {
+			return verifyPassword(stored, password)
+		}
+	}
+	verifyPassword(dummyPasswordHash(), password)
+	return false
+}
+
+// Users 返回所有存储中的用户名（去重）
+func (m MultiUserStore) Users() []string {
+	all := make(map[string]string)
+	for _, store := range m {
+		for _, name := range store.Users() {
+			all[name] = ""
+		}
+	}
+	return sortedUsers(all)
+}
+
+// NewUserStoreFromConfig 按配置文件中的 socks5 配置创建用户存储
+// 兼容旧的 user/password 单用户配置，users 列表与用户文件可同时使用，同名用户以配置中的为准
+// logger 用于记录用户文件的加载，为 nil 时使用 slog.Default()
+func NewUserStoreFromConfig(cfg server.Socks5Config, logger *slog.Logger) (UserStore, error) {
+	users := make(map[string]string)
+	if cfg.User != "" {
+		password, err := passwordEntry(cfg.Password, "")
+		if err != nil {
+			return nil, fmt.Errorf("用户 %s: %v", cfg.User, err)
+		}
+		users[cfg.User] = password
+	}
+	for _, u := range cfg.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("users 中存在空用户名")
+		}
+		password, err := passwordEntry(u.Password, u.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("用户 %s: %v", u.Username, err)
+		}
+		users[u.Username] = password
+	}
+	stores := MultiUserStore{NewMemoryUserStore(users)}
+
+	if cfg.UsersFile != "" {
+		store, err := NewYAMLUserStore(cfg.UsersFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	if cfg.HtpasswdFile != "" {
+		store, err := NewHtpasswdUserStore(cfg.HtpasswdFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+
+	if len(stores) == 1 {
+		return stores[0], nil
+	}
+	return stores, nil
+}
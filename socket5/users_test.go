@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiUserStoreAuthenticate(t *testing.T) {
+	first := NewMemoryUserStore(map[string]string{"alice": "first", "bob": "bobpw"})
+	second := NewMemoryUserStore(map[string]string{"alice": "second", "carol": "carolpw"})
+	store := MultiUserStore{first, second}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "first", true},
+		{"alice", "second", false}, // 同名用户以第一个存储为准
+		{"bob", "bobpw", true},
+		{"carol", "carolpw", true},
+		{"carol", "wrong", false},
+		{"nobody", "first", false},
+	}
+	for _, tt := range tests {
+		if got := store.Authenticate(tt.user, tt.password); got != tt.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+	if got, want := store.Users(), []string{"alice", "bob", "carol"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Users() = %v, want %v", got, want)
+	}
+}
+
+func TestFileUserStoreReload(t *testing.T) {
+	tests := []struct {
+		name      string
+		open      func(path string, logger *slog.Logger) (*FileUserStore, error)
+		old, next string
+	}{
+		{
+			"YAML",
+			NewYAMLUserStore,
+			"users:\n  - username: alice\n    password: secret\n",
+			"users:\n  - username: bob\n    password: secret\n",
+		},
+		{
+			"htpasswd",
+			NewHtpasswdUserStore,
+			"alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+			"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users")
+			modTime := time.Now().Add(-time.Hour)
+			write := func(content string) {
+				t.Helper()
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				// 修改时间变化后立即检查，不等待检查间隔
+				modTime = modTime.Add(time.Minute)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			write(tt.old)
+			var logs bytes.Buffer
+			store, err := tt.open(path, slog.New(slog.NewTextHandler(&logs, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !store.Authenticate("alice", "secret") {
+				t.Fatal("加载后 alice 认证失败")
+			}
+
+			// 检查间隔内不重新加载
+			write(tt.next)
+			if !store.Authenticate("alice", "secret") {
+				t.Error("检查间隔内重新加载了文件")
+			}
+			store.checked = time.Time{}
+			if store.Authenticate("alice", "secret") || !store.Authenticate("bob", "secret") {
+				t.Error("修改时间变化后没有重新加载")
+			}
+
+			// 文件有错误时继续使用旧数据并记录警告
+			write("users: [\nbroken")
+			store.checked = time.Time{}
+			if !store.Authenticate("bob", "secret") {
+				t.Error("重新加载失败后没有保留旧数据")
+			}
+			if !strings.Contains(logs.String(), "已加载用户文件") || !strings.Contains(logs.String(), "重新加载用户文件失败") {
+				t.Errorf("日志没有记录加载结果: %s", logs.String())
+			}
+		})
+	}
+}
@@ -10,14 +10,20 @@ let serverStats = {
 let serverConfig = {
     host: '0.0.0.0',
     port: 1080,
-    user: 'test',
-    authMethods: ['无认证', '用户名密码认证'],
-    maxConnections: 10000,
+    user: '',
+    authList: [],
     blackList: []
 };
 
+// 认证方法的名称
+const AUTH_METHOD_NAMES = { 0: '无认证', 2: '用户名密码认证' };
+
 let activeConnections = [];
 let serverLogs = [];
+let logStream = null; // 实时日志的 EventSource
+
+// 日志面板最多保留的条数
+const MAX_LOG_ENTRIES = 500;
 
 // 更新运行时间
 function updateUptime() {
@@ -86,10 +92,25 @@ async function fetchActiveConnections() {
     }
 }
 
-// 获取服务器日志
+// 日志面板的过滤条件
+function logFilterParams() {
+    const params = new URLSearchParams();
+    const fields = { level: 'logLevel', session: 'logSession', user: 'logUser' };
+    for (const [name, id] of Object.entries(fields)) {
+        const element = document.getElementById(id);
+        if (element && element.value.trim()) {
+            params.set(name, element.value.trim());
+        }
+    }
+    return params;
+}
+
+// 获取服务器日志，然后从最后一条开始实时接收新日志
 async function fetchServerLogs() {
+    const params = logFilterParams();
+    params.set('limit', MAX_LOG_ENTRIES);
     try {
-        const response = await fetch('/api/logs?limit=100');
+        const response = await fetch('/api/logs?' + params);
         if (response.ok) {
             const data = await response.json();
             serverLogs = data.logs || [];
@@ -97,25 +118,43 @@ async function fetchServerLogs() {
         }
     } catch (error) {
         console.log('无法获取服务器日志:', error);
-        // 使用模拟日志数据
-        serverLogs = [
-            '[INFO] 服务器启动成功',
-            '[INFO] 监听地址: 0.0.0.0:1080',
-            '[INFO] 认证方式: 用户名密码认证',
-            '[INFO] 等待客户端连接...',
-            '[INFO] 新连接: 127.0.0.1:12345',
-            '[INFO] 认证成功',
-            '[INFO] 连接目标: example.com:80',
-            '[INFO] 数据传输完成'
-        ];
-        updateLogsDisplay();
     }
+    startLogStream();
+}
+
+// 订阅实时日志，断线后 EventSource 自动重连并通过 Last-Event-ID 续传
+function startLogStream() {
+    if (logStream) {
+        logStream.close();
+    }
+    const params = logFilterParams();
+    if (serverLogs.length > 0) {
+        params.set('after', serverLogs[serverLogs.length - 1].id);
+    }
+    logStream = new EventSource('/api/logs/stream?' + params);
+    logStream.addEventListener('log', event => {
+        serverLogs.push(JSON.parse(event.data));
+        if (serverLogs.length > MAX_LOG_ENTRIES) {
+            serverLogs.splice(0, serverLogs.length - MAX_LOG_ENTRIES);
+        }
+        updateLogsDisplay();
+    });
+    logStream.onerror = () => console.log('实时日志连接中断，正在重连');
+}
+
+// 格式化一条日志：时间 级别 消息 属性
+function formatLogEntry(entry) {
+    const time = new Date(entry.time).toLocaleTimeString();
+    const attrs = Object.entries(entry.attrs || {})
+        .map(([key, value]) => `${key}=${typeof value === 'object' ? JSON.stringify(value) : value}`)
+        .join(' ');
+    return `${time} [${entry.level}] ${entry.message} ${attrs}`;
 }
 
 // 更新服务器配置
-async function updateServerConfig(newConfig) {
+async function updateServerConfig(newConfig, persist = false) {
     try {
-        const response = await fetch('/api/config', {
+        const response = await fetch('/api/config' + (persist ? '?persist=true' : ''), {
             method: 'PUT',
             headers: {
                 'Content-Type': 'application/json'
@@ -125,7 +164,14 @@ async function updateServerConfig(newConfig) {
         
         if (response.ok) {
             const result = await response.json();
-            showNotification('配置更新成功', 'success');
+            const update = result.update;
+            if (update.changed.length === 0) {
+                showNotification('配置没有变化', 'info');
+            } else if (update.restartRequired.length > 0) {
+                showNotification(`配置已更新，${update.restartRequired.join(', ')} 需要重启后生效`, 'warning');
+            } else {
+                showNotification('配置更新成功', 'success');
+            }
             fetchServerConfig(); // 重新获取配置
             return true;
         } else {
@@ -163,11 +209,13 @@ function updateStatsDisplay() {
 function updateConfigDisplay() {
     const configElement = document.getElementById('serverConfig');
     if (configElement) {
+        const authMethods = (serverConfig.authList || []).map(method => AUTH_METHOD_NAMES[method] || method);
+        const users = (serverConfig.users || []).length + (serverConfig.user ? 1 : 0);
         configElement.innerHTML = `
-            <p><strong>监听地址:</strong> ${serverConfig.host}:${serverConfig.port}</p>
-            <p><strong>认证用户:</strong> ${serverConfig.user}</p>
-            <p><strong>最大连接数:</strong> ${serverConfig.maxConnections}</p>
-            <p><strong>认证方式:</strong> ${serverConfig.authMethods.join(', ')}</p>
+            <p><strong>监听地址:</strong> ${escapeHtml(serverConfig.host)}:${serverConfig.port}</p>
+            <p><strong>认证方式:</strong> ${escapeHtml(authMethods.join(', ') || '无')}</p>
+            <p><strong>配置的用户数:</strong> ${users}</p>
+            <p><strong>黑名单规则数:</strong> ${(serverConfig.blackList || []).length}</p>
         `;
     }
 }
@@ -177,12 +225,17 @@ function updateConfigForm() {
     const hostElement = document.getElementById('configHost');
     const portElement = document.getElementById('configPort');
     const userElement = document.getElementById('configUser');
-    const maxConnectionsElement = document.getElementById('configMaxConnections');
+    const authNoneElement = document.getElementById('configAuthNone');
+    const authPasswordElement = document.getElementById('configAuthPassword');
+    const blackListElement = document.getElementById('configBlackList');
+    const authList = serverConfig.authList || [];
     
     if (hostElement) hostElement.value = serverConfig.host;
     if (portElement) portElement.value = serverConfig.port;
     if (userElement) userElement.value = serverConfig.user;
-    if (maxConnectionsElement) maxConnectionsElement.value = serverConfig.maxConnections;
+    if (authNoneElement) authNoneElement.checked = authList.includes(0);
+    if (authPasswordElement) authPasswordElement.checked = authList.includes(2);
+    if (blackListElement) blackListElement.value = (serverConfig.blackList || []).join('\n');
 }
 
 // 更新连接显示
@@ -199,13 +252,19 @@ function updateConnectionsDisplay() {
             const duration = Math.floor((Date.now() - new Date(conn.startTime).getTime()) / 1000);
             const durationStr = formatDuration(duration);
             
+            const user = conn.user ? `${escapeHtml(conn.user)}@` : '';
+            
             html += `
                 <div class="connection-item">
                     <div class="connection-info">
-                        <strong>${conn.clientIP}</strong> → <strong>${conn.target}</strong>
+                        <strong>${user}${escapeHtml(conn.clientAddr || conn.clientIP)}</strong>
+                        → ${escapeHtml(conn.command || '')} <strong>${escapeHtml(conn.target)}</strong>
                         <span class="connection-duration">${durationStr}</span>
+                        <span class="connection-duration">↑${formatBytes(conn.bytesIn || 0)} ↓${formatBytes(conn.bytesOut || 0)}</span>
                     </div>
                     <button class="button-small" onclick="disconnectConnection('${conn.id}')">断开</button>
+                    ${conn.user ? `<button class="button-small" onclick="disconnectConnections('user', '${encodeURIComponent(conn.user).replace(/'/g, '%27')}')">断开该用户</button>` : ''}
+                    <button class="button-small" onclick="disconnectConnections('clientIP', '${encodeURIComponent(conn.clientIP).replace(/'/g, '%27')}')">断开该IP</button>
                 </div>
             `;
         });
@@ -223,17 +282,42 @@ function updateLogsDisplay() {
             return;
         }
         
+        // 已滚动到底部时跟随新日志，查看历史日志时不打断
+        const atBottom = logsElement.scrollTop + logsElement.clientHeight >= logsElement.scrollHeight - 20;
         let html = '';
-        serverLogs.forEach(log => {
-            html += `<p>${log}</p>`;
+        serverLogs.forEach(entry => {
+            html += `<p class="log-${escapeHtml(entry.level.toLowerCase())}">${escapeHtml(formatLogEntry(entry))}</p>`;
         });
         logsElement.innerHTML = html;
         
-        // 滚动到底部
-        logsElement.scrollTop = logsElement.scrollHeight;
+        if (atBottom) {
+            logsElement.scrollTop = logsElement.scrollHeight;
+        }
     }
 }
 
+// 格式化字节数
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let value = bytes;
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    return unit === 0 ? `${value} ${units[unit]}` : `${value.toFixed(1)} ${units[unit]}`;
+}
+
+// 转义HTML，连接信息中的用户名和目标来自客户端输入
+function escapeHtml(text) {
+    return String(text)
+        .replace(/&/g, '&amp;')
+        .replace(/</g, '&lt;')
+        .replace(/>/g, '&gt;')
+        .replace(/"/g, '&quot;')
+        .replace(/'/g, '&#39;');
+}
+
 // 格式化持续时间
 function formatDuration(seconds) {
     const hours = Math.floor(seconds / 3600);
@@ -268,48 +352,177 @@ async function disconnectConnection(connectionId) {
     }
 }
 
+// 批量断开连接，field 为 user、clientIP 或 target，value 已经过URL编码
+async function disconnectConnections(field, value) {
+    if (!confirm(`确定断开 ${field}=${decodeURIComponent(value)} 的所有连接吗？`)) {
+        return;
+    }
+    try {
+        const response = await fetch(`/api/connections?${field}=${value}`, {
+            method: 'DELETE'
+        });
+        
+        if (response.ok) {
+            const result = await response.json();
+            showNotification(result.message, 'success');
+            fetchActiveConnections(); // 刷新连接列表
+        } else {
+            showNotification('断开连接失败', 'error');
+        }
+    } catch (error) {
+        console.log('断开连接失败:', error);
+        showNotification('断开连接失败', 'error');
+    }
+}
+
 // 测试连接
-async function testConnection(host, port) {
+async function testConnection(host, port, options = {}) {
     try {
         const response = await fetch('/api/test', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
             },
-            body: JSON.stringify({ host, port })
+            body: JSON.stringify({ host, port, ...options })
         });
+        const result = await response.json();
         
-        if (response.ok) {
-            const result = await response.json();
-            showNotification(result.message, 'success');
-        } else {
-            showNotification('连接测试失败', 'error');
+        if (!response.ok) {
+            showNotification(`连接测试失败: ${result.error}`, 'error');
+            return;
         }
+        showTestResult(result);
+        showNotification(result.message, result.success ? 'success' : 'error');
     } catch (error) {
         console.log('连接测试失败:', error);
         showNotification('连接测试失败', 'error');
     }
 }
 
-// 重启服务器
+// 连接测试各阶段的名称
+const TEST_PHASES = [
+    ['handshake', 'SOCKS5握手'],
+    ['dns', '域名解析'],
+    ['connect', '连接目标'],
+    ['tls', 'TLS握手'],
+    ['http', 'HTTP请求']
+];
+
+// 显示连接测试的各阶段耗时
+function showTestResult(result) {
+    const resultElement = document.getElementById('testResult');
+    if (!resultElement) return;
+    
+    const rows = TEST_PHASES
+        .filter(([key]) => result.timings[key] !== undefined)
+        .map(([key, name]) => {
+            const failed = result.failedPhase === key ? ' ❌' : '';
+            return `<p><strong>${name}:</strong> ${result.timings[key].toFixed(1)} ms${failed}</p>`;
+        });
+    if (result.resolvedIPs) {
+        rows.push(`<p><strong>解析结果:</strong> ${escapeHtml(result.resolvedIPs.join(', '))}</p>`);
+    }
+    if (result.tlsVersion) {
+        rows.push(`<p><strong>TLS版本:</strong> ${escapeHtml(result.tlsVersion)}</p>`);
+    }
+    if (result.httpStatus) {
+        rows.push(`<p><strong>HTTP状态码:</strong> ${result.httpStatus}</p>`);
+    }
+    if (result.replyCode !== undefined) {
+        rows.push(`<p><strong>SOCKS5应答码:</strong> 0x${result.replyCode.toString(16).padStart(2, '0')}</p>`);
+    }
+    
+    resultElement.innerHTML = `
+        <p>${result.success ? '✅' : '❌'} ${escapeHtml(result.message)}</p>
+        <p><strong>代理:</strong> ${escapeHtml(result.proxy || '-')}，<strong>用户:</strong> ${escapeHtml(result.user || '无认证')}</p>
+        ${rows.join('')}
+        <p><strong>总耗时:</strong> ${result.timings.total.toFixed(1)} ms</p>
+    `;
+}
+
+// 重启的各个阶段
+const RESTART_PHASES = {
+    reloading: '正在读取配置文件',
+    starting: '正在启动新监听器',
+    draining: '新监听器已开始接受连接，等待重启前的会话结束',
+    stopping: '新监听器已开始接受连接，正在关闭重启前的会话',
+    running: '新监听器已开始接受连接',
+    failed: '重启失败'
+};
+
+// 显示重启进度
+function showRestartProgress(status) {
+    const progressElement = document.getElementById('restartProgress');
+    if (!progressElement) return;
+    
+    let text = RESTART_PHASES[status.phase] || status.phase;
+    if (status.phase === 'draining' || status.phase === 'stopping') {
+        text += `（当前共 ${status.sessions} 个会话）`;
+    } else if (status.phase === 'running' && status.acceptingAt) {
+        const elapsed = (new Date(status.acceptingAt) - new Date(status.startedAt)) / 1000;
+        text += `：${status.addr}，${new Date(status.acceptingAt).toLocaleTimeString()}，耗时 ${elapsed.toFixed(1)} 秒`;
+    } else if (status.phase === 'failed' && status.error) {
+        text += `：${status.error}`;
+    }
+    progressElement.textContent = text;
+}
+
+// 重启服务器，重启期间轮询进度
 async function restartServer() {
-    if (!confirm('确定要重启服务器吗？')) {
+    const mode = document.getElementById('restartMode').value;
+    const message = mode === 'immediate' ? '确定要立即重启服务器吗？所有会话将被断开' : '确定要重启服务器吗？';
+    if (!confirm(message)) {
         return;
     }
     
+    const button = document.getElementById('restartButton');
+    button.disabled = true;
+    let finished = false;
+    let draining = false;
+    const stop = () => {
+        finished = true;
+        clearInterval(poller);
+        button.disabled = false;
+    };
+    const poller = setInterval(async () => {
+        try {
+            const response = await fetch('/api/restart');
+            if (response.ok && !finished) {
+                const status = await response.json();
+                showRestartProgress(status);
+                // 新监听器接受连接后继续轮询，直到重启前的会话全部结束
+                if (draining && (status.phase === 'running' || status.phase === 'failed')) {
+                    stop();
+                }
+            }
+        } catch (error) {
+            console.log('获取重启进度失败:', error);
+        }
+    }, 500);
+    
     try {
-        const response = await fetch('/api/restart', {
+        const response = await fetch(`/api/restart?mode=${mode}`, {
             method: 'POST'
         });
+        const result = await response.json();
         
+        if (result.restart) {
+            showRestartProgress(result.restart);
+            draining = response.ok && result.restart.phase === 'draining';
+        }
         if (response.ok) {
-            showNotification('重启请求已发送', 'success');
+            showNotification('SOCKS5服务器已重启', 'success');
+            fetchServerConfig();
         } else {
-            showNotification('重启请求失败', 'error');
+            showNotification(`重启失败: ${result.error}`, 'error');
         }
     } catch (error) {
         console.log('重启请求失败:', error);
         showNotification('重启请求失败', 'error');
+    } finally {
+        if (!draining) {
+            stop();
+        }
     }
 }
 
@@ -322,7 +535,7 @@ function refreshStats() {
     showNotification('状态已刷新', 'success');
 }
 
-// 刷新日志
+// 刷新日志，按当前过滤条件重新加载并订阅
 function refreshLogs() {
     fetchServerLogs();
     showNotification('日志已刷新', 'success');
@@ -332,24 +545,35 @@ function refreshLogs() {
 async function updateConfig() {
     const host = document.getElementById('configHost').value;
     const port = parseInt(document.getElementById('configPort').value);
-    const user = document.getElementById('configUser').value;
-    const maxConnections = parseInt(document.getElementById('configMaxConnections').value);
+    const user = document.getElementById('configUser').value.trim();
+    const authList = [];
+    if (document.getElementById('configAuthNone').checked) authList.push(0);
+    if (document.getElementById('configAuthPassword').checked) authList.push(2);
+    const blackList = document.getElementById('configBlackList').value
+        .split('\n')
+        .map(rule => rule.trim())
+        .filter(rule => rule);
     
-    if (!host || !port || !user || !maxConnections) {
+    if (!host || !port) {
         showNotification('请填写完整的配置信息', 'error');
         return;
     }
+    if (authList.length === 0) {
+        showNotification('至少需要一种认证方式', 'error');
+        return;
+    }
     
+    // 只提交表单中的配置项，其余配置项保持不变
     const newConfig = {
         host: host,
         port: port,
         user: user,
-        maxConnections: maxConnections,
-        authMethods: serverConfig.authMethods,
-        blackList: serverConfig.blackList
+        authList: authList,
+        blackList: blackList
     };
+    const persist = document.getElementById('configPersist').checked;
     
-    await updateServerConfig(newConfig);
+    await updateServerConfig(newConfig, persist);
 }
 
 // 显示通知
@@ -376,6 +600,8 @@ function showNotification(message, type = 'info') {
         notification.style.backgroundColor = '#28a745';
     } else if (type === 'error') {
         notification.style.backgroundColor = '#dc3545';
+    } else if (type === 'warning') {
+        notification.style.backgroundColor = '#fd7e14';
     } else {
         notification.style.backgroundColor = '#007bff';
     }
@@ -475,7 +701,6 @@ document.addEventListener('DOMContentLoaded', function() {
     setInterval(updateUptime, 1000);
     setInterval(fetchServerStats, 5000);
     setInterval(fetchActiveConnections, 10000);
-    setInterval(fetchServerLogs, 30000); // 30秒刷新一次日志
     
     // 绑定按钮事件
     const refreshButtons = document.querySelectorAll('[onclick="refreshStats()"]');
@@ -493,6 +718,7 @@ document.addEventListener('DOMContentLoaded', function() {
 window.refreshStats = refreshStats;
 window.showNotification = showNotification;
 window.disconnectConnection = disconnectConnection;
+window.disconnectConnections = disconnectConnections;
 window.testConnection = testConnection;
 window.restartServer = restartServer;
 window.refreshLogs = refreshLogs;